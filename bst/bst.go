@@ -2,8 +2,8 @@ package bst
 
 import (
 	"github.com/ygzhang-yolo/lsmtree/kv"
-	"log"
 	"sync"
+	"unsafe"
 )
 
 /**
@@ -17,9 +17,10 @@ import (
 //  @Description: treeNode树节点
 //
 type TreeNode struct {
-	KV    kv.Value
-	Left  *TreeNode
-	Right *TreeNode
+	KV      kv.Value
+	History []kv.Value // 为快照保留的旧版本, 从新到旧排列
+	Left    *TreeNode
+	Right   *TreeNode
 }
 
 //
@@ -27,19 +28,71 @@ type TreeNode struct {
 //  @Description: 二叉搜索树
 //
 type BSTree struct {
-	root  *TreeNode
-	count int
-	mu    *sync.RWMutex
+	root    *TreeNode
+	count   int
+	entries int           // key(包括只有删除标记的)和范围删除标记的数量
+	size    int64         // 估算占用的内存字节数, 包括节点和版本的开销
+	maxSeq  uint64        // 树中最大的序列号
+	cmp     kv.Comparator // key的比较器
+	ranges  kv.RangeIndex // 范围删除标记, 按Start排列
+	mu      *sync.RWMutex
 }
 
 func NewBSTree() BSTree {
+	return NewBSTreeWith(kv.Bytewise)
+}
+
+//
+// New
+//  @Description: 创建一个按cmp排列key的二叉搜索树内存表, 可以用作 config.Config.MemTable
+//  @param cmp
+//  @return kv.MemTable
+//
+func New(cmp kv.Comparator) kv.MemTable {
+	t := NewBSTreeWith(cmp)
+	return &t
+}
+
+//
+// NewBSTreeWith
+//  @Description: 创建一个按cmp排列key的二叉搜索树
+//  @param cmp
+//  @return BSTree
+//
+func NewBSTreeWith(cmp kv.Comparator) BSTree {
 	return BSTree{
-		root:  nil,
-		count: 0,
-		mu:    &sync.RWMutex{},
+		root:   nil,
+		count:  0,
+		cmp:    cmp,
+		ranges: kv.NewRangeIndex(cmp, nil),
+		mu:     &sync.RWMutex{},
 	}
 }
 
+//
+// Empty
+//  @Description: 判断树中是否没有任何节点和范围删除标记, 包括删除标记
+//  @receiver t
+//  @return bool
+//
+func (t *BSTree) Empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root == nil && t.ranges.Len() == 0
+}
+
+//
+// Entries
+//  @Description: 返回树中的条目数量, 包括删除标记和范围删除标记, 用于按数量落盘
+//  @receiver t
+//  @return int
+//
+func (t *BSTree) Entries() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.entries
+}
+
 //
 // GetCount
 //  @Description: 返回BST树中的元素数量
@@ -61,26 +114,41 @@ func (t *BSTree) GetCount() int {
 //  @return kv.SearchResult
 //
 func (t *BSTree) Get(key string) (kv.Value, kv.SearchResult) {
+	return t.GetAt(key, kv.MaxSeq)
+}
+
+//
+// GetAt
+//  @Description: 查找key在序列号seq时的值, 即 Seq <= seq 的最新版本
+//  @receiver t
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//
+func (t *BSTree) GetAt(key string, seq uint64) (kv.Value, kv.SearchResult) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
-	// tree必须非空
-	if t == nil {
-		log.Fatalf("Get [key=%v] error, tree is nil!", key)
-	}
 	// BST的二分搜索
 	cur := t.root
 	for cur != nil {
-		if key > cur.KV.Key {
+		if c := kv.CompareKeys(t.cmp, key, cur.KV.Key); c > 0 {
 			cur = cur.Right
-		} else if key < cur.KV.Key {
+		} else if c < 0 {
 			cur = cur.Left
 		} else {
-			// 找到了对应的节点
+			// 找到了对应的节点, 取出对seq可见的版本
+			value, ok := cur.visible(seq)
+			if !ok {
+				return kv.Value{}, kv.None
+			}
 			// 确定是否是删掉的节点
-			if cur.KV.Deleted == true {
-				return kv.Value{}, kv.Deleted
+			if value.Deleted == true {
+				return value, kv.Deleted
+			} else if value.Merge {
+				return value, kv.MergeOperand
 			} else {
-				return cur.KV, kv.Success
+				return value, kv.Success
 			}
 		}
 	}
@@ -98,121 +166,235 @@ func (t *BSTree) Get(key string) (kv.Value, kv.SearchResult) {
 //  @return valid	是否有旧值
 //
 func (t *BSTree) Set(key string, value []byte) (kv.Value, bool) {
+	return t.Put(kv.Value{Key: key, Value: value}, 0)
+}
+
+//
+// Delete
+//  @Description: 删除key并返回旧值
+//  @receiver t
+//  @param key
+//  @return kv.Value
+//  @return bool
+//
+func (t *BSTree) Delete(key string) (kv.Value, bool) {
+	return t.Put(kv.Value{Key: key, Deleted: true}, 0)
+}
+
+//
+// Put
+//  @Description: 写入一个版本(设置值, 删除标记或者合并操作数)并返回旧值; 快照或者还停在写入之前的读取可能还在读的旧版本,
+//  以及合并操作数合并时需要的旧版本保留到History中, 规则见 kv.KeepVersions
+//  @receiver t
+//  @param value
+//  @param retain	最新的存活快照的序列号, 没有快照时为0
+//  @return kv.Value	旧值
+//  @return bool	是否有未删除的旧值
+//
+func (t *BSTree) Put(value kv.Value, retain uint64) (kv.Value, bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	// tree必须非空
-	if t == nil {
-		log.Fatalf("Set [key=%v] error, tree is nil!", key)
+	return t.put(value, retain, kv.PublishedBefore(value.Seq))
+}
+
+//
+// PutBatch
+//  @Description: 在一次加锁中依次写入values, 读操作要么看到全部写入, 要么一个都看不到
+//  @receiver t
+//  @param values
+//  @param retain
+//
+func (t *BSTree) PutBatch(values []kv.Value, retain uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(values) == 0 {
+		return
 	}
+	// 整批写完之后才发布序列号, 读取一直停在第一条之前
+	floor := kv.PublishedBefore(values[0].Seq)
+	for _, value := range values {
+		t.put(value, retain, floor)
+	}
+}
 
-	newNode := &TreeNode{
-		KV: kv.Value{
-			Key:   key,
-			Value: value,
-		},
+func (t *BSTree) put(value kv.Value, retain uint64, floor uint64) (kv.Value, bool) {
+	if value.Seq > t.maxSeq {
+		t.maxSeq = value.Seq
 	}
-	cur := t.root
-	// 如果当前还没有根节点, 则新建并返回
-	if cur == nil {
-		t.root = newNode
-		t.count++
-		return kv.Value{}, false
+
+	newNode := &TreeNode{
+		KV: value,
 	}
-	// 二分查找key的位置
-	for cur != nil {
-		if key < cur.KV.Key {
-			// 要插入左子树
-			if cur.Left == nil {
-				// 左子树为空, 可直接插入
-				cur.Left = newNode
-				t.count++
-				return kv.Value{}, false
-			}
-			cur = cur.Left
-		} else if key > cur.KV.Key {
-			// 要插入右子树
-			if cur.Right == nil {
-				// 右子树为空, 直接插入
-				cur.Right = newNode
-				t.count++
-				return kv.Value{}, false
-			}
-			cur = cur.Right
+	// 找到key对应的节点或者插入位置
+	link := &t.root
+	for *link != nil {
+		cur := *link
+		if c := kv.CompareKeys(t.cmp, value.Key, cur.KV.Key); c < 0 {
+			link = &cur.Left
+		} else if c > 0 {
+			link = &cur.Right
 		} else {
 			// 树里key已经存在, 替换新值并返回旧值
-			old := cur.KV.Copy()
-			cur.KV.Value = value
-			cur.KV.Deleted = false
+			old := cur.KV
+			kept, dropped := kv.KeepVersions(value, append([]kv.Value{old}, cur.History...), retain, floor)
+			cur.History = kept
+			for _, v := range dropped {
+				t.size -= kv.VersionSize(v)
+			}
+			t.size += kv.VersionSize(value)
+			cur.KV = value
 			if old.Deleted {
 				return kv.Value{}, false
-			} else {
-				return *old, true
 			}
+			if value.Deleted {
+				// NOTE: count 应该是统计当前树中存在的有效节点，但是如果删除一个不存在的key，这个count会计算错误, 应该要在添加删除Node的时候count增加一下来保证count数量正确
+				t.count--
+			}
+			return old, true
 		}
 	}
-	// 说明插入树中失败
-	log.Fatalf("Set value error, [key=%v, value=%v]]", key, value)
+	// key不存在, 插入新节点; 删除不存在的key也会插入一个删除节点
+	*link = newNode
+	t.count++
+	t.entries++
+	t.size += nodeSize(value.Key) + kv.VersionSize(value)
 	return kv.Value{}, false
 }
 
 //
-// Delete
-//  @Description: 删除key并返回旧值
-//  @receiver t
+// entrySize
+//  @Description: 一个版本的数据字节数, 按key和值的长度计算, 用于估算范围内的数据大小
+//  @param value
+//  @return int64
+//
+func entrySize(value kv.Value) int64 {
+	return int64(len(value.Key) + len(value.Value))
+}
+
+//
+// nodeSize
+//  @Description: 一个节点和它的key大约占用的字节数, 节点中的最新版本由 kv.VersionSize 计算
 //  @param key
+//  @return int64
+//
+func nodeSize(key string) int64 {
+	return int64(unsafe.Sizeof(TreeNode{})-unsafe.Sizeof(kv.Value{})) + int64(len(key))
+}
+
+//
+// visible
+//  @Description: 返回节点中对序列号seq可见的最新版本
+//  @receiver n
+//  @param seq
 //  @return kv.Value
 //  @return bool
 //
-func (t *BSTree) Delete(key string) (kv.Value, bool) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	// tree必须非空
-	if t == nil {
-		log.Fatalf("Delete [key=%v] error, tree is nil!", key)
+func (n *TreeNode) visible(seq uint64) (kv.Value, bool) {
+	if n.KV.Seq <= seq {
+		return n.KV, true
 	}
-	del := &TreeNode{
-		KV: kv.Value{
-			Key:     key,
-			Value:   nil,
-			Deleted: true,
-		},
+	for _, value := range n.History {
+		if value.Seq <= seq {
+			return value, true
+		}
 	}
+	return kv.Value{}, false
+}
+
+//
+// GetChainAt
+//  @Description: 返回key在序列号seq时需要合并的一串版本, 从新到旧排列: 从可见的最新版本开始,
+//  到第一个不是合并操作数的版本为止; 最后一个仍是操作数时, 说明旧值在更旧的数据源中
+//  @receiver t
+//  @param key
+//  @param seq
+//  @return []kv.Value
+//
+func (t *BSTree) GetChainAt(key string, seq uint64) []kv.Value {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	cur := t.root
-	if cur == nil {
-		t.root = del
-		return kv.Value{}, false
-	}
-	// 二分查找
 	for cur != nil {
-		if key < cur.KV.Key {
-			if cur.Left == nil {
-				// 删除不存在的key, 将对应的delete位置true
-				cur.Left = del
-				t.count++
-			}
-			cur = cur.Left
-		} else if key > cur.KV.Key {
-			if cur.Right == nil {
-				cur.Right = del
-				t.count++
-			}
+		if c := kv.CompareKeys(t.cmp, key, cur.KV.Key); c > 0 {
 			cur = cur.Right
+		} else if c < 0 {
+			cur = cur.Left
 		} else {
-			// 存在的key, 判断是否已经删除
-			if cur.KV.Deleted == true {
-				// 已经删除了就直接返回
-				return kv.Value{}, false
-			} else {
-				old := cur.KV.Copy()
-				cur.KV = del.KV
-				// NOTE: count 应该是统计当前树中存在的有效节点，但是如果删除一个不存在的key，这个count会计算错误, 应该要在添加删除Node的时候count增加一下来保证count数量正确
-				t.count--
-				return *old, true
-			}
+			break
 		}
 	}
-	log.Fatalf("Delete value error, [key=%v]]", key)
-	return kv.Value{}, false
+	chain := make([]kv.Value, 0)
+	if cur == nil {
+		return chain
+	}
+	for _, value := range append([]kv.Value{cur.KV}, cur.History...) {
+		if value.Seq > seq {
+			continue
+		}
+		chain = append(chain, value)
+		if !value.Merge {
+			break
+		}
+	}
+	return chain
+}
+
+//
+// PutRange
+//  @Description: 写入一个范围删除标记, 树中被它遮住的版本不会修改, 读取时再判断
+//  @receiver t
+//  @param r
+//
+func (t *BSTree) PutRange(r kv.RangeTombstone) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.Seq > t.maxSeq {
+		t.maxSeq = r.Seq
+	}
+	t.ranges.Add(r)
+	t.entries++
+	t.size += kv.RangeSize(r)
+}
+
+//
+// RangesAt
+//  @Description: 返回对序列号seq可见的范围删除标记
+//  @receiver t
+//  @param seq
+//  @return []kv.RangeTombstone
+//
+func (t *BSTree) RangesAt(seq uint64) []kv.RangeTombstone {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ranges.RangesAt(seq)
+}
+
+//
+// Covering
+//  @Description: 找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记
+//  @receiver t
+//  @param key
+//  @param seq
+//  @param at
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (t *BSTree) Covering(key string, seq uint64, at uint64) (kv.RangeTombstone, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ranges.Covering(key, seq, at)
+}
+
+//
+// MaxSeq
+//  @Description: 返回树中最大的序列号
+//  @receiver t
+//  @return uint64
+//
+func (t *BSTree) MaxSeq() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.maxSeq
 }
 
 //
@@ -246,19 +428,151 @@ func (t *BSTree) GetKV() []kv.Value {
 	return values
 }
 
+//
+// GetVersions
+//  @Description: 中序遍历返回树中的所有元素及其保留的旧版本, 按key升序, 同一个key从新到旧排列
+//  @receiver t
+//  @return []kv.Value
+//
+func (t *BSTree) GetVersions() []kv.Value {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	values := make([]kv.Value, 0, t.count)
+	t.rangeNode(t.root, "", "", func(node *TreeNode) {
+		values = append(values, node.KV)
+		values = append(values, node.History...)
+	})
+	return values
+}
+
+//
+// Range
+//  @Description: 中序遍历返回树中key在[start, end)范围内的元素, 包括删除标记; end为空表示没有上界
+//  @receiver t
+//  @param start
+//  @param end
+//  @return []kv.Value	返回一个有序的元素切片
+//
+func (t *BSTree) Range(start string, end string) []kv.Value {
+	return t.RangeAt(start, end, kv.MaxSeq)
+}
+
+//
+// RangeAt
+//  @Description: 与Range相同, 但每个key只返回对序列号seq可见的版本, 没有可见版本的key不返回
+//  @receiver t
+//  @param start
+//  @param end
+//  @param seq
+//  @return []kv.Value
+//
+func (t *BSTree) RangeAt(start string, end string, seq uint64) []kv.Value {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	values := make([]kv.Value, 0)
+	t.rangeNode(t.root, start, end, func(node *TreeNode) {
+		if value, ok := node.visible(seq); ok {
+			values = append(values, value)
+		}
+	})
+	return values
+}
+
+//
+// ApproximateRange
+//  @Description: 估算key在[start, end)内的数据大小和key数量, 大小按key和值的字节数计算, 包括为快照保留的旧版本
+//  @receiver t
+//  @param start
+//  @param end
+//  @return int64
+//  @return int	key的数量, 包括删除标记
+//
+func (t *BSTree) ApproximateRange(start string, end string) (int64, int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var size int64
+	count := 0
+	t.rangeNode(t.root, start, end, func(node *TreeNode) {
+		count++
+		for _, value := range append([]kv.Value{node.KV}, node.History...) {
+			size += entrySize(value)
+		}
+	})
+	return size, count
+}
+
+//
+// ApproximateSize
+//  @Description: 估算树中数据的总大小, 按key和值的字节数计算
+//  @receiver t
+//  @return int64
+//
+func (t *BSTree) ApproximateSize() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
+
+//
+// NewIterator
+//  @Description: 返回[start, end)内对序列号seq可见的版本的迭代器, 遍历的是创建时的副本
+//  @receiver t
+//  @param start
+//  @param end
+//  @param seq
+//  @return kv.Iterator
+//
+func (t *BSTree) NewIterator(start string, end string, seq uint64) kv.Iterator {
+	return kv.NewSliceIterator(t.RangeAt(start, end, seq), t.cmp)
+}
+
+//
+// rangeNode
+//  @Description: 对以node为根的子树做剪枝的中序遍历, 只访问可能落在范围内的子树; start为空表示没有下界
+//  @receiver t
+//  @param node
+//  @param start
+//  @param end
+//  @param visit
+//
+func (t *BSTree) rangeNode(node *TreeNode, start string, end string, visit func(node *TreeNode)) {
+	if node == nil {
+		return
+	}
+	key := node.KV.Key
+	if start == "" || kv.CompareKeys(t.cmp, key, start) > 0 {
+		t.rangeNode(node.Left, start, end, visit)
+	}
+	if kv.InRange(t.cmp, key, start, end) {
+		visit(node)
+	}
+	if end == "" || kv.CompareKeys(t.cmp, key, end) < 0 {
+		t.rangeNode(node.Right, start, end, visit)
+	}
+}
+
 //
 // Swap
 //  @Description: 将t置空, 返回t的副本
 //  @receiver t
 //
-func (t *BSTree) Swap() *BSTree {
+func (t *BSTree) Swap() kv.MemTable {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	newTree := NewBSTree()
+	newTree := NewBSTreeWith(t.cmp)
 	newTree.root = t.root
 	newTree.count = t.count
+	newTree.entries = t.entries
+	newTree.size = t.size
+	newTree.maxSeq = t.maxSeq
+	newTree.ranges = t.ranges
 	t.root = nil
 	t.count = 0
+	t.entries = 0
+	t.size = 0
+	t.ranges = kv.NewRangeIndex(t.cmp, nil)
 	return &newTree
 }
+
+var _ kv.MemTable = (*BSTree)(nil)
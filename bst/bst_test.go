@@ -47,6 +47,11 @@ func TestBSTree(t *testing.T) {
 	if count != 2 {
 		t.Error(count)
 	}
+	// 按数量落盘时删除标记也算一个条目
+	tree.Delete("z")
+	if entries := tree.Entries(); entries != 4 {
+		t.Error("entries", entries)
+	}
 
 	data, success := tree.Get("a")
 	if success != kv.Deleted {
@@ -62,3 +67,61 @@ func TestBSTree(t *testing.T) {
 		t.Error(data)
 	}
 }
+
+func TestBSTree_Range(t *testing.T) {
+	tree := NewBSTree()
+	for _, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+		tree.Set(key, []byte(key))
+	}
+	tree.Delete("c")
+
+	values := tree.Range("b", "f")
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		keys = append(keys, value.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "c", "d", "e"}) {
+		t.Error(keys)
+	}
+	if !values[1].Deleted {
+		t.Error("the key 'c' should be a deleted node")
+	}
+
+	values = tree.Range("e", "")
+	if len(values) != 3 || values[0].Key != "e" || values[2].Key != "g" {
+		t.Error(values)
+	}
+}
+
+func TestBSTree_Versions(t *testing.T) {
+	tree := NewBSTree()
+	tree.Put(kv.Value{Key: "a", Value: []byte{1}, Seq: 1}, 0)
+	// 快照2还在读seq=1的版本, 需要保留
+	tree.Put(kv.Value{Key: "a", Value: []byte{2}, Seq: 3}, 2)
+	// 序列号4发布之前读取还停在3上, 保留
+	tree.Put(kv.Value{Key: "a", Deleted: true, Seq: 4}, 2)
+	if values := tree.GetVersions(); len(values) != 3 || values[1].Seq != 3 {
+		t.Error(values)
+	}
+	// 没有快照读seq=3的版本, 不再保留
+	tree.Put(kv.Value{Key: "a", Deleted: true, Seq: 5}, 2)
+
+	if _, result := tree.Get("a"); result != kv.Deleted {
+		t.Error(result)
+	}
+	if value, result := tree.GetAt("a", 2); result != kv.Success || value.Value[0] != 1 {
+		t.Error(value, result)
+	}
+	if _, result := tree.GetAt("a", 0); result != kv.None {
+		t.Error(result)
+	}
+	if values := tree.GetVersions(); len(values) != 3 || values[1].Seq != 4 || values[2].Seq != 1 {
+		t.Error(values)
+	}
+	if values := tree.RangeAt("", "", 3); len(values) != 1 || values[0].Seq != 1 {
+		t.Error(values)
+	}
+	if tree.MaxSeq() != 5 {
+		t.Error(tree.MaxSeq())
+	}
+}
@@ -1,6 +1,9 @@
 package config
 
-import "sync"
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"github.com/ygzhang-yolo/lsmtree/skiplist"
+)
 
 /**
  * @Author: ygzhang
@@ -8,29 +11,145 @@ import "sync"
  * @Func:
  **/
 
-// Config 数据库启动配置
+// DefaultWriteBufferSize 没有配置WriteBufferSize时内存表的最大字节数
+const DefaultWriteBufferSize = 4 << 20
+
+// DefaultMaxWalSize 没有配置MaxWalSize时wal.log的最大总字节数
+const DefaultMaxWalSize = 4 * DefaultWriteBufferSize
+
+// Config 数据库启动配置, 每个打开的数据库实例各自持有一份
 type Config struct {
-	DataDir       string // 数据目录
-	Level0Size    int    // 0 层的 所有 SsTable 文件大小总和的最大值，单位 MB，超过此值，该层 SsTable 将会被压缩到下一层
-	PartSize      int    // 每层中 SsTable 表数量的阈值，该层 SsTable 将会被压缩到下一层
-	Threshold     int    // 内存表的 kv 最大数量，超出这个阈值，内存表将会被保存到 SsTable 中
-	CheckInterval int    // 压缩内存、文件的时间间隔，多久进行一次检查工作
+	DataDir         string                              // 数据目录
+	Level0Size      int                                 // 0 层的 所有 SsTable 文件大小总和的最大值，单位 MB，超过此值，该层 SsTable 将会被压缩到下一层
+	PartSize        int                                 // 每层中 SsTable 表数量的阈值，该层 SsTable 将会被压缩到下一层
+	Threshold       int                                 // 内存表的 kv 最大数量(包括删除标记)，超出这个阈值，内存表将会被保存到 SsTable 中; 是字节数之外可选的落盘条件, 为0时不按数量落盘
+	WriteBufferSize int64                               // 内存表估算占用的最大字节数, 超出后保存到 SsTable 中; 为0时使用 DefaultWriteBufferSize
+	CheckInterval   int                                 // 压缩内存、文件的时间间隔，多久进行一次检查工作
+	FlushOnClose    bool                                // 关闭数据库时是否将内存表落盘为 level 0 的 SsTable
+	MaxWalSize      int64                               // wal.log(包括切换出去的旧文件)的最大总字节数, 超出后落盘时一起落盘还拖住旧文件的列族; 为0时使用 DefaultMaxWalSize
+	Codec           kv.Codec                            // 值的默认编码方式, 为空时使用 kv.JSON; 读取时总是使用写入时的编码方式
+	Comparator      kv.Comparator                       // key的比较器, 为空时使用 kv.Bytewise; 名字保存在数据目录中, 不能更换
+	MergeOperator   kv.MergeOperator                    // 合并操作, 为空时不能使用Merge; 有合并操作数的数据目录要一直使用同一个合并操作
+	Families        map[string]Config                   // 打开数据库时已有列族的配置, 没有配置的列族和为零值的选项沿用数据库的配置
+	FeedBuffer      int                                 // 每个订阅最多缓冲的事件数量, 为0时使用1024; 缓冲区满时订阅被关闭
+	MemTable        func(cmp kv.Comparator) kv.MemTable // 内存表的实现, 为空时使用跳表 skiplist.New, 也可以使用 bst.New
+	// 写入限流, 为0时不限制. 减速时每次写入延迟1ms, 阻塞时写入等待后台落盘和压缩追上;
+	// 阻塞的条件要在压缩能消除的范围内, 例如 Level0StopTrigger 要大于 PartSize
+	MaxImmutables             int   // 等待落盘的不可变内存表达到这个数量时阻塞写入
+	Level0SlowdownTrigger     int   // level 0的SSTable达到这个数量时写入减速
+	Level0StopTrigger         int   // level 0的SSTable达到这个数量时阻塞写入
+	PendingCompactionSlowdown int64 // 等待压缩的字节数达到这个值时写入减速
+	PendingCompactionStop     int64 // 等待压缩的字节数达到这个值时阻塞写入
+}
+
+//
+// Inherit
+//  @Description: 返回列族使用的配置: c中为零值的选项沿用数据库的配置base, 数据目录为dir;
+//  检查间隔, 关闭时是否落盘和wal.log的大小限制总是和数据库一致
+//  @receiver c
+//  @param base
+//  @param dir
+//  @return Config
+//
+func (c Config) Inherit(base Config, dir string) Config {
+	c.DataDir = dir
+	c.CheckInterval = base.CheckInterval
+	c.FlushOnClose = base.FlushOnClose
+	c.MaxWalSize = base.MaxWalSize
+	c.Families = nil
+	if c.Level0Size == 0 {
+		c.Level0Size = base.Level0Size
+	}
+	if c.PartSize == 0 {
+		c.PartSize = base.PartSize
+	}
+	if c.Threshold == 0 {
+		c.Threshold = base.Threshold
+	}
+	if c.WriteBufferSize == 0 {
+		c.WriteBufferSize = base.WriteBufferSize
+	}
+	if c.Codec == nil {
+		c.Codec = base.Codec
+	}
+	if c.Comparator == nil {
+		c.Comparator = base.Comparator
+	}
+	if c.MergeOperator == nil {
+		c.MergeOperator = base.MergeOperator
+	}
+	if c.FeedBuffer == 0 {
+		c.FeedBuffer = base.FeedBuffer
+	}
+	if c.MemTable == nil {
+		c.MemTable = base.MemTable
+	}
+	if c.MaxImmutables == 0 {
+		c.MaxImmutables = base.MaxImmutables
+	}
+	if c.Level0SlowdownTrigger == 0 {
+		c.Level0SlowdownTrigger = base.Level0SlowdownTrigger
+	}
+	if c.Level0StopTrigger == 0 {
+		c.Level0StopTrigger = base.Level0StopTrigger
+	}
+	if c.PendingCompactionSlowdown == 0 {
+		c.PendingCompactionSlowdown = base.PendingCompactionSlowdown
+	}
+	if c.PendingCompactionStop == 0 {
+		c.PendingCompactionStop = base.PendingCompactionStop
+	}
+	return c
 }
 
-// 单例模式
-var once *sync.Once = &sync.Once{}
+//
+// GetComparator
+//  @Description: 返回key的比较器, 没有配置时使用 kv.Bytewise
+//  @receiver c
+//  @return kv.Comparator
+//
+func (c Config) GetComparator() kv.Comparator {
+	if c.Comparator == nil {
+		return kv.Bytewise
+	}
+	return c.Comparator
+}
 
-// 常驻内存
-var config Config
+//
+// GetWriteBufferSize
+//  @Description: 返回内存表的最大字节数, 没有配置时使用 DefaultWriteBufferSize; 配置了Threshold时字节数限制仍然有效
+//  @receiver c
+//  @return int64
+//
+func (c Config) GetWriteBufferSize() int64 {
+	if c.WriteBufferSize <= 0 {
+		return DefaultWriteBufferSize
+	}
+	return c.WriteBufferSize
+}
 
-// Init 初始化数据库配置
-func Init(con Config) {
-	once.Do(func() {
-		config = con
-	})
+//
+// GetMaxWalSize
+//  @Description: 返回wal.log的最大总字节数, 没有配置时使用 DefaultMaxWalSize
+//  @receiver c
+//  @return int64
+//
+func (c Config) GetMaxWalSize() int64 {
+	if c.MaxWalSize <= 0 {
+		return DefaultMaxWalSize
+	}
+	return c.MaxWalSize
 }
 
-// GetConfig 获取数据库配置
-func GetConfig() Config {
-	return config
+//
+// NewMemTable
+//  @Description: 按配置的实现创建一个空的内存表, 没有配置时使用跳表
+//  @receiver c
+//  @return kv.MemTable
+//
+func (c Config) NewMemTable() kv.MemTable {
+	if c.MemTable == nil {
+		return skiplist.New(c.GetComparator())
+	}
+	return c.MemTable(c.GetComparator())
 }
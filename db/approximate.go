@@ -0,0 +1,76 @@
+package db
+
+import "github.com/ygzhang-yolo/lsmtree/kv"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:45
+ * @Func: 估算一个key范围的数据大小和key数量, 用于分片和容量规划
+ **/
+
+//
+// ApproximateSize
+//  @Description: 估算key在[start, end)内的数据占用的字节数, end为空表示没有上界; 只使用SSTable的索引和内存表,
+//  不读取数据. 结果包括删除标记, 旧版本和已经过期的元素, 压缩之后会变小
+//  @receiver d
+//  @param start
+//  @param end
+//  @return int64
+//  @return error
+//
+func (d *Database) ApproximateSize(start string, end string) (int64, error) {
+	size, _, err := d.approximate(start, end)
+	return size, err
+}
+
+//
+// ApproximateCount
+//  @Description: 估算key在[start, end)内的key数量, end为空表示没有上界; 同一个key在内存表和多个SSTable中出现时会重复计算,
+//  删除标记也计算在内, 所以结果一般偏大
+//  @receiver d
+//  @param start
+//  @param end
+//  @return int
+//  @return error
+//
+func (d *Database) ApproximateCount(start string, end string) (int, error) {
+	_, count, err := d.approximate(start, end)
+	return count, err
+}
+
+func (d *Database) approximate(start string, end string) (int64, int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return 0, 0, kv.ErrClosed
+	}
+	memSize, memCount := d.memApproximate(start, end)
+	tableSize, tableCount := d.SSTableTree.ApproximateRange(start, end)
+	return memSize + tableSize, memCount + tableCount, nil
+}
+
+//
+// ApproximateSize
+//  @Description: 估算范围内的数据大小, 对Database.ApproximateSize的封装
+//  @param d
+//  @param start
+//  @param end
+//  @return int64
+//  @return error
+//
+func ApproximateSize(d *Database, start string, end string) (int64, error) {
+	return d.ApproximateSize(start, end)
+}
+
+//
+// ApproximateCount
+//  @Description: 估算范围内的key数量, 对Database.ApproximateCount的封装
+//  @param d
+//  @param start
+//  @param end
+//  @return int
+//  @return error
+//
+func ApproximateCount(d *Database, start string, end string) (int, error) {
+	return d.ApproximateCount(start, end)
+}
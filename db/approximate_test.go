@@ -0,0 +1,49 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:45
+ * @Func:
+ **/
+
+func TestApproximate(t *testing.T) {
+	d := openTestDatabase(t)
+	// a:000-a:049在SSTable中, b:000-b:029在内存表中
+	for i := 0; i < 50; i++ {
+		_ = d.SetRaw(fmt.Sprintf("a:%03d", i), make([]byte, 100))
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		_ = d.SetRaw(fmt.Sprintf("b:%03d", i), make([]byte, 100))
+	}
+
+	tests := []struct {
+		start, end string
+		count      int
+	}{
+		{"", "", 80},
+		{"a:", "b:", 50},
+		{"a:010", "a:020", 10},
+		{"b:", "", 30},
+		{"a:010", "b:010", 50},
+		{"c:", "", 0},
+	}
+	for _, tt := range tests {
+		count, err := d.ApproximateCount(tt.start, tt.end)
+		if err != nil || count != tt.count {
+			t.Errorf("ApproximateCount(%q, %q) = %d %v, want %d", tt.start, tt.end, count, err, tt.count)
+		}
+		// 每个元素至少有100字节的值, 编码后的额外开销不会超过它
+		size, err := d.ApproximateSize(tt.start, tt.end)
+		if err != nil || size < int64(tt.count)*100 || size > int64(tt.count)*200 {
+			t.Errorf("ApproximateSize(%q, %q) = %d %v, want about %d", tt.start, tt.end, size, err, tt.count*100)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+	"sync/atomic"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:15
+ * @Func: 批量写入, 一批写入作为wal.log中的一条记录原子地生效
+ **/
+
+//
+//  WriteBatch
+//  @Description: 一组按顺序执行的写入, 通过Database.Write原子地生效: 读操作和崩溃恢复
+//  要么看到全部写入, 要么一个都看不到. 同一个key写入多次时以最后一次为准;
+//  可以同时写入多个列族, 崩溃恢复时仍然是原子的, 读操作在每个列族内看到的写入是原子的
+//
+type WriteBatch struct {
+	values []kv.Value
+	codec  kv.Codec // Put使用的编码方式
+	family string   // Put和Delete写入的列族, 和wal.log中的记录相同, 为空表示默认列族
+}
+
+//
+// NewWriteBatch
+//  @Description: 创建一个空的WriteBatch, Put使用JSON编码, 写入默认列族
+//  @return *WriteBatch
+//
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{codec: kv.JSON}
+}
+
+//
+// NewWriteBatch
+//  @Description: 创建一个空的WriteBatch, Put使用数据库配置的编码方式, 写入d所在的列族
+//  @receiver d
+//  @return *WriteBatch
+//
+func (d *Database) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{codec: d.codec(), family: d.walFamily()}
+}
+
+//
+// Put
+//  @Description: 在批量写入中加入一次插入
+//  @receiver b
+//  @param key
+//  @param value
+//  @return error	value序列化失败
+//
+func (b *WriteBatch) Put(key string, value any) error {
+	return b.PutWith(key, value, b.codec)
+}
+
+//
+// PutWith
+//  @Description: 在批量写入中加入一次用指定编码方式的插入
+//  @receiver b
+//  @param key
+//  @param value
+//  @param codec
+//  @return error
+//
+func (b *WriteBatch) PutWith(key string, value any, codec kv.Codec) error {
+	return b.put(b.family, key, value, codec)
+}
+
+//
+// PutIn
+//  @Description: 在批量写入中加入一次对列族cf的插入, 使用cf配置的编码方式
+//  @receiver b
+//  @param cf
+//  @param key
+//  @param value
+//  @return error
+//
+func (b *WriteBatch) PutIn(cf *Database, key string, value any) error {
+	return b.put(cf.walFamily(), key, value, cf.codec())
+}
+
+func (b *WriteBatch) put(family string, key string, value any, codec kv.Codec) error {
+	data := kv.Value{
+		Key:     key,
+		Deleted: false,
+		Family:  family,
+	}
+	if err := data.Encode(codec, value); err != nil { //将value序列化为二进制
+		return err
+	}
+	b.values = append(b.values, data)
+	return nil
+}
+
+//
+// Delete
+//  @Description: 在批量写入中加入一次删除
+//  @receiver b
+//  @param key
+//
+func (b *WriteBatch) Delete(key string) {
+	b.values = append(b.values, kv.Value{
+		Key:     key,
+		Value:   nil,
+		Deleted: true,
+		Family:  b.family,
+	})
+}
+
+//
+// DeleteIn
+//  @Description: 在批量写入中加入一次对列族cf的删除
+//  @receiver b
+//  @param cf
+//  @param key
+//
+func (b *WriteBatch) DeleteIn(cf *Database, key string) {
+	b.values = append(b.values, kv.Value{
+		Key:     key,
+		Deleted: true,
+		Family:  cf.walFamily(),
+	})
+}
+
+//
+// Clear
+//  @Description: 清空批量写入, 之后可以重复使用
+//  @receiver b
+//
+func (b *WriteBatch) Clear() {
+	b.values = b.values[:0]
+}
+
+//
+// Len
+//  @Description: 批量写入中的写入次数
+//  @receiver b
+//  @return int
+//
+func (b *WriteBatch) Len() int {
+	return len(b.values)
+}
+
+//
+// Write
+//  @Description: 原子地执行批量写入: 作为一条记录写入wal.log, 再在一次加锁中写入内存表
+//  @receiver d
+//  @param b
+//  @return error
+//
+func (d *Database) Write(b *WriteBatch) error {
+	if err := d.throttleBatch(b.values); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	log.Print("Write batch of ", b.Len())
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	return d.writeBatch(b.values)
+}
+
+//
+// writeBatch
+//  @Description: 为values依次分配序列号, 作为一条记录写入wal.log, 再在一次加锁中写入每个列族的内存表;
+//  有列族不存在时整批都不写入. 调用方需要持有d.writeMu
+//  @receiver d
+//  @param values
+//  @return error
+//
+func (d *Database) writeBatch(values []kv.Value) error {
+	// 复制一份再分配序列号, 不影响调用方重复使用
+	values = append([]kv.Value(nil), values...)
+	families := make([]*Database, len(values))
+	d.familyMu.RLock()
+	for i := range values {
+		fam, ok := d.families[familyOf(values[i])]
+		if !ok {
+			d.familyMu.RUnlock()
+			return fmt.Errorf("%w: %q", kv.ErrNoFamily, values[i].Family)
+		}
+		families[i] = fam
+	}
+	d.familyMu.RUnlock()
+	seq := d.seq
+	for i := range values {
+		seq++
+		values[i].Seq = seq
+	}
+	// 1.先写入 wal.log, 写入失败则不修改内存表
+	if err := d.Wal.WriteBatch(values); err != nil {
+		return err
+	}
+	// 2.再按列族分组写入内存表
+	groups := make(map[*Database][]kv.Value)
+	for i, value := range values {
+		value.Family = ""
+		groups[families[i]] = append(groups[families[i]], value)
+	}
+	retain := d.latestSnapshot()
+	for fam, group := range groups {
+		fam.MemoryTree.PutBatch(group, retain)
+	}
+	// 写入完成后才对读操作可见
+	atomic.StoreUint64(&d.seq, seq)
+	for fam := range groups {
+		fam.maybeRotate()
+	}
+	d.publish(values)
+	return nil
+}
+
+//
+// Write
+//  @Description: 批量写入, 对Database.Write的封装
+//  @param d
+//  @param b
+//  @return error
+//
+func Write(d *Database, b *WriteBatch) error {
+	return d.Write(b)
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"encoding/binary"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:15
+ * @Func:
+ **/
+
+func TestWriteBatch(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](d, "a", 1)
+	b := NewWriteBatch()
+	_ = b.Put("a", 10)
+	_ = b.Put("b", 2)
+	b.Delete("b")
+	_ = b.Put("c", 3)
+	if b.Len() != 4 {
+		t.Fatal(b.Len())
+	}
+	if err = d.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	// 重复使用batch
+	b.Clear()
+	_ = b.Put("d", 4)
+	if err = d.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入batch时崩溃, wal.log末尾留下写了一半的记录
+	f, err := os.OpenFile(filepath.Join(cfg.DataDir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, 100)
+	_, _ = f.Write(append(header, []byte(`{"Batch":[{"Key":"e"`)...))
+	_ = f.Close()
+
+	d, err = NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		for key, want := range map[string]int{"a": 10, "c": 3, "d": 4} {
+			if v, ok, err := Get[int](d, key); err != nil || !ok || v != want {
+				t.Errorf("get %s = %v %v %v, want %d", key, v, ok, err, want)
+			}
+		}
+		for _, key := range []string{"b", "e"} {
+			if _, ok, _ := Get[int](d, key); ok {
+				t.Errorf("the key %s should not exist", key)
+			}
+		}
+	}
+	check()
+	// 丢弃的记录被截断, 之后的写入可以正常恢复
+	_ = Set[int](d, "f", 6)
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d, err = NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check()
+	if v, ok, _ := Get[int](d, "f"); !ok || v != 6 {
+		t.Error(v, ok)
+	}
+}
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"bytes"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:16
+ * @Func: 条件写入, 在写锁中完成读取, 比较和写入
+ **/
+
+//
+// CompareAndSwap
+//  @Description: 如果key当前的值等于old, 则设置为new; 值按序列化后的字节比较, 只有修改成功时才写wal.log
+//  @receiver d
+//  @param key
+//  @param old
+//  @param new
+//  @return bool	是否修改成功
+//  @return error
+//
+func (d *Database) CompareAndSwap(key string, old any, new any) (bool, error) {
+	log.Print("CompareAndSwap ", key)
+	return d.conditionalWrite(key, func(current kv.Value, exists bool) (*kv.Value, error) {
+		if !exists {
+			return nil, nil
+		}
+		if equal, err := valueEquals(current, old); err != nil || !equal {
+			return nil, err
+		}
+		value := &kv.Value{Key: key}
+		if err := value.Encode(d.codec(), new); err != nil {
+			return nil, err
+		}
+		return value, nil
+	})
+}
+
+//
+// SetIfAbsent
+//  @Description: 如果key不存在(或者已经被删除), 则设置为value
+//  @receiver d
+//  @param key
+//  @param value
+//  @return bool	是否设置成功
+//  @return error
+//
+func (d *Database) SetIfAbsent(key string, value any) (bool, error) {
+	log.Print("SetIfAbsent ", key)
+	return d.conditionalWrite(key, func(current kv.Value, exists bool) (*kv.Value, error) {
+		if exists {
+			return nil, nil
+		}
+		data := &kv.Value{Key: key}
+		if err := data.Encode(d.codec(), value); err != nil {
+			return nil, err
+		}
+		return data, nil
+	})
+}
+
+//
+// DeleteIfEquals
+//  @Description: 如果key当前的值等于value, 则删除key
+//  @receiver d
+//  @param key
+//  @param value
+//  @return bool	是否删除成功
+//  @return error
+//
+func (d *Database) DeleteIfEquals(key string, value any) (bool, error) {
+	log.Print("DeleteIfEquals ", key)
+	return d.conditionalWrite(key, func(current kv.Value, exists bool) (*kv.Value, error) {
+		if !exists {
+			return nil, nil
+		}
+		if equal, err := valueEquals(current, value); err != nil || !equal {
+			return nil, err
+		}
+		return &kv.Value{Key: key, Deleted: true}, nil
+	})
+}
+
+//
+// conditionalWrite
+//  @Description: 在写锁中读取key的当前值交给decide, decide返回要写入的值, 返回nil表示不写入
+//  @receiver d
+//  @param key
+//  @param decide
+//  @return bool	是否写入
+//  @return error
+//
+func (d *Database) conditionalWrite(key string, decide func(current kv.Value, exists bool) (*kv.Value, error)) (bool, error) {
+	if err := d.throttle(); err != nil {
+		return false, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false, kv.ErrClosed
+	}
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	current, result, err := d.current(key)
+	if err != nil {
+		return false, err
+	}
+	value, err := decide(current, result == kv.Success)
+	if err != nil || value == nil {
+		return false, err
+	}
+	if _, _, err = d.write(*value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//
+// current
+//  @Description: 查询key最新的版本, 内存表中的版本(包括删除标记)总比SSTable中的新;
+//  被范围删除标记遮住时返回对应的删除标记, 合并操作数会合并出值, 已经过期的元素当作删除标记. 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param key
+//  @return kv.Value
+//  @return kv.SearchResult
+//  @return error
+//
+func (d *Database) current(key string) (kv.Value, kv.SearchResult, error) {
+	var (
+		value  kv.Value
+		result kv.SearchResult
+		err    error
+	)
+	d.readLatest(func(seq uint64) {
+		value, result, err = d.currentAt(key, seq)
+	})
+	return value, result, err
+}
+
+//
+// currentAt
+//  @Description: 查询key在序列号seq时的版本, 规则和current相同
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//  @return error
+//
+func (d *Database) currentAt(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
+	value, result := d.memGetAt(key, seq)
+	if result == kv.None {
+		var err error
+		if value, result, err = d.SSTableTree.GetAt(key, seq); err != nil {
+			return kv.Value{}, kv.None, err
+		}
+	}
+	// 没有写入过的key被遮住时也要返回范围删除标记的序列号, 事务用它检查冲突
+	if r, ok := d.covering(kv.Value{Key: key, Seq: value.Seq}, seq); ok {
+		return kv.Value{Key: key, Deleted: true, Seq: r.Seq}, kv.Deleted, nil
+	}
+	if result == kv.MergeOperand {
+		var err error
+		if value, err = d.resolveMerge(key, seq); err != nil {
+			return kv.Value{}, kv.None, err
+		}
+		result = kv.Success
+		if value.Deleted {
+			result = kv.Deleted
+		}
+	}
+	if result == kv.Success && value.Expired(time.Now().UnixNano()) {
+		result = kv.Deleted
+	}
+	return value, result, nil
+}
+
+//
+// valueEquals
+//  @Description: 用current写入时的编码方式序列化value, 比较字节是否相同
+//  @param current
+//  @param value
+//  @return bool
+//  @return error
+//
+func valueEquals(current kv.Value, value any) (bool, error) {
+	codec, err := kv.CodecByName(current.Codec)
+	if err != nil {
+		return false, err
+	}
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(current.Value, data), nil
+}
+
+//
+// CompareAndSwap[T any]
+//  @Description: 如果key当前的值等于old, 则设置为new
+//  @param d
+//  @param key
+//  @param old
+//  @param new
+//  @return bool
+//  @return error
+//
+func CompareAndSwap[T any](d *Database, key string, old T, new T) (bool, error) {
+	return d.CompareAndSwap(key, old, new)
+}
+
+//
+// SetIfAbsent[T any]
+//  @Description: 如果key不存在, 则设置为value
+//  @param d
+//  @param key
+//  @param value
+//  @return bool
+//  @return error
+//
+func SetIfAbsent[T any](d *Database, key string, value T) (bool, error) {
+	return d.SetIfAbsent(key, value)
+}
+
+//
+// DeleteIfEquals[T any]
+//  @Description: 如果key当前的值等于value, 则删除key
+//  @param d
+//  @param key
+//  @param value
+//  @return bool
+//  @return error
+//
+func DeleteIfEquals[T any](d *Database, key string, value T) (bool, error) {
+	return d.DeleteIfEquals(key, value)
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:16
+ * @Func:
+ **/
+
+func TestCompareAndSwap(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "counter", 0)
+	// 并发自增, CompareAndSwap保证没有更新丢失
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; {
+				v, _, err := Get[int](d, "counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok, _ := CompareAndSwap[int](d, "counter", v, v+1); ok {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _, _ := Get[int](d, "counter"); v != 80 {
+		t.Errorf("counter = %d, want 80", v)
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[string](d, "leader", "node-1")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	walPath := filepath.Join(d.Config().DataDir, "wal.log")
+	// 条件不满足时不修改数据, 也不写wal.log
+	if ok, err := SetIfAbsent[string](d, "leader", "node-2"); ok || err != nil {
+		t.Fatal("SetIfAbsent on an existing key in SSTable", ok, err)
+	}
+	if ok, err := CompareAndSwap[string](d, "leader", "node-2", "node-3"); ok || err != nil {
+		t.Fatal("CompareAndSwap with a wrong old value", ok, err)
+	}
+	if ok, err := DeleteIfEquals[string](d, "leader", "node-2"); ok || err != nil {
+		t.Fatal("DeleteIfEquals with a wrong value", ok, err)
+	}
+	if info, _ := os.Stat(walPath); info.Size() != 0 {
+		t.Errorf("failed conditional writes should not be logged, wal size %d", info.Size())
+	}
+
+	if ok, err := DeleteIfEquals[string](d, "leader", "node-1"); !ok || err != nil {
+		t.Fatal("DeleteIfEquals", ok, err)
+	}
+	if ok, _ := CompareAndSwap[string](d, "leader", "node-1", "node-2"); ok {
+		t.Error("CompareAndSwap on a deleted key")
+	}
+	if ok, err := SetIfAbsent[string](d, "leader", "node-2"); !ok || err != nil {
+		t.Fatal("SetIfAbsent on a deleted key", ok, err)
+	}
+	if v, _, _ := Get[string](d, "leader"); v != "node-2" {
+		t.Error(v)
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bytes"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:19
+ * @Func:
+ **/
+
+func TestMixedCodec(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100, Codec: kv.Gob}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[time.Time](d, "gob", at)
+	_ = SetWith[[]byte](d, "raw", []byte("raw bytes"), kv.Raw)
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int64](d, "wal", 1<<62+1)
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 换成JSON重新打开, 之前写入的数据仍然用各自的编码方式解码
+	cfg.Codec = nil
+	d, err = NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	_ = Set[int](d, "json", 1)
+	if v, ok, err := Get[time.Time](d, "gob"); err != nil || !ok || !v.Equal(at) {
+		t.Error(v, ok, err)
+	}
+	if v, ok, err := Get[int64](d, "wal"); err != nil || !ok || v != 1<<62+1 {
+		t.Error(v, ok, err)
+	}
+	var raw []byte
+	if ok, err := d.Get("raw", &raw); err != nil || !ok || string(raw) != "raw bytes" {
+		t.Error(string(raw), ok, err)
+	}
+	it := d.Scan("", "")
+	defer it.Close()
+	for it.Next() {
+		if it.Key() == "gob" {
+			var v time.Time
+			if err = it.Value(&v); err != nil || !v.Equal(at) {
+				t.Error(v, err)
+			}
+		}
+	}
+	// CompareAndSwap用元素写入时的编码方式比较
+	if ok, err := CompareAndSwap[time.Time](d, "gob", at, at.Add(time.Second)); !ok || err != nil {
+		t.Error(ok, err)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	d := openTestDatabase(t)
+	data := []byte{0x0a, 0x03, 'f', 'o', 'o', 0xff}
+	if err := d.SetRaw("proto", data); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		if v, ok, err := d.GetRaw("proto"); err != nil || !ok || !bytes.Equal(v, data) {
+			t.Errorf("%s: got %v %v %v", stage, v, ok, err)
+		}
+		it := d.Scan("", "")
+		defer it.Close()
+		if !it.Next() || !bytes.Equal(it.RawValue(), data) {
+			t.Errorf("%s: scan got %v", stage, it.RawValue())
+		}
+	}
+	check("memory")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("sstable")
+	// SSTable的数据区中原样保存值的字节
+	file, _ := os.ReadFile(filepath.Join(d.Config().DataDir, "0.0.db"))
+	if !bytes.Contains(file, data) {
+		t.Error("the raw bytes should be stored as is in the data area")
+	}
+	// 泛型的Get[T]建立在同样的字节之上
+	_ = Set[string](d, "json", "x")
+	if v, _, _ := d.GetRaw("json"); string(v) != `"x"` {
+		t.Error(string(v))
+	}
+	_ = d.SetRaw("tmp", data)
+	if err := d.DeleteRaw("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := d.GetRaw("tmp"); ok {
+		t.Error("the key should be deleted")
+	}
+}
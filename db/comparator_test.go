@@ -0,0 +1,146 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:24
+ * @Func:
+ **/
+
+// lengthComparator 先按长度再按字节序排列
+type lengthComparator struct{}
+
+func (lengthComparator) Name() string {
+	return "length"
+}
+
+func (lengthComparator) Compare(a []byte, b []byte) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(a, b)
+}
+
+func TestComparator(t *testing.T) {
+	for _, tt := range []struct {
+		cmp  kv.Comparator
+		want []string
+	}{
+		{kv.Bytewise, []string{"a", "aa", "ab", "b", "ba"}},
+		{kv.Reverse, []string{"ba", "b", "ab", "aa", "a"}},
+		{lengthComparator{}, []string{"a", "b", "aa", "ab", "ba"}},
+	} {
+		cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100, Comparator: tt.cmp}
+		d, err := NewDatabase(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 数据分散在多个SSTable和内存表中
+		for i, key := range []string{"ab", "b", "a", "ba", "aa"} {
+			_ = Set[int](d, key, i)
+			if i < 3 {
+				if err = d.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		check := func(stage string) {
+			keys, _ := scanKeys(t, d.Scan("", ""))
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("%s %s: scan %v, want %v", tt.cmp.Name(), stage, keys, tt.want)
+			}
+			// 范围按比较器的顺序
+			keys, _ = scanKeys(t, d.Scan(tt.want[1], tt.want[3]))
+			if !reflect.DeepEqual(keys, tt.want[1:3]) {
+				t.Errorf("%s %s: range scan %v, want %v", tt.cmp.Name(), stage, keys, tt.want[1:3])
+			}
+			keys, _ = scanKeys(t, d.ScanPrefix("a"))
+			if len(keys) != 3 {
+				t.Errorf("%s %s: prefix scan %v", tt.cmp.Name(), stage, keys)
+			}
+			it := d.Scan("", "")
+			if !it.Prev() || it.Key() != tt.want[4] {
+				t.Errorf("%s %s: last key %s", tt.cmp.Name(), stage, it.Key())
+			}
+			_ = it.Close()
+			for _, key := range tt.want {
+				if _, ok, err := Get[int](d, key); !ok || err != nil {
+					t.Errorf("%s %s: get %s %v", tt.cmp.Name(), stage, key, err)
+				}
+			}
+		}
+		check("flush")
+		if err = d.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if n := d.SSTableTree.GetTableNums(0); n != 0 {
+			t.Fatalf("level 0 should be compacted, but has %d tables", n)
+		}
+		check("compact")
+		_ = d.Close()
+
+		// 用不同的比较器打开被拒绝
+		cfg.Comparator = lengthComparator{}
+		if tt.cmp.Name() == "length" {
+			cfg.Comparator = kv.Bytewise
+		}
+		if _, err = NewDatabase(cfg); !errors.Is(err, kv.ErrComparator) {
+			t.Errorf("%s: open with %s, got %v", tt.cmp.Name(), cfg.Comparator.Name(), err)
+		}
+		cfg.Comparator = tt.cmp
+		if d, err = NewDatabase(cfg); err != nil {
+			t.Fatal(err)
+		}
+		check("reopen")
+		_ = d.Close()
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不是合法UTF-8的key
+	keys := [][]byte{{0xff, 0x00}, {0xfe}, {0x00, 0x01}, {0xc3, 0x28}}
+	for i, key := range keys[:2] {
+		_ = d.SetBytes(key, []byte{byte(i)})
+	}
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys[2:] {
+		_ = d.SetBytes(key, []byte{byte(i + 2)})
+	}
+	_ = d.Close()
+
+	// 从wal.log和SSTable中恢复
+	d, err = NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for i, key := range keys {
+		if v, ok, err := d.GetBytes(key); err != nil || !ok || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Errorf("get %x = %v %v %v", key, v, ok, err)
+		}
+	}
+	it := d.ScanBytes([]byte{0xc0}, nil)
+	defer it.Close()
+	got := make([][]byte, 0)
+	for it.Next() {
+		got = append(got, it.KeyBytes())
+	}
+	if !reflect.DeepEqual(got, [][]byte{{0xc3, 0x28}, {0xfe}, {0xff, 0x00}}) {
+		t.Errorf("scan %x", got)
+	}
+}
@@ -1,11 +1,18 @@
 package db
 
 import (
-	"github.com/ygzhang-yolo/lsmtree/bst"
+	"errors"
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
 	"github.com/ygzhang-yolo/lsmtree/sstTree"
 	"github.com/ygzhang-yolo/lsmtree/wal"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 /**
@@ -14,44 +21,542 @@ import (
  * @Func: Database, 对外提供的kv db
  **/
 
+const comparatorName = "comparator" // 数据目录中记录比较器名字的文件
+
+//
+//  Database
+//  @Description: 一个独立的kv数据库实例, 各自持有内存表, SSTable, WAL和配置;
+//  同一进程内可以同时打开多个互不影响的实例. 数据库中的每个列族也是一个Database,
+//  有自己的内存表, SSTable和配置, 和所属的数据库共享wal.log, 序列号和快照
+//
 type Database struct {
 	// 内存表
-	MemoryTree *bst.BSTree
+	MemoryTree kv.MemTable
+	// 已经切换出去, 等待落盘的不可变内存表, 从旧到新排列
+	immutables []kv.MemTable
+	immMu      sync.RWMutex // 保护immutables和内存表的切换
+	flushMu    sync.Mutex   // 同一时间只有一个落盘或压缩, 保证SSTable按从旧到新的顺序生成
+	dropped    bool         // 列族已经删除, 之后的落盘和压缩返回ErrClosed; 由flushMu保护
+	flushed    uint64       // 这个列族序列号不大于它的写入都已经落盘为SSTable, 原子读写
 	// SSTable 列表
 	SSTableTree *sstTree.SSTableTree
+	// 数据库配置
+	cfg config.Config
+	// 列族的名字
+	name string
+
+	mu     sync.RWMutex // 读写操作持有读锁, Close和DropFamily持有写锁
+	closed bool         // 数据库是否已经关闭, 或者列族是否已经删除
+
+	*store
+}
+
+//
+//  store
+//  @Description: 同一个数据库的所有列族共享的部分
+//
+type store struct {
+	seq    uint64     // 最后一次写入的序列号, 原子读写
+	stalls stallStats // 写入限流的统计, 原子读写
+
 	// WalF 文件句柄
 	Wal *wal.Wal
-}
+	// 数据目录, 默认列族的数据直接保存在其中
+	dir string
+
+	stop      chan struct{}  // 关闭时close, 通知后台协程退出
+	bg        sync.WaitGroup // 后台协程计数
+	closeOnce sync.Once
+	closeErr  error
+
+	writeMu   sync.Mutex     // 保证写入按序列号的顺序进入wal.log和内存表
+	snapMu    sync.Mutex     // 保护snapshots
+	snapshots map[uint64]int // 存活的快照序列号及其引用次数
 
-// 单例模式, 数据库，全局唯一实例
-var DB *Database
+	familyMu sync.RWMutex         // 保护families, 修改时还需要持有writeMu
+	families map[string]*Database // 所有的列族, 包括默认列族
+
+	walBase     uint64                     // wal.log中包含序列号大于walBase的所有写入, 原子读写
+	subMu       sync.Mutex                 // 保护subscribers
+	subscribers map[*Subscription]struct{} // 所有的变更订阅
+
+	flushCh    chan struct{} // 内存表写满时通知后台协程落盘
+	progressMu sync.Mutex    // 保护progress
+	progress   chan struct{} // 每次落盘或压缩之后close并替换, 唤醒被阻塞的写入
+}
 
 //
-// InitDatabase
-//  @Description: 初始化Database, 从磁盘中还原SSTableTree, WAL, MemoryTable
-//  @param dir
+// NewDatabase
+//  @Description: 根据配置创建一个Database, 从磁盘中还原SSTableTree, WAL, MemoryTable
+//  @param cfg
+//  @return *Database
+//  @return error
 //
-func InitDatabase(dir string) {
-	DB = &Database{
-		MemoryTree:  &bst.BSTree{},
+func NewDatabase(cfg config.Config) (*Database, error) {
+	d := &Database{
+		MemoryTree:  cfg.NewMemTable(),
 		SSTableTree: &sstTree.SSTableTree{},
-		Wal:         &wal.Wal{},
+		cfg:         cfg,
+		name:        DefaultFamily,
+		store: &store{
+			Wal:         &wal.Wal{},
+			dir:         cfg.DataDir,
+			stop:        make(chan struct{}),
+			snapshots:   make(map[uint64]int),
+			families:    make(map[string]*Database),
+			subscribers: make(map[*Subscription]struct{}),
+			flushCh:     make(chan struct{}, 1),
+			progress:    make(chan struct{}),
+		},
 	}
+	d.families[DefaultFamily] = d
 
 	// 从磁盘中恢复数据, 如果目录为空, 说明是空数据库, 要新建
+	dir := cfg.DataDir
 	if _, err := os.Stat(dir); err != nil {
 		log.Printf("The %s directory does not exist. The directory is being created\r\n", dir)
-		err = os.Mkdir(dir, 0666)
+		err = os.MkdirAll(dir, 0755)
 		if err != nil {
 			log.Println("Failed to create the database directory")
-			panic(err)
+			return nil, err
 		}
 	}
 
-	//非空数据库, 加载WAL和database文件
-	// memTable要通过WAL来创建, 因为可能需要根据WAL中记录的数据恢复memTable
-	memTree := DB.Wal.Init(dir)
-	DB.MemoryTree = memTree
+	// 检查数据目录使用的比较器和配置的一致
+	if err := checkComparator(dir, cfg.GetComparator()); err != nil {
+		return nil, err
+	}
+
+	//非空数据库, 加载database文件和WAL
 	log.Println("Loading database...")
-	DB.SSTableTree.Init(dir)
+	if err := d.SSTableTree.Init(cfg); err != nil {
+		return nil, err
+	}
+	// 加载其他列族的SSTable, 记录每个列族已经落盘的序列号
+	flushed, err := d.loadFamilies()
+	if err != nil {
+		d.closeTables()
+		return nil, err
+	}
+	flushed[DefaultFamily] = d.SSTableTree.MaxSeq()
+	// memTable要通过WAL来恢复, 已经落盘的和已经删除的列族的记录跳过
+	var first uint64
+	err = d.Wal.Init(dir, func(values []kv.Value) {
+		for _, value := range values {
+			if first == 0 {
+				first = value.Seq
+			}
+			family := familyOf(value)
+			fam, ok := d.families[family]
+			if !ok || (value.Seq > 0 && value.Seq <= flushed[family]) {
+				continue
+			}
+			value.Family = ""
+			// 保留记录的序列号
+			if value.Range {
+				fam.MemoryTree.PutRange(kv.RangeOf(value))
+			} else {
+				fam.MemoryTree.Put(value, 0)
+			}
+		}
+	})
+	if err != nil {
+		d.closeTables()
+		return nil, err
+	}
+	// 从内存表和SSTable中恢复最后一次写入的序列号
+	for name, fam := range d.families {
+		fam.flushed = flushed[name]
+		for _, seq := range []uint64{fam.MemoryTree.MaxSeq(), flushed[name]} {
+			if seq > d.seq {
+				d.seq = seq
+			}
+		}
+	}
+	// wal.log中第一条记录之前的写入已经不在wal.log中, 不能再重放给订阅者
+	d.walBase = d.seq
+	if first > 0 {
+		d.walBase = first - 1
+	}
+	return d, nil
+}
+
+//
+// checkComparator
+//  @Description: 数据目录中的key按比较器的顺序保存, 第一次打开时记录比较器的名字, 之后用不同的比较器打开会被拒绝;
+//  没有记录的旧数据目录使用的是 kv.Bytewise
+//  @param dir
+//  @param cmp
+//  @return error
+//
+func checkComparator(dir string, cmp kv.Comparator) error {
+	path := filepath.Join(dir, comparatorName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if name := string(data); name != cmp.Name() {
+			return fmt.Errorf("%w: data directory uses %q, configured %q", kv.ErrComparator, name, cmp.Name())
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return kv.IOError("read file", path, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return kv.IOError("read dir", dir, err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); filepath.Ext(name) == ".db" || name == "wal.log" {
+			if cmp.Name() != kv.Bytewise.Name() {
+				return fmt.Errorf("%w: data directory uses %q, configured %q", kv.ErrComparator, kv.Bytewise.Name(), cmp.Name())
+			}
+			break
+		}
+	}
+	return writeFileSync(path, []byte(cmp.Name()))
+}
+
+//
+// writeFileSync
+//  @Description: 先写临时文件并刷盘再改名, 崩溃时path要么不存在, 要么是完整的内容, 不会留下空的或者写了一半的文件
+//  @param path
+//  @param data
+//  @return error
+//
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return kv.IOError("create file", tmp, err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return kv.IOError("write file", tmp, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return kv.IOError("rename file", tmp, err)
+	}
+	// 改名记录在目录中, 目录也要刷盘
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return kv.IOError("open dir", filepath.Dir(path), err)
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return kv.IOError("sync dir", filepath.Dir(path), err)
+	}
+	return nil
+}
+
+//
+// Config
+//  @Description: 返回数据库实例的配置
+//  @receiver d
+//  @return config.Config
+//
+func (d *Database) Config() config.Config {
+	return d.cfg
+}
+
+//
+// codec
+//  @Description: 写入时默认使用的编码方式
+//  @receiver d
+//  @return kv.Codec
+//
+func (d *Database) codec() kv.Codec {
+	if d.cfg.Codec == nil {
+		return kv.JSON
+	}
+	return d.cfg.Codec
+}
+
+//
+// Background
+//  @Description: 在后台协程中运行fn, fn需要在stop被关闭后尽快返回, Close会等待所有后台协程退出
+//  @receiver d
+//  @param fn
+//
+func (d *Database) Background(fn func(stop <-chan struct{})) {
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+		fn(d.stop)
+	}()
+}
+
+//
+// Flush
+//  @Description: 将当前内存表切换为不可变内存表, 再把所有不可变内存表从旧到新落盘为level 0的SSTable,
+//  每个落盘之后删除已经不需要的wal.log旧文件. SSTable写好之后, 插入SSTable和从队列中去掉不可变内存表在同一个临界区中,
+//  落盘期间的读取仍然能找到其中的数据, 也不会同时读到两份; 落盘失败的留在队列中, 下次Flush重试.
+//  wal.log超过MaxWalSize时, 还有写入留在旧文件中的其他列族也一起落盘
+//  @receiver d
+//  @return error
+//
+func (d *Database) Flush() error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+	for _, fam := range d.laggingFamilies() {
+		// 期间被删除的列族不需要落盘
+		if err := fam.flush(); err != nil && !errors.Is(err, kv.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) flush() error {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	if d.dropped {
+		return kv.ErrClosed
+	}
+	d.writeMu.Lock()
+	err := d.rotate()
+	d.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for imm := d.oldestImmutable(); imm != nil; imm = d.oldestImmutable() {
+		values := retainVersions(imm.GetVersions(), d.snapshotSeqs())
+		ranges := imm.RangesAt(kv.MaxSeq)
+		// 将内存表存储到 SsTable 中, wal.log没有重置, 失败时数据不会丢失
+		var table *sstTree.SSTableNode
+		if len(values) > 0 || len(ranges) > 0 {
+			if table, err = d.SSTableTree.CreateTable(values, ranges); err != nil {
+				return err
+			}
+		}
+		d.retire(imm, table)
+		d.notifyProgress()
+		if err = d.retireWal(); err != nil {
+			return err
+		}
+	}
+	return d.retireWal()
+}
+
+//
+// retireWal
+//  @Description: 删除其中的写入都已经落盘的wal.log旧文件. 内存表中还有数据的列族里, flushed最小的一个决定能删除到哪里;
+//  所有列族都已经落盘时当前的wal.log也切换出去删除. 持有writeMu, 检查和删除之间不会有新的写入
+//  @receiver d
+//  @return error
+//
+func (d *Database) retireWal() error {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.familyMu.RLock()
+	defer d.familyMu.RUnlock()
+	floor, all := d.seq, true
+	for _, fam := range d.families {
+		if !fam.unflushed() {
+			continue
+		}
+		all = false
+		if flushed := atomic.LoadUint64(&fam.flushed); flushed < floor {
+			floor = flushed
+		}
+	}
+	if all {
+		if err := d.Wal.Rotate(); err != nil {
+			return err
+		}
+	} else if floor == 0 {
+		// 旧版本没有序列号的记录只有在所有列族都落盘之后才能删除
+		return nil
+	}
+	base, err := d.Wal.Retire(floor)
+	if base > atomic.LoadUint64(&d.walBase) {
+		atomic.StoreUint64(&d.walBase, base)
+	}
+	return err
+}
+
+//
+// laggingFamilies
+//  @Description: wal.log超过MaxWalSize时, 返回还有写入留在旧文件中的列族. 很少写入的列族的内存表一直写不满,
+//  不落盘的话它的一次写入会让之后的旧文件都不能删除
+//  @receiver d
+//  @return []*Database
+//
+func (d *Database) laggingFamilies() []*Database {
+	if d.Wal.Size() <= d.cfg.GetMaxWalSize() {
+		return nil
+	}
+	archived := d.Wal.Archived()
+	d.familyMu.RLock()
+	defer d.familyMu.RUnlock()
+	lagging := make([]*Database, 0)
+	for _, fam := range d.families {
+		if fam.unflushed() && atomic.LoadUint64(&fam.flushed) < archived {
+			lagging = append(lagging, fam)
+		}
+	}
+	return lagging
+}
+
+//
+// Compact
+//  @Description: 检查各层SSTable是否需要压缩, 压缩时保留存活快照能看到的旧版本; 和落盘互斥
+//  @receiver d
+//  @return error
+//
+func (d *Database) Compact() error {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+	if d.dropped {
+		return kv.ErrClosed
+	}
+	defer d.notifyProgress()
+	return d.SSTableTree.Check(d.snapshotSeqs())
+}
+
+//
+// retainVersions
+//  @Description: 对按key升序, 同一个key从新到旧排列的values, 去掉所有快照都不会再看到的旧版本
+//  @param values
+//  @param snapshots
+//  @return []kv.Value
+//
+func retainVersions(values []kv.Value, snapshots []uint64) []kv.Value {
+	retained := make([]kv.Value, 0, len(values))
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && values[j].Key == values[i].Key {
+			j++
+		}
+		retained = append(retained, kv.RetainVersions(values[i:j], snapshots)...)
+		i = j
+	}
+	return retained
+}
+
+//
+// snapshotSeqs
+//  @Description: 返回所有存活快照的序列号, 升序排列
+//  @receiver d
+//  @return []uint64
+//
+func (d *Database) snapshotSeqs() []uint64 {
+	d.snapMu.Lock()
+	defer d.snapMu.Unlock()
+	seqs := make([]uint64, 0, len(d.snapshots))
+	for seq := range d.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+	return seqs
+}
+
+//
+// latestSnapshot
+//  @Description: 返回最新的存活快照的序列号, 没有快照时返回0
+//  @receiver d
+//  @return uint64
+//
+func (d *Database) latestSnapshot() uint64 {
+	d.snapMu.Lock()
+	defer d.snapMu.Unlock()
+	var latest uint64
+	for seq := range d.snapshots {
+		if seq > latest {
+			latest = seq
+		}
+	}
+	return latest
+}
+
+//
+// write
+//  @Description: 为value分配下一个序列号, 先写wal.log再写内存表; 调用方需要持有d.writeMu
+//  @receiver d
+//  @param value
+//  @return kv.Value	旧值
+//  @return bool	是否有未删除的旧值
+//  @return error
+//
+func (d *Database) write(value kv.Value) (kv.Value, bool, error) {
+	value.Seq = d.seq + 1
+	// 1.先写入 wal.log, 写入失败则不修改内存表
+	value.Family = d.walFamily()
+	if err := d.Wal.Write(value); err != nil {
+		return kv.Value{}, false, err
+	}
+	// 内存表写入之后推送给订阅者, 内存表写满时切换
+	defer d.publish([]kv.Value{value})
+	defer d.maybeRotate()
+	// 2.再写入内存表, 被覆盖的版本如果还有快照能看到就保留下来; 内存表属于列族, 不需要记录列族
+	value.Family = ""
+	if value.Range {
+		d.MemoryTree.PutRange(kv.RangeOf(value))
+		atomic.StoreUint64(&d.seq, value.Seq)
+		return kv.Value{}, false, nil
+	}
+	old, ok := d.MemoryTree.Put(value, d.latestSnapshot())
+	// 写入完成后才对读操作可见
+	atomic.StoreUint64(&d.seq, value.Seq)
+	return old, ok, nil
+}
+
+//
+// Close
+//  @Description: 关闭数据库: 停止后台监视协程并等待进行中的落盘/压缩结束,
+//  按配置将所有列族的内存表落盘, 同步并关闭wal.log, 最后关闭所有SSTable文件句柄.
+//  在任意一个列族上调用都会关闭整个数据库, 重复调用是安全的
+//  @receiver d
+//  @return error
+//
+func (d *Database) Close() error {
+	d.closeOnce.Do(func() {
+		log.Println("Closing database ", d.cfg.DataDir)
+		// 等待进行中的读写结束, 之后的读写都会返回ErrClosed
+		families := d.Families()
+		for _, fam := range families {
+			fam.mu.Lock()
+			fam.closed = true
+			fam.mu.Unlock()
+		}
+
+		d.closeSubscriptions("", kv.ErrClosed)
+		close(d.stop)
+		d.bg.Wait()
+
+		if d.cfg.FlushOnClose {
+			for _, fam := range families {
+				if err := fam.Flush(); err != nil && d.closeErr == nil {
+					d.closeErr = err
+				}
+			}
+		}
+		if err := d.Wal.Close(); err != nil && d.closeErr == nil {
+			d.closeErr = err
+		}
+		for _, fam := range families {
+			if err := fam.SSTableTree.Close(); err != nil && d.closeErr == nil {
+				d.closeErr = err
+			}
+		}
+	})
+	return d.closeErr
+}
+
+//
+// closeTables
+//  @Description: 打开数据库失败时关闭已经加载的SSTable
+//  @receiver d
+//
+func (d *Database) closeTables() {
+	for _, fam := range d.families {
+		_ = fam.SSTableTree.Close()
+	}
 }
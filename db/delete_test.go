@@ -0,0 +1,164 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:35
+ * @Func:
+ **/
+
+func TestDeleteAndGet(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	_ = Set[string](d, "flushed", "on disk")
+	_ = SetWithTTL[string](d, "expired", "gone", time.Millisecond)
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[string](d, "memory", "in memory")
+	time.Sleep(5 * time.Millisecond)
+
+	for key, want := range map[string]string{"flushed": "on disk", "memory": "in memory"} {
+		if ok, err := d.Exists(key); !ok || err != nil {
+			t.Errorf("%s should exist: %v", key, err)
+		}
+		if v, ok, err := DeleteAndGet[string](d, key); !ok || err != nil || v != want {
+			t.Errorf("DeleteAndGet %s = %q %v %v, want %q", key, v, ok, err, want)
+		}
+		if ok, err := d.Exists(key); ok || err != nil {
+			t.Errorf("%s should not exist after delete: %v", key, err)
+		}
+		// 已经删除的key没有旧值
+		if _, ok, err := DeleteAndGet[string](d, key); ok || err != nil {
+			t.Errorf("DeleteAndGet %s twice: %v %v", key, ok, err)
+		}
+	}
+	// 过期和不存在的key没有旧值, 但是删除标记仍然写入wal.log
+	info, _ := os.Stat(filepath.Join(dir, "wal.log"))
+	for _, key := range []string{"expired", "missing"} {
+		if ok, err := d.Exists(key); ok || err != nil {
+			t.Errorf("%s should not exist: %v", key, err)
+		}
+		if _, ok, err := DeleteAndGet[string](d, key); ok || err != nil {
+			t.Errorf("DeleteAndGet %s: %v %v", key, ok, err)
+		}
+	}
+	if after, _ := os.Stat(filepath.Join(dir, "wal.log")); after.Size() <= info.Size() {
+		t.Error("tombstones should always be logged")
+	}
+
+	// 删除标记从wal.log恢复, 落盘的旧值不会重新出现
+	_ = d.Close()
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Exists("flushed"); ok || err != nil {
+		t.Errorf("flushed should stay deleted after reopen: %v", err)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	flush := func() {
+		t.Helper()
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 连续落盘3次触发压缩, 数据都进入level 1
+	compact := func() {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			_ = Set[int](d, "zfiller", i)
+			flush()
+		}
+		if err := d.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(stage string, want map[string]int) {
+		t.Helper()
+		for _, key := range []string{"flushed", "compacted", "reset"} {
+			v, ok, err := Get[int](d, key)
+			if w, exists := want[key]; err != nil || ok != exists || v != w {
+				t.Errorf("%s: %s = %d %v %v, want %d %v", stage, key, v, ok, err, w, exists)
+			}
+		}
+		keys, _ := scanKeys(t, d.Scan("", "z"))
+		if len(keys) != len(want) {
+			t.Errorf("%s: scan %v, want %v", stage, keys, want)
+		}
+	}
+
+	// 删除已经落盘的key: 删除标记先在内存表中, 落盘后在更新的level 0 SSTable中
+	_ = Set[int](d, "flushed", 1)
+	_ = Set[int](d, "compacted", 2)
+	_ = Set[int](d, "reset", 3)
+	flush()
+	_ = d.Delete("flushed")
+	check("delete after flush", map[string]int{"compacted": 2, "reset": 3})
+	flush()
+	check("flush the tombstone", map[string]int{"compacted": 2, "reset": 3})
+
+	// 删除已经压缩到更深层的key
+	compact()
+	_ = d.Delete("compacted")
+	check("delete after compaction", map[string]int{"reset": 3})
+	flush()
+	check("flush the tombstone", map[string]int{"reset": 3})
+
+	// 删除之后重新写入, 新值遮住删除标记
+	_ = d.Delete("reset")
+	flush()
+	_ = Set[int](d, "reset", 4)
+	check("set after delete", map[string]int{"reset": 4})
+	flush()
+	check("flush after delete and set", map[string]int{"reset": 4})
+
+	// 删除标记和旧值都压缩到最深层之后, 删除标记和它遮住的旧值一起清理掉
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact()
+	check("compact the tombstones", map[string]int{"reset": 4})
+	// 快照还在时, 它能看到的旧值保留
+	if v, ok, err := GetAt[int](snap, "reset"); !ok || err != nil || v != 4 {
+		t.Errorf("snapshot: reset = %d %v %v", v, ok, err)
+	}
+	snap.Release()
+	compact()
+	for _, key := range []string{"flushed", "compacted"} {
+		if chain, err := d.SSTableTree.GetChainAt(key, ^uint64(0)); err != nil || len(chain) != 0 {
+			t.Errorf("tombstone of %s should be dropped at the bottom level: %+v %v", key, chain, err)
+		}
+	}
+
+	_ = d.Close()
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("reopen", map[string]int{"reset": 4})
+}
@@ -0,0 +1,315 @@
+package db
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"github.com/ygzhang-yolo/lsmtree/sstTree"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:34
+ * @Func: 列族, 一个数据库中相互独立的key空间, 共享wal.log, 跨列族的批量写入也是原子的
+ **/
+
+// DefaultFamily 默认列族的名字, 数据库本身就是默认列族, 数据保存在数据目录中
+const DefaultFamily = "default"
+
+const (
+	familiesDir = "families" // 其他列族的数据目录都在数据目录的这个子目录中
+	createdName = "created"  // 列族目录中记录创建时序列号的文件
+)
+
+//
+// Name
+//  @Description: 列族的名字
+//  @receiver d
+//  @return string
+//
+func (d *Database) Name() string {
+	return d.name
+}
+
+//
+// Family
+//  @Description: 返回名为name的列族, 不存在时返回ErrNoFamily
+//  @receiver d
+//  @param name
+//  @return *Database
+//  @return error
+//
+func (d *Database) Family(name string) (*Database, error) {
+	d.familyMu.RLock()
+	defer d.familyMu.RUnlock()
+	fam, ok := d.families[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", kv.ErrNoFamily, name)
+	}
+	return fam, nil
+}
+
+//
+// Families
+//  @Description: 返回数据库中所有的列族, 按名字排序, 默认列族也在其中
+//  @receiver d
+//  @return []*Database
+//
+func (d *Database) Families() []*Database {
+	d.familyMu.RLock()
+	defer d.familyMu.RUnlock()
+	families := make([]*Database, 0, len(d.families))
+	for _, fam := range d.families {
+		families = append(families, fam)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	return families
+}
+
+//
+// CreateFamily
+//  @Description: 创建一个列族, 有自己的内存表, SSTable和配置; opts中为零值的选项沿用数据库的配置,
+//  之后重新打开数据库时, 列族的配置需要放在config.Families中
+//  @receiver d
+//  @param name
+//  @param opts
+//  @return *Database
+//  @return error
+//
+func (d *Database) CreateFamily(name string, opts config.Config) (*Database, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("lsm: invalid column family name %q", name)
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil, kv.ErrClosed
+	}
+	log.Print("Create column family ", name)
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	if _, ok := d.families[name]; ok {
+		return nil, fmt.Errorf("%w: %q", kv.ErrFamilyExists, name)
+	}
+	dir := d.familyDir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, kv.IOError("create dir", dir, err)
+	}
+	fam, err := d.openFamily(name, opts.Inherit(d.families[DefaultFamily].cfg, dir))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	// 同名的列族可能被删除过, wal.log中之前的记录不属于新的列族. created最后写入, 有了它列族才算创建完成
+	if err = writeFileSync(filepath.Join(dir, createdName), []byte(strconv.FormatUint(d.seq, 10))); err != nil {
+		_ = fam.SSTableTree.Close()
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	fam.flushed = d.seq
+	d.familyMu.Lock()
+	d.families[name] = fam
+	d.familyMu.Unlock()
+	return fam, nil
+}
+
+//
+// DropFamily
+//  @Description: 删除一个列族和它的所有数据, 包括SSTable文件; 之后在这个列族上的读写, 落盘和压缩返回ErrClosed.
+//  默认列族不能删除
+//  @receiver d
+//  @param name
+//  @return error
+//
+func (d *Database) DropFamily(name string) error {
+	if name == DefaultFamily {
+		return fmt.Errorf("lsm: the default column family cannot be dropped")
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
+	log.Print("Drop column family ", name)
+	// 先从列族列表中去掉, 之后的批量写入不会再写到这个列族
+	d.writeMu.Lock()
+	fam, ok := d.families[name]
+	if ok {
+		d.familyMu.Lock()
+		delete(d.families, name)
+		d.familyMu.Unlock()
+	}
+	d.writeMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", kv.ErrNoFamily, name)
+	}
+	// 等待进行中的读写结束
+	fam.mu.Lock()
+	closed := fam.closed
+	fam.closed = true
+	fam.mu.Unlock()
+	if closed {
+		return kv.ErrClosed
+	}
+	d.closeSubscriptions(name, kv.ErrClosed)
+	// 等待进行中的落盘和压缩结束, 之后它们不会再写这个列族的目录
+	fam.flushMu.Lock()
+	defer fam.flushMu.Unlock()
+	fam.dropped = true
+	// 先删除created, 删除到一半时崩溃, 下次打开会把剩下的目录当作没有创建完成的列族删除
+	dir := d.familyDir(name)
+	path := filepath.Join(dir, createdName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return kv.IOError("remove file", path, err)
+	}
+	if err := fam.SSTableTree.Drop(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return kv.IOError("remove dir", dir, err)
+	}
+	return nil
+}
+
+//
+// loadFamilies
+//  @Description: 打开数据目录中已有的列族
+//  @receiver d
+//  @return map[string]uint64	每个列族已经落盘的序列号, wal.log中不大于它的记录不需要恢复
+//  @return error
+//
+func (d *Database) loadFamilies() (map[string]uint64, error) {
+	flushed := make(map[string]uint64)
+	root := filepath.Join(d.dir, familiesDir)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return flushed, nil
+	}
+	if err != nil {
+		return nil, kv.IOError("read dir", root, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		dir := d.familyDir(name)
+		created, ok, err := readCreated(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// 创建列族时在写好created之前崩溃, 列族没有创建成功, 也不会有写入, 删除留下的目录
+			log.Print("Remove unfinished column family ", name)
+			if err = os.RemoveAll(dir); err != nil {
+				return nil, kv.IOError("remove dir", dir, err)
+			}
+			continue
+		}
+		fam, err := d.openFamily(name, d.cfg.Families[name].Inherit(d.cfg, dir))
+		if err != nil {
+			return nil, err
+		}
+		d.families[name] = fam
+		flushed[name] = fam.SSTableTree.MaxSeq()
+		if created > flushed[name] {
+			flushed[name] = created
+		}
+	}
+	return flushed, nil
+}
+
+//
+// openFamily
+//  @Description: 加载列族的SSTable, 创建空的内存表
+//  @receiver d
+//  @param name
+//  @param cfg	列族的配置, 数据目录是列族的目录
+//  @return *Database
+//  @return error
+//
+func (d *Database) openFamily(name string, cfg config.Config) (*Database, error) {
+	if err := checkComparator(cfg.DataDir, cfg.GetComparator()); err != nil {
+		return nil, err
+	}
+	fam := &Database{
+		MemoryTree:  cfg.NewMemTable(),
+		SSTableTree: &sstTree.SSTableTree{},
+		cfg:         cfg,
+		name:        name,
+		store:       d.store,
+	}
+	if err := fam.SSTableTree.Init(cfg); err != nil {
+		return nil, err
+	}
+	return fam, nil
+}
+
+//
+// readCreated
+//  @Description: 读取列族创建时的序列号; 文件不存在或者内容不完整时返回false, 列族没有创建完成
+//  @param dir
+//  @return uint64
+//  @return bool
+//  @return error
+//
+func readCreated(dir string) (uint64, bool, error) {
+	path := filepath.Join(dir, createdName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, kv.IOError("read file", path, err)
+	}
+	created, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	return created, true, nil
+}
+
+//
+// familyDir
+//  @Description: 列族的数据目录
+//  @receiver d
+//  @param name
+//  @return string
+//
+func (d *Database) familyDir(name string) string {
+	return filepath.Join(d.dir, familiesDir, name)
+}
+
+//
+// walFamily
+//  @Description: 写入wal.log时记录的列族名字, 默认列族为空, 和加入列族之前的格式相同
+//  @receiver d
+//  @return string
+//
+func (d *Database) walFamily() string {
+	if d.name == DefaultFamily {
+		return ""
+	}
+	return d.name
+}
+
+//
+// familyOf
+//  @Description: wal.log中的记录所属的列族
+//  @param value
+//  @return string
+//
+func familyOf(value kv.Value) string {
+	if value.Family == "" {
+		return DefaultFamily
+	}
+	return value.Family
+}
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"errors"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:34
+ * @Func:
+ **/
+
+func TestFamily(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	users, err := d.CreateFamily("users", config.Config{Comparator: kv.Reverse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.CreateFamily("users", config.Config{}); !errors.Is(err, kv.ErrFamilyExists) {
+		t.Fatal("create an existing family", err)
+	}
+	if _, err = d.CreateFamily("../users", config.Config{}); err == nil {
+		t.Fatal("family name with a path separator")
+	}
+
+	// 同一个key在不同列族中互不影响
+	_ = Set[int](d, "a", 1)
+	_ = Set[int](users, "a", 10)
+	_ = Set[int](users, "b", 20)
+	if v, _, _ := Get[int](d, "a"); v != 1 {
+		t.Errorf("default a = %d", v)
+	}
+	if _, ok, _ := Get[int](d, "b"); ok {
+		t.Error("b should only exist in users")
+	}
+	// 列族使用自己的比较器
+	if keys, values := scanKeys(t, users.Scan("", "")); !reflect.DeepEqual(keys, []string{"b", "a"}) || !reflect.DeepEqual(values, []int{20, 10}) {
+		t.Errorf("users scan %v %v", keys, values)
+	}
+
+	// 跨列族的批量写入
+	b := d.NewWriteBatch()
+	_ = b.Put("c", 3)
+	_ = b.PutIn(users, "c", 30)
+	b.DeleteIn(users, "b")
+	if err = d.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	// 只落盘一个列族, 另一个列族的数据还在wal.log中
+	if err = users.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](users, "d", 40)
+
+	// 重新打开, 已经落盘的记录不会重复恢复, 列族的配置通过config.Families传入
+	_ = d.Close()
+	cfg.Families = map[string]config.Config{"users": {Comparator: kv.Reverse}}
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if users, err = d.Family("users"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := scanKeys(t, d.Scan("", "")); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("default scan after reopen %v", keys)
+	}
+	if keys, values := scanKeys(t, users.Scan("", "")); !reflect.DeepEqual(keys, []string{"d", "c", "a"}) || !reflect.DeepEqual(values, []int{40, 30, 10}) {
+		t.Errorf("users scan after reopen %v %v", keys, values)
+	}
+	if names := []string{d.Families()[0].Name(), d.Families()[1].Name()}; !reflect.DeepEqual(names, []string{DefaultFamily, "users"}) {
+		t.Errorf("families %v", names)
+	}
+
+	// 删除列族会删除它的SSTable文件
+	if err = users.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](users, "e", 50)
+	if err = d.DropFamily("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, familiesDir, "users")); !os.IsNotExist(err) {
+		t.Error("the directory of a dropped family should be removed", err)
+	}
+	if _, err = d.Family("users"); !errors.Is(err, kv.ErrNoFamily) {
+		t.Error(err)
+	}
+	if _, _, err = Get[int](users, "a"); !errors.Is(err, kv.ErrClosed) {
+		t.Error("read a dropped family", err)
+	}
+	if err = d.DropFamily(DefaultFamily); err == nil {
+		t.Error("the default family cannot be dropped")
+	}
+	b = d.NewWriteBatch()
+	_ = b.PutIn(users, "f", 60)
+	if err = d.Write(b); !errors.Is(err, kv.ErrNoFamily) {
+		t.Error("write a batch to a dropped family", err)
+	}
+
+	// 重新创建的同名列族是空的, wal.log中之前的记录不会恢复到新的列族
+	if users, err = d.CreateFamily("users", config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	cfg.Families = nil
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if users, err = d.Family("users"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := scanKeys(t, users.Scan("", "")); len(keys) != 0 {
+		t.Errorf("recreated family should be empty, got %v", keys)
+	}
+	if v, _, _ := Get[int](d, "c"); v != 3 {
+		t.Errorf("default c = %d", v)
+	}
+}
+
+func TestIdleFamilyWal(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 10, Threshold: 100, MaxWalSize: 1}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := d.CreateFamily("idle", config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 列族只写入一次, 之后默认列族落盘时wal.log超出限制, 它也要一起落盘, 否则旧文件都不能删除
+	_ = Set[int](idle, "a", 1)
+	for i := 0; i < 3; i++ {
+		_ = Set[int](d, "b", i)
+		if err = d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idle.unflushed() {
+		t.Error("idle family not flushed")
+	}
+	records := 0
+	if err = d.Wal.Read(func(values []kv.Value) {
+		records += len(values)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if records != 0 {
+		t.Error("wal records", records)
+	}
+	_ = d.Close()
+
+	cfg.Families = map[string]config.Config{"idle": {}}
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	if idle, err = d.Family("idle"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := Get[int](idle, "a"); !ok || err != nil || v != 1 {
+		t.Errorf("idle a = %d %v %v", v, ok, err)
+	}
+	if v, ok, err := Get[int](d, "b"); !ok || err != nil || v != 2 {
+		t.Errorf("b = %d %v %v", v, ok, err)
+	}
+}
+
+func TestDropFamilyDuringFlush(t *testing.T) {
+	d := openTestDatabase(t)
+	fam, err := d.CreateFamily("tmp", config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			_ = Set[int](fam, "k", i)
+			if err := fam.Flush(); err != nil {
+				done <- err
+				return
+			}
+			if err := fam.Compact(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// 删除等待进行中的落盘和压缩结束, 之后它们返回ErrClosed, 不会再写列族的目录
+	if err = d.DropFamily("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; !errors.Is(err, kv.ErrClosed) {
+		t.Error("flush a dropped family", err)
+	}
+	if _, err = os.Stat(d.familyDir("tmp")); !os.IsNotExist(err) {
+		t.Error("the directory of a dropped family should be removed", err)
+	}
+	_ = d.Close()
+	if err = d.DropFamily("tmp"); !errors.Is(err, kv.ErrClosed) {
+		t.Error("drop a family after close", err)
+	}
+}
+
+func TestUnfinishedFamily(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.CreateFamily("users", config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.Close()
+	// 创建时在写created之前崩溃, 或者删除到一半时崩溃, 留下没有created的目录
+	if err = os.Remove(filepath.Join(dir, familiesDir, "users", createdName)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, familiesDir, "orders"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	if len(d.Families()) != 1 {
+		t.Errorf("families %d, want only the default family", len(d.Families()))
+	}
+	for _, name := range []string{"users", "orders"} {
+		if _, err = os.Stat(filepath.Join(dir, familiesDir, name)); !os.IsNotExist(err) {
+			t.Errorf("the unfinished family %s should be removed: %v", name, err)
+		}
+	}
+	if _, err = d.CreateFamily("users", config.Config{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:48
+ * @Func: 变更订阅, 把提交的写入按序列号的顺序推送给订阅者
+ **/
+
+const defaultFeedBuffer = 1024 // 没有配置时每个订阅缓冲的事件数量
+
+//
+//  EventOp
+//  @Description: 事件对应的写操作
+//
+type EventOp int
+
+const (
+	OpSet         EventOp = iota // 写入一个值
+	OpDelete                     // 删除一个key
+	OpMerge                      // 写入一个合并操作数
+	OpDeleteRange                // 删除[Key, End)内的所有key
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	case OpMerge:
+		return "merge"
+	case OpDeleteRange:
+		return "delete-range"
+	}
+	return fmt.Sprintf("EventOp(%d)", int(op))
+}
+
+//
+//  Event
+//  @Description: 一次提交的写入, 批量写入中的每个元素各是一个事件, 序列号连续
+//
+type Event struct {
+	Op       EventOp
+	Key      string
+	End      string // 范围删除的终点, 为空表示没有上界
+	Value    []byte // 写入时保存的字节, 删除时为空
+	Codec    string // 值的编码方式
+	ExpireAt int64  // 过期时间, 0表示永不过期
+	Seq      uint64
+}
+
+//
+// Decode
+//  @Description: 用写入时的编码方式将事件的值反序列化到value指向的对象中
+//  @receiver e
+//  @param value	必须是一个指针
+//  @return error
+//
+func (e Event) Decode(value any) error {
+	data := kv.Value{Key: e.Key, Value: e.Value, Codec: e.Codec}
+	return data.Decode(value)
+}
+
+//
+//  Subscription
+//  @Description: 一个变更订阅, 从C中按序列号的顺序读取事件. C被关闭表示订阅结束, 原因通过Err获取:
+//  读取太慢, 缓冲区满时返回ErrSlowConsumer, 可以用最后读到的序列号调用SubscribeFrom继续;
+//  数据库关闭或者列族删除时返回ErrClosed; 调用Close时为nil
+//
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	family string
+	prefix string
+	cmp    kv.Comparator
+	err    error // 订阅结束的原因, 由store.subMu保护
+	closed bool
+	store  *store
+}
+
+//
+// Subscribe
+//  @Description: 订阅之后提交的, key以prefix为前缀的写入, prefix为空表示所有写入; 用完需要Close
+//  @receiver d
+//  @param prefix
+//  @return *Subscription
+//  @return error
+//
+func (d *Database) Subscribe(prefix string) (*Subscription, error) {
+	return d.subscribe(prefix, 0, false)
+}
+
+//
+// SubscribeFrom
+//  @Description: 从序列号seq之后开始订阅: 先重放wal.log中序列号大于seq的写入, 再继续推送之后提交的写入;
+//  这些写入已经随落盘从wal.log中清理掉时返回ErrTruncated
+//  @receiver d
+//  @param prefix
+//  @param seq	最后处理过的事件的序列号
+//  @return *Subscription
+//  @return error
+//
+func (d *Database) SubscribeFrom(prefix string, seq uint64) (*Subscription, error) {
+	return d.subscribe(prefix, seq, true)
+}
+
+func (d *Database) subscribe(prefix string, seq uint64, resume bool) (*Subscription, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil, kv.ErrClosed
+	}
+	log.Printf("Subscribe %q", prefix)
+	sub := &Subscription{
+		family: d.name,
+		prefix: prefix,
+		cmp:    d.cfg.GetComparator(),
+		store:  d.store,
+	}
+	// 持有写锁, 重放和注册之间不会有新的写入, 事件不会重复也不会遗漏
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	backlog := make([]Event, 0)
+	if resume {
+		if seq < atomic.LoadUint64(&d.walBase) {
+			return nil, fmt.Errorf("%w: %d", kv.ErrTruncated, seq)
+		}
+		err := d.Wal.Read(func(values []kv.Value) {
+			for _, value := range values {
+				if value.Seq > seq && familyOf(value) == sub.family {
+					if event := eventOf(value); sub.matches(event) {
+						backlog = append(backlog, event)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	size := d.cfg.FeedBuffer
+	if size <= 0 {
+		size = defaultFeedBuffer
+	}
+	sub.ch = make(chan Event, size+len(backlog))
+	sub.C = sub.ch
+	for _, event := range backlog {
+		sub.ch <- event
+	}
+	d.subMu.Lock()
+	d.subscribers[sub] = struct{}{}
+	d.subMu.Unlock()
+	return sub, nil
+}
+
+//
+// Err
+//  @Description: 订阅结束的原因, 订阅还在进行时为nil
+//  @receiver s
+//  @return error
+//
+func (s *Subscription) Err() error {
+	s.store.subMu.Lock()
+	defer s.store.subMu.Unlock()
+	return s.err
+}
+
+//
+// Close
+//  @Description: 取消订阅并关闭C, 重复调用是安全的
+//  @receiver s
+//
+func (s *Subscription) Close() {
+	s.store.subMu.Lock()
+	defer s.store.subMu.Unlock()
+	s.stop(nil)
+}
+
+//
+// stop
+//  @Description: 结束订阅, 调用方需要持有store.subMu
+//  @receiver s
+//  @param err
+//
+func (s *Subscription) stop(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	delete(s.store.subscribers, s)
+	close(s.ch)
+}
+
+//
+// matches
+//  @Description: 判断事件是否在订阅的前缀内; 范围删除只要和前缀的范围有交集就推送,
+//  不是按字节序排列时带前缀的key不是连续的一段, 范围删除总是推送
+//  @receiver s
+//  @param event
+//  @return bool
+//
+func (s *Subscription) matches(event Event) bool {
+	if event.Op != OpDeleteRange {
+		return strings.HasPrefix(event.Key, s.prefix)
+	}
+	if s.prefix == "" || s.cmp != kv.Bytewise {
+		return true
+	}
+	end := prefixEnd(s.prefix)
+	return (event.End == "" || kv.CompareKeys(s.cmp, event.End, s.prefix) > 0) && (end == "" || kv.CompareKeys(s.cmp, event.Key, end) < 0)
+}
+
+//
+// publish
+//  @Description: 把已经写入wal.log和内存表的values推送给订阅者, values中记录了所属的列族;
+//  订阅者的缓冲区满时不等待, 直接结束它的订阅. 调用方需要持有d.writeMu
+//  @receiver st
+//  @param values
+//
+func (st *store) publish(values []kv.Value) {
+	st.subMu.Lock()
+	defer st.subMu.Unlock()
+	if len(st.subscribers) == 0 {
+		return
+	}
+	for _, value := range values {
+		event := eventOf(value)
+		for sub := range st.subscribers {
+			if sub.family != familyOf(value) || !sub.matches(event) {
+				continue
+			}
+			select {
+			case sub.ch <- event:
+			default:
+				log.Printf("Subscriber of %q fell behind at %d", sub.prefix, event.Seq)
+				sub.stop(kv.ErrSlowConsumer)
+			}
+		}
+	}
+}
+
+//
+// closeSubscriptions
+//  @Description: 结束列族family的所有订阅, family为空时结束所有订阅
+//  @receiver st
+//  @param family
+//  @param err
+//
+func (st *store) closeSubscriptions(family string, err error) {
+	st.subMu.Lock()
+	defer st.subMu.Unlock()
+	for sub := range st.subscribers {
+		if family == "" || sub.family == family {
+			sub.stop(err)
+		}
+	}
+}
+
+//
+// eventOf
+//  @Description: 把写入的记录转换为事件, 值复制一份, 订阅者修改它不会影响内存表
+//  @param value
+//  @return Event
+//
+func eventOf(value kv.Value) Event {
+	event := Event{Op: OpSet, Key: value.Key, Value: append([]byte(nil), value.Value...), Codec: value.Codec, ExpireAt: value.ExpireAt, Seq: value.Seq}
+	switch {
+	case value.Range:
+		event.Op, event.End, event.Value = OpDeleteRange, string(value.Value), nil
+	case value.Deleted:
+		event.Op = OpDelete
+	case value.Merge:
+		event.Op = OpMerge
+	}
+	return event
+}
+
+//
+// Subscribe
+//  @Description: 变更订阅, 对Database.Subscribe的封装
+//  @param d
+//  @param prefix
+//  @return *Subscription
+//  @return error
+//
+func Subscribe(d *Database, prefix string) (*Subscription, error) {
+	return d.Subscribe(prefix)
+}
+
+//
+// SubscribeFrom
+//  @Description: 从序列号seq之后开始的变更订阅, 对Database.SubscribeFrom的封装
+//  @param d
+//  @param prefix
+//  @param seq
+//  @return *Subscription
+//  @return error
+//
+func SubscribeFrom(d *Database, prefix string, seq uint64) (*Subscription, error) {
+	return d.SubscribeFrom(prefix, seq)
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:48
+ * @Func:
+ **/
+
+// drain 读出订阅中已经缓冲的所有事件, 返回"操作 key"的列表和最后一个事件的序列号
+func drain(sub *Subscription) ([]string, uint64) {
+	events := make([]string, 0)
+	var last uint64
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return events, last
+			}
+			events = append(events, event.Op.String()+" "+event.Key)
+			last = event.Seq
+		default:
+			return events, last
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := openTestDatabase(t)
+	sub, err := d.Subscribe("user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](d, "user:1", 1)
+	_ = Set[int](d, "order:1", 1)
+	_ = d.Delete("user:1")
+	b := d.NewWriteBatch()
+	_ = b.Put("user:2", 2)
+	_ = b.Put("order:2", 2)
+	_ = d.Write(b)
+	_ = d.DeleteRange("user:", "user:~")
+	_ = d.DeleteRange("order:", "order:~")
+
+	event := <-sub.C
+	var v int
+	if err = event.Decode(&v); err != nil || event.Op != OpSet || event.Key != "user:1" || v != 1 || event.Seq != 1 {
+		t.Errorf("first event = %+v %d %v", event, v, err)
+	}
+	events, last := drain(sub)
+	want := []string{"delete user:1", "set user:2", "delete-range user:"}
+	if !reflect.DeepEqual(events, want) || last != 6 {
+		t.Errorf("events = %v last %d, want %v", events, last, want)
+	}
+	sub.Close()
+	sub.Close()
+	if _, ok := <-sub.C; ok || sub.Err() != nil {
+		t.Errorf("closed subscription: %v", sub.Err())
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100, FeedBuffer: 2}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	sub, err := d.Subscribe("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_ = Set[string](d, key, key)
+	}
+	// 缓冲区只能放两个事件, 之后订阅被关闭
+	events, last := drain(sub)
+	if !reflect.DeepEqual(events, []string{"set a", "set b"}) || !errors.Is(sub.Err(), kv.ErrSlowConsumer) {
+		t.Fatalf("slow consumer: %v %v", events, sub.Err())
+	}
+	// 从最后读到的序列号继续, 重放wal.log中之后的写入
+	if sub, err = d.SubscribeFrom("", last); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[string](d, "f", "f")
+	if events, last = drain(sub); !reflect.DeepEqual(events, []string{"set c", "set d", "set e", "set f"}) || last != 6 {
+		t.Errorf("resume: %v %d", events, last)
+	}
+
+	// 关闭数据库时订阅结束, 重新打开后仍然可以从wal.log中恢复
+	_ = d.Close()
+	if _, ok := <-sub.C; ok || !errors.Is(sub.Err(), kv.ErrClosed) {
+		t.Errorf("close: %v", sub.Err())
+	}
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = d.SubscribeFrom("", 4); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ = drain(sub); !reflect.DeepEqual(events, []string{"set e", "set f"}) {
+		t.Errorf("resume after reopen: %v", events)
+	}
+	sub.Close()
+
+	// 落盘后wal.log被重置, 之前的写入不能再重放
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.SubscribeFrom("", 4); !errors.Is(err, kv.ErrTruncated) {
+		t.Errorf("SubscribeFrom after flush: %v", err)
+	}
+	if sub, err = d.SubscribeFrom("", 6); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[string](d, "g", "g")
+	if events, _ = drain(sub); !reflect.DeepEqual(events, []string{"set g"}) {
+		t.Errorf("resume from the latest: %v", events)
+	}
+	sub.Close()
+}
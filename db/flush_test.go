@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:59
+ * @Func:
+ **/
+
+func TestImmutable(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range map[string]int{"a": 0, "b": 20, "c": 3, "d": 0} {
+			v, ok, err := Get[int](d, key)
+			if err != nil || ok != (want != 0) || v != want {
+				t.Errorf("%s: %s = %d %v %v, want %d", stage, key, v, ok, err, want)
+			}
+		}
+		keys, values := scanKeys(t, d.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"b", "c"}) || !reflect.DeepEqual(values, []int{20, 3}) {
+			t.Errorf("%s: scan %v %v", stage, keys, values)
+		}
+	}
+
+	// 切换出去还没有落盘的内存表中的数据仍然可见, 活跃内存表中的更新
+	_ = Set[int](d, "a", 1)
+	_ = Set[int](d, "b", 2)
+	_ = Set[int](d, "c", 3)
+	_ = DeleteRange(d, "a", "b")
+	_ = d.rotate()
+	_ = Set[int](d, "b", 20)
+	_ = d.rotate()
+	_ = Set[int](d, "d", 4)
+	_ = Delete(d, "d")
+	if n := d.Immutables(); n != 2 {
+		t.Fatal("immutables", n)
+	}
+	// 估算不去重, b在两个内存表中各算一次
+	if count, _ := d.ApproximateCount("", ""); count != 5 {
+		t.Error("approximate count", count)
+	}
+	check("immutable")
+
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Immutables(); n != 0 || !d.MemoryTree.Empty() {
+		t.Error("immutables after flush", n)
+	}
+	check("flush")
+
+	_ = d.Close()
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("reopen")
+}
+
+func TestFlushConcurrent(t *testing.T) {
+	d := openTestDatabase(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := d.Flush(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// 落盘过程中写入的key马上就能读到
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		if err := Set[int](d, key, i); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok, err := Get[int](d, key); !ok || err != nil || v != i {
+			t.Fatalf("%s = %d %v %v", key, v, ok, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if count, _ := d.ApproximateCount("", ""); count < 300 {
+		t.Error("approximate count", count)
+	}
+}
+
+func TestFlushRetiresWal(t *testing.T) {
+	d := openTestDatabase(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = Set[int](d, fmt.Sprintf("k%d", i%50), i)
+		}
+	}()
+	// 一直有写入时活跃内存表不会为空, 落盘的不可变内存表对应的wal.log旧文件仍然要删除
+	for i := 0; i < 3; i++ {
+		for atomic.LoadUint64(&d.seq) < uint64(100*(i+1)) {
+			time.Sleep(time.Millisecond)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushed := atomic.LoadUint64(&d.flushed)
+	close(stop)
+	wg.Wait()
+	if flushed == 0 {
+		t.Fatal("nothing flushed")
+	}
+	err := d.Wal.Read(func(values []kv.Value) {
+		for _, value := range values {
+			if value.Seq <= flushed {
+				t.Fatalf("wal.log still has seq %d, flushed %d", value.Seq, flushed)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,500 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"strings"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:04
+ * @Func: 范围查询, 对内存表和所有SSTable做多路归并
+ **/
+
+//
+//  Iterator
+//  @Description: 范围查询的迭代器, 双向遍历[start, end)内未被删除的元素;
+//  同一个key在多处出现时以最新的为准. 升序遍历:
+//	it := d.Scan("user:100", "user:200")
+//	defer it.Close()
+//	for it.Next() {
+//		it.Key(); it.Value(&v)
+//	}
+//	err := it.Err()
+//  降序遍历把Next换成Prev即可, 也可以用Seek/SeekForPrev定位后再继续Next/Prev
+//
+type Iterator struct {
+	iters   []kv.Iterator // 各数据源的迭代器, 按从新到旧排列, 下标越小越新
+	start   string        // 为空表示没有下界
+	end     string        // 为空表示没有上界
+	prefix  string        // 不为空时只返回带这个前缀的key
+	cmp     kv.Comparator
+	key     string
+	value   kv.Value
+	valid   bool // 当前是否指向一个元素
+	reverse bool // 当前的遍历方向, 各数据源都已经越过了当前元素
+	started bool
+	err     error
+	// 合并操作数和更旧的版本一起算出的值
+	resolve func(key string) (kv.Value, error)
+	// 对迭代器可见的范围删除标记, 被遮住的版本不返回
+	ranges kv.RangeIndex
+	// 不属于快照的迭代器自己持有的快照, 遍历期间写入覆盖的版本保留下来
+	snap *Snapshot
+}
+
+//
+// Scan
+//  @Description: 查询key在[start, end)范围内的元素, end为空表示一直遍历到最后; 迭代器用完需要Close
+//  @receiver d
+//  @param start
+//  @param end
+//  @return *Iterator
+//
+func (d *Database) Scan(start string, end string) *Iterator {
+	return d.scan(start, end, kv.MaxSeq)
+}
+
+//
+// scan
+//  @Description: 查询key在[start, end)范围内, 对序列号seq可见的元素
+//  @receiver d
+//  @param start
+//  @param end
+//  @param seq
+//  @return *Iterator
+//
+func (d *Database) scan(start string, end string, seq uint64) *Iterator {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return NewErrIterator(kv.ErrClosed)
+	}
+	// 内存表和写入并发遍历, 固定在当前的序列号上
+	var snap *Snapshot
+	if seq == kv.MaxSeq {
+		snap = d.pin()
+		seq = snap.seq
+	}
+	cmp := d.cfg.GetComparator()
+	return &Iterator{
+		snap:  snap,
+		iters: d.iterators(start, end, seq),
+		start: start,
+		end:   end,
+		cmp:   cmp,
+		resolve: func(key string) (kv.Value, error) {
+			return d.mergeAt(key, seq)
+		},
+		ranges: kv.NewRangeIndex(cmp, d.rangesAt(seq)),
+	}
+}
+
+//
+// ScanBytes
+//  @Description: 以[]byte为边界的Scan, 空表示没有边界
+//  @receiver d
+//  @param start
+//  @param end
+//  @return *Iterator
+//
+func (d *Database) ScanBytes(start []byte, end []byte) *Iterator {
+	return d.Scan(string(start), string(end))
+}
+
+//
+// ScanPrefix
+//  @Description: 查询所有以prefix为前缀的元素, 直接定位到第一个带前缀的key, 遇到第一个超出前缀的key停止
+//  @receiver d
+//  @param prefix
+//  @return *Iterator
+//
+func (d *Database) ScanPrefix(prefix string) *Iterator {
+	return d.scanPrefix(prefix, kv.MaxSeq)
+}
+
+//
+// scanPrefix
+//  @Description: 查询以prefix为前缀, 对序列号seq可见的元素; 只有按字节序排列时带前缀的key才是连续的一段,
+//  其他比较器需要遍历所有元素再过滤
+//  @receiver d
+//  @param prefix
+//  @param seq
+//  @return *Iterator
+//
+func (d *Database) scanPrefix(prefix string, seq uint64) *Iterator {
+	if d.cfg.GetComparator() == kv.Bytewise {
+		return d.scan(prefix, prefixEnd(prefix), seq)
+	}
+	it := d.scan("", "", seq)
+	it.prefix = prefix
+	return it
+}
+
+//
+// prefixEnd
+//  @Description: 计算前缀的上界: 所有以prefix为前缀的key都小于它; 返回空表示没有上界
+//  @param prefix
+//  @return string
+//
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		// 末尾的0xff不能再加1, 去掉后对前一个字节加1
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+//
+// NewErrIterator
+//  @Description: 返回一个没有元素, Err为err的迭代器
+//  @param err
+//  @return *Iterator
+//
+func NewErrIterator(err error) *Iterator {
+	return &Iterator{err: err}
+}
+
+//
+// Next
+//  @Description: 移动到下一个(更大的)元素, 第一次调用时定位到第一个元素; 没有更多元素或者出错时返回false,
+//  之后可以用Seek等方法重新定位
+//  @receiver it
+//  @return bool
+//
+func (it *Iterator) Next() bool {
+	if !it.started {
+		return it.First()
+	}
+	if !it.valid {
+		return false
+	}
+	if it.reverse {
+		it.switchDirection(false)
+	}
+	return it.step()
+}
+
+//
+// Prev
+//  @Description: 移动到上一个(更小的)元素, 第一次调用时定位到最后一个元素; 没有更多元素或者出错时返回false
+//  @receiver it
+//  @return bool
+//
+func (it *Iterator) Prev() bool {
+	if !it.started {
+		return it.Last()
+	}
+	if !it.valid {
+		return false
+	}
+	if !it.reverse {
+		it.switchDirection(true)
+	}
+	return it.step()
+}
+
+//
+// First
+//  @Description: 定位到范围内的第一个元素
+//  @receiver it
+//  @return bool
+//
+func (it *Iterator) First() bool {
+	return it.Seek(it.start)
+}
+
+//
+// Last
+//  @Description: 定位到范围内的最后一个元素
+//  @receiver it
+//  @return bool
+//
+func (it *Iterator) Last() bool {
+	if !it.begin(true) {
+		return false
+	}
+	for _, iter := range it.iters {
+		if it.end == "" {
+			iter.SeekToLast()
+		} else {
+			// 等于end的key在step中跳过
+			iter.SeekForPrev(it.end)
+		}
+	}
+	return it.step()
+}
+
+//
+// Seek
+//  @Description: 定位到第一个 >= key 的元素, 之后可以继续Next/Prev
+//  @receiver it
+//  @param key
+//  @return bool
+//
+func (it *Iterator) Seek(key string) bool {
+	if !it.begin(false) {
+		return false
+	}
+	if it.start != "" && kv.CompareKeys(it.cmp, key, it.start) < 0 {
+		key = it.start
+	}
+	for _, iter := range it.iters {
+		if key == "" {
+			iter.SeekToFirst()
+		} else {
+			iter.Seek(key)
+		}
+	}
+	return it.step()
+}
+
+//
+// SeekForPrev
+//  @Description: 定位到最后一个 <= key 的元素, 之后可以继续Next/Prev
+//  @receiver it
+//  @param key
+//  @return bool
+//
+func (it *Iterator) SeekForPrev(key string) bool {
+	if it.end != "" && kv.CompareKeys(it.cmp, key, it.end) >= 0 {
+		return it.Last()
+	}
+	if !it.begin(true) {
+		return false
+	}
+	for _, iter := range it.iters {
+		iter.SeekForPrev(key)
+	}
+	return it.step()
+}
+
+//
+// begin
+//  @Description: 重新定位前的准备, 设置遍历方向
+//  @receiver it
+//  @param reverse
+//  @return bool	迭代器是否可用
+//
+func (it *Iterator) begin(reverse bool) bool {
+	if it.err != nil || it.iters == nil {
+		it.valid = false
+		return false
+	}
+	it.started = true
+	it.reverse = reverse
+	return true
+}
+
+//
+// switchDirection
+//  @Description: 改变遍历方向, 把各数据源重新定位到当前元素的另一侧
+//  @receiver it
+//  @param reverse
+//
+func (it *Iterator) switchDirection(reverse bool) {
+	it.reverse = reverse
+	for _, iter := range it.iters {
+		if reverse {
+			iter.SeekForPrev(it.key)
+		} else {
+			iter.Seek(it.key)
+		}
+		// 跳过当前元素本身
+		if iter.Valid() && iter.Key() == it.key {
+			it.move(iter)
+		}
+	}
+}
+
+//
+// move
+//  @Description: 按当前的遍历方向移动一个数据源
+//  @receiver it
+//  @param iter
+//
+func (it *Iterator) move(iter kv.Iterator) {
+	if it.reverse {
+		iter.Prev()
+	} else {
+		iter.Next()
+	}
+}
+
+//
+// step
+//  @Description: 从各数据源的当前位置, 沿遍历方向找到下一个未被删除的元素
+//  @receiver it
+//  @return bool
+//
+func (it *Iterator) step() bool {
+	it.valid = false
+	for {
+		// 找出所有数据源中最小(降序时最大)的key, key相同时下标小的(更新的)优先
+		winner := -1
+		for i, iter := range it.iters {
+			if !iter.Valid() {
+				continue
+			}
+			if winner == -1 {
+				winner = i
+				continue
+			}
+			key, best := iter.Key(), it.iters[winner].Key()
+			if c := kv.CompareKeys(it.cmp, key, best); (!it.reverse && c < 0) || (it.reverse && c > 0) {
+				winner = i
+			}
+		}
+		if it.err = it.childErr(); it.err != nil || winner == -1 {
+			return false
+		}
+		key := it.iters[winner].Key()
+		if !it.reverse && it.end != "" && kv.CompareKeys(it.cmp, key, it.end) >= 0 {
+			return false
+		}
+		if it.reverse && it.start != "" && kv.CompareKeys(it.cmp, key, it.start) < 0 {
+			return false
+		}
+		entry := it.iters[winner].Value()
+		// 所有数据源中同一个key的旧版本都跳过
+		for _, iter := range it.iters {
+			if iter.Valid() && iter.Key() == key {
+				it.move(iter)
+			}
+		}
+		if it.err = it.childErr(); it.err != nil {
+			return false
+		}
+		// 不带前缀的key, 以及降序遍历时超出上界的key不返回
+		if !strings.HasPrefix(key, it.prefix) || (it.end != "" && kv.CompareKeys(it.cmp, key, it.end) >= 0) {
+			continue
+		}
+		// 被范围删除标记遮住的key不返回
+		if _, ok := it.ranges.Covering(key, entry.Seq, kv.MaxSeq); ok {
+			continue
+		}
+		// 合并操作数要和更旧的版本一起算出值
+		if entry.Merge {
+			if entry, it.err = it.resolve(key); it.err != nil {
+				return false
+			}
+		}
+		// 被删除或者已经过期的key不返回
+		if entry.Deleted || entry.Expired(time.Now().UnixNano()) {
+			continue
+		}
+		it.key = entry.Key
+		it.value = entry
+		it.valid = true
+		return true
+	}
+}
+
+//
+// Key
+//  @Description: 当前元素的key
+//  @receiver it
+//  @return string
+//
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+//
+// KeyBytes
+//  @Description: 以[]byte返回当前元素的key
+//  @receiver it
+//  @return []byte
+//
+func (it *Iterator) KeyBytes() []byte {
+	return []byte(it.key)
+}
+
+//
+// Value
+//  @Description: 用写入时的编码方式, 将当前元素的值反序列化到value指向的对象中
+//  @receiver it
+//  @param value	必须是一个指针
+//  @return error
+//
+func (it *Iterator) Value(value any) error {
+	_, err := decodeValue(it.value, value)
+	return err
+}
+
+//
+// RawValue
+//  @Description: 原样返回当前元素保存的字节
+//  @receiver it
+//  @return []byte
+//
+func (it *Iterator) RawValue() []byte {
+	return it.value.Value
+}
+
+//
+// Err
+//  @Description: 遍历过程中遇到的错误
+//  @receiver it
+//  @return error
+//
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+//
+// Close
+//  @Description: 释放迭代器持有的SSTable和快照, 重复调用是安全的
+//  @receiver it
+//  @return error
+//
+func (it *Iterator) Close() error {
+	if it.snap != nil {
+		it.snap.Release()
+	}
+	var first error
+	for _, iter := range it.iters {
+		if err := iter.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	it.iters = nil
+	return first
+}
+
+func (it *Iterator) childErr() error {
+	for _, iter := range it.iters {
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Scan
+//  @Description: 范围查询, 对Database.Scan的封装
+//  @param d
+//  @param start
+//  @param end
+//  @return *Iterator
+//
+func Scan(d *Database, start string, end string) *Iterator {
+	return d.Scan(start, end)
+}
+
+//
+// ScanPrefix
+//  @Description: 前缀查询, 对Database.ScanPrefix的封装
+//  @param d
+//  @param prefix
+//  @return *Iterator
+//
+func ScanPrefix(d *Database, prefix string) *Iterator {
+	return d.ScanPrefix(prefix)
+}
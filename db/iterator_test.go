@@ -0,0 +1,271 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/bst"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:04
+ * @Func:
+ **/
+
+func openTestDatabase(t *testing.T) *Database {
+	d, err := NewDatabase(config.Config{
+		DataDir:    t.TempDir(),
+		Level0Size: 1,
+		PartSize:   2,
+		Threshold:  100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d
+}
+
+func scanKeys(t *testing.T, it *Iterator) ([]string, []int) {
+	defer it.Close()
+	keys := make([]string, 0)
+	values := make([]int, 0)
+	for it.Next() {
+		var v int
+		if err := it.Value(&v); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, it.Key())
+		values = append(values, v)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys, values
+}
+
+func TestScan(t *testing.T) {
+	d := openTestDatabase(t)
+	// 第一批数据落盘到SSTable
+	for i, key := range []string{"user:099", "user:100", "user:150", "user:199", "user:200"} {
+		_ = Set[int](d, key, i)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 第二批数据覆盖和删除一部分, 再落盘一个SSTable
+	_ = Set[int](d, "user:150", 15)
+	_ = Delete(d, "user:199")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 内存表中的数据
+	_ = Set[int](d, "user:120", 12)
+	_ = Delete(d, "user:100")
+
+	keys, values := scanKeys(t, d.Scan("user:100", "user:200"))
+	if !reflect.DeepEqual(keys, []string{"user:120", "user:150"}) {
+		t.Error(keys)
+	}
+	if !reflect.DeepEqual(values, []int{12, 15}) {
+		t.Error(values)
+	}
+
+	keys, _ = scanKeys(t, d.Scan("", ""))
+	if !reflect.DeepEqual(keys, []string{"user:099", "user:120", "user:150", "user:200"}) {
+		t.Error(keys)
+	}
+}
+
+func TestScanDuringCompaction(t *testing.T) {
+	d := openTestDatabase(t)
+	for i := 0; i < 3; i++ {
+		_ = Set[int](d, "k"+string(rune('a'+i)), i)
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := d.Scan("", "")
+	// 压缩会删除level 0的文件, 但打开的迭代器仍然可以读取
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.SSTableTree.GetTableNums(0); n != 0 {
+		t.Fatalf("level 0 should be compacted, but has %d tables", n)
+	}
+	keys, values := scanKeys(t, it)
+	if !reflect.DeepEqual(keys, []string{"ka", "kb", "kc"}) || !reflect.DeepEqual(values, []int{0, 1, 2}) {
+		t.Error(keys, values)
+	}
+	keys, _ = scanKeys(t, d.Scan("kb", ""))
+	if !reflect.DeepEqual(keys, []string{"kb", "kc"}) {
+		t.Error(keys)
+	}
+}
+
+func TestScanFileReuse(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_ = Set[int](d, "k"+string(rune('a'+i)), i)
+		if err = d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := d.Scan("", "")
+	if err = d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// 压缩之后新落盘的SSTable不能用迭代器还在读的旧文件名, 否则迭代器关闭时会删掉它
+	_ = Set[int](d, "kd", 3)
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	_ = d.Close()
+	if d, err = NewDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	keys, values := scanKeys(t, d.Scan("", ""))
+	if !reflect.DeepEqual(keys, []string{"ka", "kb", "kc", "kd"}) || !reflect.DeepEqual(values, []int{0, 1, 2, 3}) {
+		t.Error(keys, values)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "tenant/12/a", 0)
+	_ = Set[int](d, "tenant/123/a", 1)
+	_ = Set[int](d, "tenant/123/b", 2)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](d, "tenant/123/c", 3)
+	_ = Set[int](d, "tenant/124/a", 4)
+	_ = Set[int](d, "tenant/123\xff", 5)
+
+	keys, _ := scanKeys(t, d.ScanPrefix("tenant/123/"))
+	if !reflect.DeepEqual(keys, []string{"tenant/123/a", "tenant/123/b", "tenant/123/c"}) {
+		t.Error(keys)
+	}
+	keys, _ = scanKeys(t, d.ScanPrefix("tenant/123\xff"))
+	if !reflect.DeepEqual(keys, []string{"tenant/123\xff"}) {
+		t.Error(keys)
+	}
+	// 落盘的SSTable不包含这个前缀, 直接跳过
+	it := d.ScanPrefix("tenant/124/")
+	if len(it.iters) != 1 {
+		t.Errorf("the SSTable should be skipped, got %d iterators", len(it.iters))
+	}
+	keys, _ = scanKeys(t, it)
+	if !reflect.DeepEqual(keys, []string{"tenant/124/a"}) {
+		t.Error(keys)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"":          "",
+		"abc":       "abd",
+		"ab\xff":    "ac",
+		"\xff\xff":  "",
+		"tenant/1/": "tenant/10",
+	}
+	for prefix, want := range tests {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestScanReverse(t *testing.T) {
+	d := openTestDatabase(t)
+	for i, key := range []string{"e1", "e2", "e3", "e4", "e5"} {
+		_ = Set[int](d, key, i+1)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Delete(d, "e4")
+	_ = Set[int](d, "e6", 6)
+	_ = Set[int](d, "e2", 20)
+
+	// 降序遍历 [e2, e6)
+	it := d.Scan("e2", "e6")
+	keys := make([]string, 0)
+	for it.Prev() {
+		keys = append(keys, it.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{"e5", "e3", "e2"}) {
+		t.Error(keys)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	it = d.Scan("", "")
+	defer it.Close()
+	// e4已经删除, 定位到e3
+	if !it.SeekForPrev("e4") || it.Key() != "e3" {
+		t.Errorf("SeekForPrev(e4) got %q", it.Key())
+	}
+	var v int
+	if !it.Prev() || it.Key() != "e2" || it.Value(&v) != nil || v != 20 {
+		t.Errorf("Prev got %q, %d", it.Key(), v)
+	}
+	// 改变方向继续升序遍历
+	if !it.Next() || it.Key() != "e3" {
+		t.Errorf("Next got %q", it.Key())
+	}
+	if !it.Next() || it.Key() != "e5" {
+		t.Errorf("Next got %q", it.Key())
+	}
+	if it.SeekForPrev("e0") {
+		t.Error("there is no key <= e0")
+	}
+	if !it.Seek("e5") || it.Key() != "e5" || !it.Next() || it.Key() != "e6" || it.Next() {
+		t.Error("Seek(e5) should be followed by e6 only")
+	}
+}
+
+func TestScanMemTable(t *testing.T) {
+	// 两种内存表实现的结果一致
+	for _, memTable := range []func(cmp kv.Comparator) kv.MemTable{nil, bst.New} {
+		d, err := NewDatabase(config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 100, MemTable: memTable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = Set[int](d, "b", 2)
+		_ = Set[int](d, "a", 1)
+		snap, err := d.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = Set[int](d, "c", 3)
+		_ = Delete(d, "a")
+
+		keys, values := scanKeys(t, d.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"b", "c"}) || !reflect.DeepEqual(values, []int{2, 3}) {
+			t.Error(keys, values)
+		}
+		keys, _ = scanKeys(t, snap.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+			t.Error("snapshot scan", keys)
+		}
+		snap.Release()
+		if size, count := d.MemoryTree.ApproximateRange("", ""); size <= 0 || count != 3 {
+			t.Error(size, count)
+		}
+		_ = d.Close()
+	}
+}
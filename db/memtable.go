@@ -0,0 +1,223 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"github.com/ygzhang-yolo/lsmtree/sstTree"
+	"sync/atomic"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:59
+ * @Func: 活跃内存表和等待落盘的不可变内存表
+ **/
+
+//
+// Immutables
+//  @Description: 返回已经切换出去, 还没有落盘为SSTable的内存表数量
+//  @receiver d
+//  @return int
+//
+func (d *Database) Immutables() int {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	return len(d.immutables)
+}
+
+//
+// unflushed
+//  @Description: 活跃内存表或者不可变内存表中是否还有没有落盘的数据
+//  @receiver d
+//  @return bool
+//
+func (d *Database) unflushed() bool {
+	return !d.MemoryTree.Empty() || d.Immutables() > 0
+}
+
+//
+// rotate
+//  @Description: 把活跃内存表切换为不可变内存表, 加入等待落盘的队列, 同时切换wal.log, 这个内存表的写入都留在切换出去的旧文件中;
+//  活跃内存表为空时不切换. 调用方需要持有d.writeMu
+//  @receiver d
+//  @return error
+//
+func (d *Database) rotate() error {
+	d.immMu.Lock()
+	defer d.immMu.Unlock()
+	if d.MemoryTree.Empty() {
+		return nil
+	}
+	if err := d.Wal.Rotate(); err != nil {
+		return err
+	}
+	d.immutables = append(d.immutables, d.MemoryTree.Swap())
+	return nil
+}
+
+//
+// oldestImmutable
+//  @Description: 返回最早切换出去的不可变内存表, 没有时返回nil
+//  @receiver d
+//  @return kv.MemTable
+//
+func (d *Database) oldestImmutable() kv.MemTable {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	if len(d.immutables) == 0 {
+		return nil
+	}
+	return d.immutables[0]
+}
+
+//
+// retire
+//  @Description: 不可变内存表已经落盘为table, 插入table并把内存表从队列中去掉; 之后的读取从SSTable中找到这些数据.
+//  两步都持有immMu的写锁, 持有读锁同时读内存表和SSTable的读取不会两边都看到这些数据.
+//  比它新的写入都在之后切换的内存表中, 这个列族不大于它的最大序列号的写入都已经落盘
+//  @receiver d
+//  @param imm
+//  @param table	内存表没有数据时为nil
+//
+func (d *Database) retire(imm kv.MemTable, table *sstTree.SSTableNode) {
+	d.immMu.Lock()
+	defer d.immMu.Unlock()
+	if table != nil {
+		d.SSTableTree.Install(table)
+	}
+	if len(d.immutables) > 0 && d.immutables[0] == imm {
+		d.immutables = d.immutables[1:]
+	}
+	if seq := imm.MaxSeq(); seq > atomic.LoadUint64(&d.flushed) {
+		atomic.StoreUint64(&d.flushed, seq)
+	}
+}
+
+//
+// memGetAt
+//  @Description: 查找key在序列号seq时的版本, 先查活跃内存表, 再从新到旧查不可变内存表.
+//  切换内存表时持有immMu的写锁, 查找过程中持有读锁, 数据不会同时不在两处
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//
+func (d *Database) memGetAt(key string, seq uint64) (kv.Value, kv.SearchResult) {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	value, result := d.MemoryTree.GetAt(key, seq)
+	for i := len(d.immutables) - 1; i >= 0 && result == kv.None; i-- {
+		value, result = d.immutables[i].GetAt(key, seq)
+	}
+	return value, result
+}
+
+//
+// chainAt
+//  @Description: 从内存表到SSTable收集key在序列号seq时需要合并的版本, 从新到旧排列.
+//  整个过程持有immMu的读锁, 落盘不会让同一个内存表的版本在内存表和SSTable中各收集一次
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return []kv.Value
+//  @return error
+//
+func (d *Database) chainAt(key string, seq uint64) ([]kv.Value, error) {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	chain := d.MemoryTree.GetChainAt(key, seq)
+	for i := len(d.immutables) - 1; i >= 0 && (len(chain) == 0 || chain[len(chain)-1].Merge); i-- {
+		chain = append(chain, d.immutables[i].GetChainAt(key, seq)...)
+	}
+	if len(chain) == 0 || chain[len(chain)-1].Merge {
+		// 内存表中没有旧值, 继续到SSTable中找
+		older, err := d.SSTableTree.GetChainAt(key, seq)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, older...)
+	}
+	return chain, nil
+}
+
+//
+// memRangesAt
+//  @Description: 返回所有内存表中对序列号seq可见的范围删除标记
+//  @receiver d
+//  @param seq
+//  @return []kv.RangeTombstone
+//
+func (d *Database) memRangesAt(seq uint64) []kv.RangeTombstone {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	ranges := d.MemoryTree.RangesAt(seq)
+	for i := len(d.immutables) - 1; i >= 0; i-- {
+		ranges = append(ranges, d.immutables[i].RangesAt(seq)...)
+	}
+	return ranges
+}
+
+//
+// memCovering
+//  @Description: 在内存表中找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记;
+//  新的内存表中的标记总是比旧的内存表中的新, 找到就不用再查更旧的内存表
+//  @receiver d
+//  @param key
+//  @param seq
+//  @param at
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (d *Database) memCovering(key string, seq uint64, at uint64) (kv.RangeTombstone, bool) {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	if r, ok := d.MemoryTree.Covering(key, seq, at); ok {
+		return r, true
+	}
+	for i := len(d.immutables) - 1; i >= 0; i-- {
+		if r, ok := d.immutables[i].Covering(key, seq, at); ok {
+			return r, true
+		}
+	}
+	return kv.RangeTombstone{}, false
+}
+
+//
+// iterators
+//  @Description: 返回所有内存表和SSTable的迭代器, 内存表最新, 然后是从新到旧的SSTable; 迭代器创建后不受内存表切换的影响.
+//  创建期间持有immMu的读锁, 落盘不会让同一个内存表的数据在两个迭代器中各出现一次
+//  @receiver d
+//  @param start
+//  @param end
+//  @param seq
+//  @return []kv.Iterator
+//
+func (d *Database) iterators(start string, end string, seq uint64) []kv.Iterator {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	iters := []kv.Iterator{d.MemoryTree.NewIterator(start, end, seq)}
+	for i := len(d.immutables) - 1; i >= 0; i-- {
+		iters = append(iters, d.immutables[i].NewIterator(start, end, seq))
+	}
+	return append(iters, d.SSTableTree.NewIterators(start, end, seq)...)
+}
+
+//
+// memApproximate
+//  @Description: 估算所有内存表中[start, end)内的数据大小和key数量
+//  @receiver d
+//  @param start
+//  @param end
+//  @return int64
+//  @return int
+//
+func (d *Database) memApproximate(start string, end string) (int64, int) {
+	d.immMu.RLock()
+	defer d.immMu.RUnlock()
+	size, count := d.MemoryTree.ApproximateRange(start, end)
+	for _, imm := range d.immutables {
+		s, c := imm.ApproximateRange(start, end)
+		size, count = size+s, count+c
+	}
+	return size, count
+}
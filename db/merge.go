@@ -0,0 +1,125 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:30
+ * @Func: 合并写入, 只记录操作数, 读取时再和旧值合并
+ **/
+
+//
+// Merge
+//  @Description: 写入一个合并操作数, 不需要读取旧值; 读取时用配置的合并操作把它合并到旧值上,
+//  压缩时合并成普通的值. 没有配置合并操作时返回ErrMergeOperator
+//  @receiver d
+//  @param key
+//  @param operand	用数据库默认的编码方式序列化
+//  @return error
+//
+func (d *Database) Merge(key string, operand any) error {
+	return d.merge(key, operand, d.codec())
+}
+
+//
+// MergeRaw
+//  @Description: 原样写入操作数的字节, 一般和 kv.BytesAppend 一起使用
+//  @receiver d
+//  @param key
+//  @param operand
+//  @return error
+//
+func (d *Database) MergeRaw(key string, operand []byte) error {
+	return d.merge(key, operand, kv.Raw)
+}
+
+func (d *Database) merge(key string, operand any, codec kv.Codec) error {
+	if err := d.throttle(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
+	if d.cfg.MergeOperator == nil {
+		return kv.ErrMergeOperator
+	}
+	log.Print("Merge ", key)
+	data := kv.Value{
+		Key:   key,
+		Merge: true,
+	}
+	if err := data.Encode(codec, operand); err != nil {
+		return err
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, _, err := d.write(data)
+	return err
+}
+
+//
+// resolveMerge
+//  @Description: key在序列号seq时的最新版本是合并操作数, 从内存表到SSTable收集所有需要合并的版本, 算出合并后的值, 看不到任何版本时返回删除标记;
+//  调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return error
+//
+func (d *Database) resolveMerge(key string, seq uint64) (kv.Value, error) {
+	chain, err := d.chainAt(key, seq)
+	if err != nil {
+		return kv.Value{}, err
+	}
+	// 不注册快照的读取期间, 这些操作数可能已经被压缩合并成序列号更大的值, 在seq时看不到任何版本;
+	// 这时已经发布了新的写入, 调用方会用新的序列号重读, 当作删除标记即可
+	if len(chain) == 0 {
+		return kv.Value{Key: key, Deleted: true}, nil
+	}
+	// 被范围删除标记遮住的版本当作删除标记, 更旧的版本都不需要
+	for i, value := range chain {
+		if r, ok := d.covering(value, seq); ok {
+			chain = append(chain[:i], kv.Value{Key: key, Deleted: true, Seq: r.Seq})
+			break
+		}
+	}
+	return kv.ResolveMerge(d.cfg.MergeOperator, chain, time.Now().UnixNano())
+}
+
+//
+// mergeAt
+//  @Description: 加读锁的resolveMerge, 供迭代器使用
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return error
+//
+func (d *Database) mergeAt(key string, seq uint64) (kv.Value, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.Value{}, kv.ErrClosed
+	}
+	return d.resolveMerge(key, seq)
+}
+
+//
+// Merge[T any]
+//  @Description: 写入类型为T的合并操作数
+//  @param d
+//  @param key
+//  @param operand
+//  @return error
+//
+func Merge[T any](d *Database, key string, operand T) error {
+	return d.Merge(key, operand)
+}
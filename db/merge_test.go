@@ -0,0 +1,253 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:30
+ * @Func:
+ **/
+
+func openMergeDatabase(t *testing.T, dir string, op kv.MergeOperator) *Database {
+	d, err := NewDatabase(config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100, MergeOperator: op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d
+}
+
+func TestMerge(t *testing.T) {
+	if err := Merge[int64](openTestDatabase(t), "counter", 1); !errors.Is(err, kv.ErrMergeOperator) {
+		t.Fatal("merge without an operator", err)
+	}
+
+	dir := t.TempDir()
+	d := openMergeDatabase(t, dir, kv.Int64Add)
+	check := func(stage string, key string, want int64) {
+		t.Helper()
+		if v, ok, err := Get[int64](d, key); !ok || err != nil || v != want {
+			t.Errorf("%s: %s = %d %v %v, want %d", stage, key, v, ok, err, want)
+		}
+	}
+	// 旧值在SSTable中, 操作数在内存表中
+	_ = Set[int64](d, "counter", 10)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Merge[int64](d, "counter", 5)
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	_ = Merge[int64](d, "counter", 2)
+	// 没有旧值的计数器从0开始, 删除之后也重新从0开始
+	for i := 0; i < 3; i++ {
+		_ = Merge[int64](d, "hits", 1)
+	}
+	_ = Set[int64](d, "gone", 100)
+	_ = d.Delete("gone")
+	_ = Merge[int64](d, "gone", 7)
+	check("memory", "counter", 17)
+	check("memory", "hits", 3)
+	check("memory", "gone", 7)
+	if v, ok, err := GetAt[int64](snap, "counter"); !ok || err != nil || v != 15 {
+		t.Errorf("snapshot: counter = %d %v %v, want 15", v, ok, err)
+	}
+	keys, values := scanKeys(t, d.Scan("", ""))
+	if want := []string{"counter", "gone", "hits"}; !reflect.DeepEqual(keys, want) || !reflect.DeepEqual(values, []int{17, 7, 3}) {
+		t.Errorf("scan %v %v", keys, values)
+	}
+	// 条件写入看到的是合并后的值
+	if ok, err := CompareAndSwap[int64](d, "counter", 17, 20); !ok || err != nil {
+		t.Error("CompareAndSwap on a merged value", ok, err)
+	}
+	_ = Merge[int64](d, "counter", -3)
+	check("cas", "counter", 17)
+
+	// 从wal.log恢复
+	_ = d.Close()
+	d = openMergeDatabase(t, dir, kv.Int64Add)
+	check("reopen", "counter", 17)
+	check("reopen", "hits", 3)
+
+	// 操作数分散在多个SSTable中, 压缩后合并成普通的值
+	for i := 0; i < 3; i++ {
+		_ = Merge[int64](d, "counter", 1)
+		_ = Merge[int64](d, "hits", 1)
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("flush", "counter", 20)
+	check("flush", "hits", 6)
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compact", "counter", 20)
+	check("compact", "hits", 6)
+	check("compact", "gone", 7)
+	for _, key := range []string{"counter", "hits", "gone"} {
+		if chain, err := d.SSTableTree.GetChainAt(key, kv.MaxSeq); err != nil || len(chain) != 1 || chain[0].Merge {
+			t.Errorf("%s should be collapsed after compaction: %+v %v", key, chain, err)
+		}
+	}
+}
+
+func TestMergeRaw(t *testing.T) {
+	d := openMergeDatabase(t, t.TempDir(), kv.BytesAppend)
+	_ = d.SetRaw("log", []byte("a"))
+	_ = d.MergeRaw("log", []byte("b"))
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.MergeRaw("log", []byte("c"))
+	if v, ok, err := d.GetRaw("log"); !ok || err != nil || string(v) != "abc" {
+		t.Errorf("log = %q %v %v", v, ok, err)
+	}
+	var s string
+	if ok, err := d.Get("log", &s); !ok || err != nil || s != "abc" {
+		t.Errorf("log = %q %v %v", s, ok, err)
+	}
+}
+
+// mergeCounters 几个用合并操作数累加的计数器和它们的模型值. 写入在Merge返回之前就可能被读到,
+// 所以记录两个模型值: merging在写入之前加1, merged在写入之后加1
+type mergeCounters struct {
+	d       *Database
+	merging []int64
+	merged  []int64
+}
+
+func newMergeCounters(t *testing.T) *mergeCounters {
+	d := openMergeDatabase(t, t.TempDir(), kv.Int64Add)
+	return &mergeCounters{d: d, merging: make([]int64, 8), merged: make([]int64, 8)}
+}
+
+func (c *mergeCounters) key(i int) string {
+	return fmt.Sprintf("k%d", i)
+}
+
+// merge 给每个计数器加1
+func (c *mergeCounters) merge() error {
+	for i := range c.merged {
+		atomic.AddInt64(&c.merging[i], 1)
+		if err := Merge[int64](c.d, c.key(i), 1); err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.merged[i], 1)
+	}
+	return nil
+}
+
+// read 用Get和Scan读取所有计数器, 读到的值不能比读取前写完的次数小, 也不能比读取后开始写的次数大;
+// 合并操作数被算两次时会超过模型值
+func (c *mergeCounters) read() error {
+	low := make([]int64, len(c.merged))
+	for i := range c.merged {
+		low[i] = atomic.LoadInt64(&c.merged[i])
+		v, _, err := Get[int64](c.d, c.key(i))
+		if high := atomic.LoadInt64(&c.merging[i]); err != nil || v < low[i] || v > high {
+			return fmt.Errorf("get %s = %d %v, want between %d and %d", c.key(i), v, err, low[i], high)
+		}
+	}
+	for i := range c.merged {
+		low[i] = atomic.LoadInt64(&c.merged[i])
+	}
+	it := c.d.Scan("", "")
+	defer it.Close()
+	for i := 0; it.Next(); i++ {
+		var v int64
+		if err := it.Value(&v); err != nil || v < low[i] || v > atomic.LoadInt64(&c.merging[i]) {
+			return fmt.Errorf("scan %s = %d %v, want between %d and %d", it.Key(), v, err, low[i], atomic.LoadInt64(&c.merging[i]))
+		}
+	}
+	return it.Err()
+}
+
+// whileReading 执行fn期间, 几个goroutine不停地检查计数器
+func (c *mergeCounters) whileReading(t *testing.T, fn func() error) {
+	t.Helper()
+	var stop int32
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < cap(errs); r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				if err := c.read(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	err := fn()
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeWhileCompacting(t *testing.T) {
+	// 每次读写都会打日志, 几万次读取时日志占了大部分时间
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	c := newMergeCounters(t)
+	for round := 0; round < 500; round++ {
+		// level0的SSTable超过PartSize时压缩, 压缩期间读取不能同时看到新旧两份操作数
+		for i := 0; i < 3; i++ {
+			if err := c.merge(); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.whileReading(t, c.d.Compact)
+	}
+}
+
+func TestMergeWhileFlushing(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	c := newMergeCounters(t)
+	// 落盘期间读取不能同时在不可变内存表和新的SSTable中看到同一份操作数; 定期压缩, SSTable的数量不会一直增长
+	c.whileReading(t, func() error {
+		for round := 1; round <= 500; round++ {
+			if err := c.merge(); err != nil {
+				return err
+			}
+			if err := c.d.Flush(); err != nil {
+				return err
+			}
+			if round%3 == 0 {
+				if err := c.d.Compact(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -1,9 +1,9 @@
 package db
 
 import (
-	"encoding/json"
 	"github.com/ygzhang-yolo/lsmtree/kv"
 	"log"
+	"time"
 )
 
 /**
@@ -13,110 +13,417 @@ import (
  **/
 
 //
-// Get[T any]
-//  @Description: 数据查询过程Get
+// Get
+//  @Description: 数据查询过程Get, 查询到的值会反序列化到value指向的对象中
+//  @receiver d
 //  @param key
-//  @return T
+//  @param value	必须是一个指针
+//  @return bool	是否查询到
+//  @return error
+//
+func (d *Database) Get(key string, value any) (bool, error) {
+	data, ok, err := d.get(key, kv.MaxSeq)
+	if !ok || err != nil {
+		return false, err
+	}
+	return decodeValue(data, value)
+}
+
+//
+// GetRaw
+//  @Description: 查询key, 原样返回保存的字节, 不做反序列化
+//  @receiver d
+//  @param key
+//  @return []byte
 //  @return bool
+//  @return error
 //
-func Get[T any](key string) (T, bool) {
+func (d *Database) GetRaw(key string) ([]byte, bool, error) {
+	data, ok, err := d.get(key, kv.MaxSeq)
+	return data.Value, ok, err
+}
+
+//
+// get
+//  @Description: 查询key在序列号seq时的值, seq为MaxSeq时读取已经发布的最新值
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return bool
+//  @return error
+//
+func (d *Database) get(key string, seq uint64) (kv.Value, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.Value{}, false, kv.ErrClosed
+	}
 	log.Print("Get ", key)
-	// 1. 先查内存表, 查询成功直接返回
-	value, result := DB.MemoryTree.Get(key)
-	if result == kv.Success {
-		return getInstanceFromBytes[T](value.Value)
+	if seq != kv.MaxSeq {
+		return d.getAt(key, seq)
 	}
+	var (
+		data kv.Value
+		ok   bool
+		err  error
+	)
+	d.readLatest(func(seq uint64) {
+		data, ok, err = d.getAt(key, seq)
+	})
+	return data, ok, err
+}
 
-	// 2. 查SSTable文件
-	if DB.SSTableTree != nil {
-		value, result = DB.SSTableTree.Get(key)
-		if result == kv.Success {
-			return getInstanceFromBytes[T](value.Value)
+//
+// getAt
+//  @Description: 查询key在序列号seq时的值; 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return bool
+//  @return error
+//
+func (d *Database) getAt(key string, seq uint64) (kv.Value, bool, error) {
+	now := time.Now().UnixNano()
+	// 1. 先查活跃内存表和不可变内存表, 内存表中的版本(包括删除标记)比SSTable中的都新
+	data, result := d.memGetAt(key, seq)
+
+	// 2. 内存表中没有这个key, 查SSTable文件, 同样是找到的第一个版本为准
+	if result == kv.None && d.SSTableTree != nil {
+		var err error
+		data, result, err = d.SSTableTree.GetAt(key, seq)
+		if err != nil {
+			return kv.Value{}, false, err
+		}
+	}
+	// 3. 查到的版本被更新的范围删除标记遮住, 相当于已经删除
+	if result != kv.None {
+		if _, ok := d.covering(data, seq); ok {
+			return kv.Value{}, false, nil
+		}
+	}
+	// 4. 查到的是合并操作数, 和更旧的版本一起合并出值
+	if result == kv.MergeOperand {
+		var err error
+		if data, err = d.resolveMerge(key, seq); err != nil {
+			return kv.Value{}, false, err
+		}
+		result = kv.Success
+		if data.Deleted {
+			result = kv.Deleted
 		}
 	}
-	// 否则只能返回空
-	var nilValue T
-	return nilValue, false
+	// 已经过期的元素当作不存在
+	if result == kv.Success {
+		if data.Expired(now) {
+			return kv.Value{}, false, nil
+		}
+		return data, true, nil
+	}
+	// 否则是删除标记或者不存在, 只能返回空
+	return kv.Value{}, false, nil
 }
 
 //
-// Set[T any]
+// Set
 //  @Description: Set 插入元素
+//  @receiver d
 //  @param key
 //  @param value
-//  @return bool
+//  @return error
 //
-func Set[T any](key string, value T) bool {
+func (d *Database) Set(key string, value any) error {
+	return d.set(key, value, 0, d.codec())
+}
+
+//
+// SetRaw
+//  @Description: 原样保存value的字节, 不做序列化, 用GetRaw读取
+//  @receiver d
+//  @param key
+//  @param value
+//  @return error
+//
+func (d *Database) SetRaw(key string, value []byte) error {
+	return d.set(key, value, 0, kv.Raw)
+}
+
+//
+// SetWith
+//  @Description: 用指定的编码方式插入元素, 读取时会自动使用这个编码方式解码
+//  @receiver d
+//  @param key
+//  @param value
+//  @param codec
+//  @return error
+//
+func (d *Database) SetWith(key string, value any, codec kv.Codec) error {
+	return d.set(key, value, 0, codec)
+}
+
+//
+// SetWithTTL
+//  @Description: 插入一个在ttl之后过期的元素, 过期后读不到, 压缩时会清理掉它的数据
+//  @receiver d
+//  @param key
+//  @param value
+//  @param ttl
+//  @return error
+//
+func (d *Database) SetWithTTL(key string, value any, ttl time.Duration) error {
+	return d.set(key, value, time.Now().Add(ttl).UnixNano(), d.codec())
+}
+
+func (d *Database) set(key string, value any, expireAt int64, codec kv.Codec) error {
+	if err := d.throttle(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
 	log.Print("Insert ", key, ",")
-	data, err := kv.Convert(value) //将value序列化为二进制
-	if err != nil {
-		log.Println(err)
-		return false
+	data := kv.Value{
+		Key:      key,
+		Deleted:  false,
+		ExpireAt: expireAt,
+	}
+	if err := data.Encode(codec, value); err != nil { //将value序列化为二进制
+		return err
 	}
 
-	// 1.先写入database
-	_, _ = DB.MemoryTree.Set(key, data)
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, _, err := d.write(data)
+	return err
+}
 
-	// 2.再写入 wal.log
-	DB.Wal.Write(kv.Value{
-		Key:     key,
-		Value:   data,
-		Deleted: false,
-	})
-	return true
+//
+// Exists
+//  @Description: 判断key当前是否存在, 不读取和反序列化值; 删除和过期的key不存在
+//  @receiver d
+//  @param key
+//  @return bool
+//  @return error
+//
+func (d *Database) Exists(key string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false, kv.ErrClosed
+	}
+	_, result, err := d.current(key)
+	return result == kv.Success, err
 }
 
 //
-// DeleteAndGet[T any]
-//  @Description: // DeleteAndGet 删除元素并尝试获取旧的值， 返回的 bool 表示是否有旧值，不表示是否删除成功
+// DeleteAndGet
+//  @Description: DeleteAndGet 删除元素并尝试获取旧的值到value中, 旧值可能在内存表或者SSTable中;
+//  删除标记总是写入wal.log, 返回的 bool 表示是否删除了一个存在的旧值
+//  @receiver d
 //  @param key
-//  @return T
+//  @param value	必须是一个指针
 //  @return bool
+//  @return error
 //
-func DeleteAndGet[T any](key string) (T, bool) {
+func (d *Database) DeleteAndGet(key string, value any) (bool, error) {
+	if err := d.throttle(); err != nil {
+		return false, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false, kv.ErrClosed
+	}
 	log.Print("Delete ", key)
-	value, success := DB.MemoryTree.Delete(key)
-
-	if success {
-		// 写入 wal.log
-		DB.Wal.Write(kv.Value{
-			Key:     key,
-			Value:   nil,
-			Deleted: true,
-		})
-		return getInstanceFromBytes[T](value.Value)
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	// 在写锁中读取旧值, 读到的就是被这次删除覆盖的版本
+	old, result, err := d.current(key)
+	if err != nil {
+		return false, err
 	}
-	var nilV T
-	return nilV, false
+	if _, _, err = d.write(kv.Value{
+		Key:     key,
+		Value:   nil,
+		Deleted: true,
+	}); err != nil {
+		return false, err
+	}
+	if result != kv.Success {
+		return false, nil
+	}
+	return decodeValue(old, value)
 }
 
 //
-// Delete[T any]
+// Delete
 //  @Description: 单纯的Delete删除元素
+//  @receiver d
 //  @param key
+//  @return error
 //
-func Delete[T any](key string) {
+func (d *Database) Delete(key string) error {
+	if err := d.throttle(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
 	log.Print("Delete ", key)
-	DB.MemoryTree.Delete(key)
-	DB.Wal.Write(kv.Value{
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, _, err := d.write(kv.Value{
 		Key:     key,
 		Value:   nil,
 		Deleted: true,
 	})
+	return err
 }
 
 //
-// getInstanceFromBytes[T any]
-//  @Description: 将字节数组转为类型对象
-//  @param data
+// DeleteRaw
+//  @Description: 删除元素, 与Delete相同, 和GetRaw/SetRaw配套使用
+//  @receiver d
+//  @param key
+//  @return error
+//
+func (d *Database) DeleteRaw(key string) error {
+	return d.Delete(key)
+}
+
+//
+// GetBytes
+//  @Description: 以[]byte为key的GetRaw, key可以包含任意字节; 内部按string保存key, 这只是方便调用的封装, 每次调用都会复制一次key
+//  @receiver d
+//  @param key
+//  @return []byte
+//  @return bool
+//  @return error
+//
+func (d *Database) GetBytes(key []byte) ([]byte, bool, error) {
+	return d.GetRaw(string(key))
+}
+
+//
+// SetBytes
+//  @Description: 以[]byte为key的SetRaw; 和GetBytes一样会复制一次key, 调用后修改key不影响已经写入的数据
+//  @receiver d
+//  @param key
+//  @param value
+//  @return error
+//
+func (d *Database) SetBytes(key []byte, value []byte) error {
+	return d.SetRaw(string(key), value)
+}
+
+//
+// DeleteBytes
+//  @Description: 以[]byte为key的DeleteRaw; 和GetBytes一样会复制一次key
+//  @receiver d
+//  @param key
+//  @return error
+//
+func (d *Database) DeleteBytes(key []byte) error {
+	return d.DeleteRaw(string(key))
+}
+
+//=========================泛型的辅助函数, 对Database方法的封装=========================//
+
+//
+// Get[T any]
+//  @Description: 查询key, 并反序列化为类型T
+//  @param d
+//  @param key
 //  @return T
 //  @return bool
+//  @return error
 //
-func getInstanceFromBytes[T any](data []byte) (T, bool) {
+func Get[T any](d *Database, key string) (T, bool, error) {
 	var value T
-	err := json.Unmarshal(data, &value)
-	if err != nil {
-		log.Println(err)
+	ok, err := d.Get(key, &value)
+	return value, ok, err
+}
+
+//
+// Set[T any]
+//  @Description: 插入类型为T的元素
+//  @param d
+//  @param key
+//  @param value
+//  @return error
+//
+func Set[T any](d *Database, key string, value T) error {
+	return d.Set(key, value)
+}
+
+//
+// SetWith[T any]
+//  @Description: 用指定的编码方式插入类型为T的元素
+//  @param d
+//  @param key
+//  @param value
+//  @param codec
+//  @return error
+//
+func SetWith[T any](d *Database, key string, value T, codec kv.Codec) error {
+	return d.SetWith(key, value, codec)
+}
+
+//
+// SetWithTTL[T any]
+//  @Description: 插入类型为T, 在ttl之后过期的元素
+//  @param d
+//  @param key
+//  @param value
+//  @param ttl
+//  @return error
+//
+func SetWithTTL[T any](d *Database, key string, value T, ttl time.Duration) error {
+	return d.SetWithTTL(key, value, ttl)
+}
+
+//
+// DeleteAndGet[T any]
+//  @Description: 删除元素并返回类型为T的旧值
+//  @param d
+//  @param key
+//  @return T
+//  @return bool
+//  @return error
+//
+func DeleteAndGet[T any](d *Database, key string) (T, bool, error) {
+	var value T
+	ok, err := d.DeleteAndGet(key, &value)
+	return value, ok, err
+}
+
+//
+// Delete
+//  @Description: 删除元素
+//  @param d
+//  @param key
+//  @return error
+//
+func Delete(d *Database, key string) error {
+	return d.Delete(key)
+}
+
+//
+// decodeValue
+//  @Description: 用data写入时的编码方式, 将data的值反序列化到value指向的对象
+//  @param data
+//  @param value
+//  @return bool
+//  @return error
+//
+func decodeValue(data kv.Value, value any) (bool, error) {
+	if err := data.Decode(value); err != nil {
+		return false, err
 	}
-	return value, true
+	return true, nil
 }
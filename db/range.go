@@ -0,0 +1,81 @@
+package db
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:44
+ * @Func: 范围删除, 一条范围删除标记删除一个范围内的所有key
+ **/
+
+//
+// DeleteRange
+//  @Description: 删除key在[start, end)内的所有元素, end为空表示没有上界; 只写入一条范围删除标记,
+//  读取时被它遮住的旧版本不可见, 压缩时清理掉它们的数据, 标记到了最深的层后也会被清理
+//  @receiver d
+//  @param start
+//  @param end
+//  @return error
+//
+func (d *Database) DeleteRange(start string, end string) error {
+	if end != "" && kv.CompareKeys(d.cfg.GetComparator(), start, end) >= 0 {
+		return fmt.Errorf("lsm: invalid range [%q, %q)", start, end)
+	}
+	if err := d.throttle(); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
+	log.Printf("Delete range [%q, %q)", start, end)
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_, _, err := d.write(kv.RangeTombstone{Start: start, End: end}.Value())
+	return err
+}
+
+//
+// rangesAt
+//  @Description: 返回内存表和SSTable中对序列号seq可见的范围删除标记; 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param seq
+//  @return []kv.RangeTombstone
+//
+func (d *Database) rangesAt(seq uint64) []kv.RangeTombstone {
+	return append(d.memRangesAt(seq), d.SSTableTree.RangesAt(seq)...)
+}
+
+//
+// covering
+//  @Description: 返回在序列号seq时遮住value的最新的范围删除标记; 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param value
+//  @param seq
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (d *Database) covering(value kv.Value, seq uint64) (kv.RangeTombstone, bool) {
+	// 内存表中的标记总是比SSTable中的新
+	if r, ok := d.memCovering(value.Key, value.Seq, seq); ok {
+		return r, true
+	}
+	return d.SSTableTree.Covering(value.Key, value.Seq, seq)
+}
+
+//
+// DeleteRange
+//  @Description: 范围删除, 对Database.DeleteRange的封装
+//  @param d
+//  @param start
+//  @param end
+//  @return error
+//
+func DeleteRange(d *Database, start string, end string) error {
+	return d.DeleteRange(start, end)
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:44
+ * @Func:
+ **/
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{DataDir: dir, Level0Size: 1, PartSize: 2, Threshold: 100}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	flush := func() {
+		t.Helper()
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen := func() {
+		t.Helper()
+		_ = d.Close()
+		if d, err = NewDatabase(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range map[string]int{"t1/a": 0, "t1/b": 4, "t1/c": 0, "t2/a": 5} {
+			v, ok, err := Get[int](d, key)
+			if err != nil || ok != (want != 0) || v != want {
+				t.Errorf("%s: %s = %d %v %v, want %d", stage, key, v, ok, err, want)
+			}
+		}
+		keys, values := scanKeys(t, d.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"t1/b", "t2/a"}) || !reflect.DeepEqual(values, []int{4, 5}) {
+			t.Errorf("%s: scan %v %v", stage, keys, values)
+		}
+	}
+
+	// t1/a和t1/b在SSTable中, t1/c在内存表中
+	_ = Set[int](d, "t1/a", 1)
+	_ = Set[int](d, "t1/b", 2)
+	_ = Set[int](d, "t2/a", 5)
+	flush()
+	_ = Set[int](d, "t1/c", 3)
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.DeleteRange("t1/", "t2/"); err != nil {
+		t.Fatal(err)
+	}
+	// 范围删除之后的写入不受影响
+	_ = Set[int](d, "t1/b", 4)
+	check("delete range")
+	if ok, err := d.Exists("t1/a"); ok || err != nil {
+		t.Errorf("t1/a should not exist: %v", err)
+	}
+	// 快照看不到范围删除标记
+	keys, _ := scanKeys(t, snap.Scan("", ""))
+	if !reflect.DeepEqual(keys, []string{"t1/a", "t1/b", "t1/c", "t2/a"}) {
+		t.Errorf("snapshot: scan %v", keys)
+	}
+	snap.Release()
+
+	// 从wal.log恢复范围删除标记
+	reopen()
+	check("replay wal")
+	// 范围删除标记落盘到SSTable
+	flush()
+	check("flush")
+	reopen()
+	check("reopen")
+
+	// 压缩到最深层之后, 被遮住的数据和范围删除标记都被清理掉
+	for i := 0; i < 6; i++ {
+		_ = Set[int](d, "t2/a", 5)
+		flush()
+		if err = d.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("compact")
+	if ranges := d.SSTableTree.RangesAt(kv.MaxSeq); len(ranges) != 0 {
+		t.Errorf("range tombstones should be dropped at the bottom level: %+v", ranges)
+	}
+	for _, key := range []string{"t1/a", "t1/c"} {
+		if chain, err := d.SSTableTree.GetChainAt(key, kv.MaxSeq); err != nil || len(chain) != 0 {
+			t.Errorf("data of %s should be dropped: %+v %v", key, chain, err)
+		}
+	}
+
+	if err = d.DeleteRange("b", "a"); err == nil {
+		t.Error("DeleteRange with start >= end should fail")
+	}
+}
+
+func TestDeleteRangeMerge(t *testing.T) {
+	d := openMergeDatabase(t, t.TempDir(), kv.Int64Add)
+	_ = Set[int](d, "counter", 10)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Merge[int](d, "counter", 1)
+	_ = d.DeleteRange("c", "d")
+	// 被遮住的旧值和操作数都不参与合并
+	_ = Merge[int](d, "counter", 2)
+	if v, ok, err := Get[int](d, "counter"); !ok || err != nil || v != 2 {
+		t.Errorf("counter = %d %v %v, want 2", v, ok, err)
+	}
+}
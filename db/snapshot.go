@@ -0,0 +1,174 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:14
+ * @Func: 快照, 固定一个序列号, 读到的数据不受之后写入的影响
+ **/
+
+const readRetries = 3 // 不注册快照的读取最多尝试的次数
+
+//
+//  Snapshot
+//  @Description: 数据库在某一时刻的一致性视图, 只能看到序列号不大于seq的写入;
+//  快照存活期间, 落盘和压缩都会保留它能看到的旧版本, 用完需要Release
+//
+type Snapshot struct {
+	d    *Database
+	seq  uint64
+	once sync.Once
+}
+
+//
+// Snapshot
+//  @Description: 创建一个当前时刻的快照
+//  @receiver d
+//  @return *Snapshot
+//  @return error
+//
+func (d *Database) Snapshot() (*Snapshot, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return nil, kv.ErrClosed
+	}
+	return d.pin(), nil
+}
+
+//
+// pin
+//  @Description: 注册一个当前时刻的快照, 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @return *Snapshot
+//
+func (d *Database) pin() *Snapshot {
+	// 持有写锁, 保证注册之后的写入都能看到这个快照
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	seq := atomic.LoadUint64(&d.seq)
+	d.snapMu.Lock()
+	d.snapshots[seq]++
+	d.snapMu.Unlock()
+	return &Snapshot{d: d, seq: seq}
+}
+
+//
+// readLatest
+//  @Description: 在已经发布的序列号上执行read. 不注册快照时, 读取期间又发布了新的写入, 旧序列号要看的版本可能已经被
+//  之后的写入, 落盘或者压缩去掉, 用新的序列号重新读; 写入一直很频繁, 重试几次都没有成功时注册一个快照再读,
+//  快照要看的版本不会被去掉. 调用方持有d.writeMu时序列号不会变化, 第一次就会成功, 不会再去获取d.writeMu
+//  @receiver d
+//  @param read
+//
+func (d *Database) readLatest(read func(seq uint64)) {
+	for i := 0; i < readRetries; i++ {
+		seq := atomic.LoadUint64(&d.seq)
+		read(seq)
+		if atomic.LoadUint64(&d.seq) == seq {
+			return
+		}
+	}
+	snapshot := d.pin()
+	defer snapshot.Release()
+	read(snapshot.seq)
+}
+
+//
+// Seq
+//  @Description: 快照的序列号
+//  @receiver s
+//  @return uint64
+//
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+//
+// Get
+//  @Description: 查询key在快照时刻的值
+//  @receiver s
+//  @param key
+//  @param value	必须是一个指针
+//  @return bool
+//  @return error
+//
+func (s *Snapshot) Get(key string, value any) (bool, error) {
+	data, ok, err := s.d.get(key, s.seq)
+	if !ok || err != nil {
+		return false, err
+	}
+	return decodeValue(data, value)
+}
+
+//
+// GetRaw
+//  @Description: 查询key在快照时刻的值, 原样返回保存的字节
+//  @receiver s
+//  @param key
+//  @return []byte
+//  @return bool
+//  @return error
+//
+func (s *Snapshot) GetRaw(key string) ([]byte, bool, error) {
+	data, ok, err := s.d.get(key, s.seq)
+	return data.Value, ok, err
+}
+
+//
+// Scan
+//  @Description: 查询key在[start, end)范围内, 快照时刻的元素
+//  @receiver s
+//  @param start
+//  @param end
+//  @return *Iterator
+//
+func (s *Snapshot) Scan(start string, end string) *Iterator {
+	return s.d.scan(start, end, s.seq)
+}
+
+//
+// ScanPrefix
+//  @Description: 查询快照时刻所有以prefix为前缀的元素
+//  @receiver s
+//  @param prefix
+//  @return *Iterator
+//
+func (s *Snapshot) ScanPrefix(prefix string) *Iterator {
+	return s.d.scanPrefix(prefix, s.seq)
+}
+
+//
+// Release
+//  @Description: 释放快照, 之后的落盘和压缩不再为它保留旧版本; 重复调用是安全的
+//  @receiver s
+//
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		s.d.snapMu.Lock()
+		defer s.d.snapMu.Unlock()
+		if s.d.snapshots[s.seq]--; s.d.snapshots[s.seq] <= 0 {
+			delete(s.d.snapshots, s.seq)
+		}
+	})
+}
+
+//
+// GetAt[T any]
+//  @Description: 在快照s中查询key, 并反序列化为类型T
+//  @param s
+//  @param key
+//  @return T
+//  @return bool
+//  @return error
+//
+func GetAt[T any](s *Snapshot, key string) (T, bool, error) {
+	var value T
+	ok, err := s.Get(key, &value)
+	return value, ok, err
+}
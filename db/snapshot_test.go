@@ -0,0 +1,139 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/bst"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:14
+ * @Func:
+ **/
+
+func TestSnapshot(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "a", 1)
+	_ = Set[int](d, "b", 2)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](d, "c", 3)
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	// 快照之后的覆盖, 删除和新增都不影响快照
+	_ = Set[int](d, "a", 10)
+	_ = Delete(d, "b")
+	_ = Delete(d, "c")
+	_ = Set[int](d, "d", 4)
+	check := func(stage string) {
+		for key, want := range map[string]int{"a": 1, "b": 2, "c": 3} {
+			if v, ok, err := GetAt[int](snap, key); err != nil || !ok || v != want {
+				t.Errorf("%s: snapshot get %s = %v %v %v, want %d", stage, key, v, ok, err, want)
+			}
+		}
+		if _, ok, _ := GetAt[int](snap, "d"); ok {
+			t.Errorf("%s: snapshot should not see d", stage)
+		}
+		keys, values := scanKeys(t, snap.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) || !reflect.DeepEqual(values, []int{1, 2, 3}) {
+			t.Errorf("%s: snapshot scan %v %v", stage, keys, values)
+		}
+		keys, values = scanKeys(t, d.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"a", "d"}) || !reflect.DeepEqual(values, []int{10, 4}) {
+			t.Errorf("%s: scan %v %v", stage, keys, values)
+		}
+	}
+	check("memory")
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("flush")
+	_ = Set[int](d, "d", 4)
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.SSTableTree.GetTableNums(0); n != 0 {
+		t.Fatalf("level 0 should be compacted, but has %d tables", n)
+	}
+	check("compact")
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "a", 1)
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = Set[int](d, "a", 2)
+	snap.Release()
+	snap.Release()
+	if seqs := d.snapshotSeqs(); len(seqs) != 0 {
+		t.Fatal(seqs)
+	}
+	// 快照释放后落盘只保留最新版本
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := Get[int](d, "a"); err != nil || !ok || v != 2 {
+		t.Fatal(v, ok, err)
+	}
+	if _, _, err = d.SSTableTree.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentOverwrite(t *testing.T) {
+	// 每次读写都会打日志, 几十万次操作时日志占了大部分时间
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, memTable := range []func(cmp kv.Comparator) kv.MemTable{nil, bst.New} {
+		d, err := NewDatabase(config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 1 << 20, MemTable: memTable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = Set[int](d, "k", 0)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = Set[int](d, "k", i)
+			}
+		}()
+		// 覆盖写入的新序列号发布之前, 读取仍然能看到旧版本, k始终存在
+		misses := 0
+		for i := 0; i < 200000; i++ {
+			if _, ok, err := Get[int](d, "k"); !ok || err != nil {
+				misses++
+			}
+		}
+		close(stop)
+		wg.Wait()
+		if misses > 0 {
+			t.Errorf("%d reads missed k", misses)
+		}
+		_ = d.Close()
+	}
+}
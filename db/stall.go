@@ -0,0 +1,240 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 10:04
+ * @Func: 写入限流, 落盘和压缩跟不上写入时让写入减速或者阻塞
+ **/
+
+const (
+	slowdownDelay = time.Millisecond       // 减速时每次写入的延迟
+	stallRecheck  = 100 * time.Millisecond // 阻塞时没有收到进展通知也定期重新检查
+)
+
+type stallKind int
+
+const (
+	stallNone stallKind = iota
+	stallSlowdown
+	stallStop
+)
+
+//
+//  stallStats
+//  @Description: 写入限流的累计统计, 整个数据库共享
+//
+type stallStats struct {
+	slowdowns     uint64
+	slowdownNanos int64
+	stops         uint64
+	stopNanos     int64
+}
+
+//
+//  Stats
+//  @Description: 数据库(或者列族)的运行状态; 内存表和SSTable的状态属于这个列族, 限流的统计是整个数据库的
+//
+type Stats struct {
+	Immutables             int           // 等待落盘的不可变内存表数量
+	Level0Tables           int           // level 0的SSTable数量
+	PendingCompactionBytes int64         // 超出阈值等待压缩的层的总字节数
+	SlowdownWrites         uint64        // 被减速的写入次数
+	SlowdownTime           time.Duration // 减速累计的时间
+	StoppedWrites          uint64        // 被阻塞的写入次数
+	StopTime               time.Duration // 阻塞累计的时间
+}
+
+//
+// Stats
+//  @Description: 返回当前的运行状态和写入限流的统计
+//  @receiver d
+//  @return Stats
+//
+func (d *Database) Stats() Stats {
+	level0, pending := d.SSTableTree.CompactionPressure()
+	return Stats{
+		Immutables:             d.Immutables(),
+		Level0Tables:           level0,
+		PendingCompactionBytes: pending,
+		SlowdownWrites:         atomic.LoadUint64(&d.stalls.slowdowns),
+		SlowdownTime:           time.Duration(atomic.LoadInt64(&d.stalls.slowdownNanos)),
+		StoppedWrites:          atomic.LoadUint64(&d.stalls.stops),
+		StopTime:               time.Duration(atomic.LoadInt64(&d.stalls.stopNanos)),
+	}
+}
+
+//
+// FlushRequests
+//  @Description: 内存表写满切换出去之后会在这个channel上通知, 后台协程收到后应尽快落盘和压缩
+//  @receiver d
+//  @return <-chan struct{}
+//
+func (d *Database) FlushRequests() <-chan struct{} {
+	return d.flushCh
+}
+
+//
+// requestFlush
+//  @Description: 通知后台协程落盘, 已经有未处理的通知时不重复发送
+//  @receiver d
+//
+func (d *Database) requestFlush() {
+	select {
+	case d.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+//
+// MemTableFull
+//  @Description: 内存表估算的字节数超过WriteBufferSize, 或者配置了Threshold且条目数量(包括删除标记)超过它时, 内存表需要落盘
+//  @receiver d
+//  @return bool
+//
+func (d *Database) MemTableFull() bool {
+	if d.MemoryTree.ApproximateSize() >= d.cfg.GetWriteBufferSize() {
+		return true
+	}
+	return d.cfg.Threshold > 0 && d.MemoryTree.Entries() >= d.cfg.Threshold
+}
+
+//
+// maybeRotate
+//  @Description: 内存表写满时切换为不可变内存表并通知后台协程落盘; 切换失败时继续写入活跃内存表. 调用方需要持有d.writeMu
+//  @receiver d
+//
+func (d *Database) maybeRotate() {
+	if !d.MemTableFull() {
+		return
+	}
+	if err := d.rotate(); err != nil {
+		log.Println("Failed to rotate the memtable: ", err)
+		return
+	}
+	d.requestFlush()
+}
+
+//
+// notifyProgress
+//  @Description: 落盘或压缩之后唤醒被阻塞的写入, 让它们重新检查
+//  @receiver d
+//
+func (d *Database) notifyProgress() {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	close(d.progress)
+	d.progress = make(chan struct{})
+}
+
+//
+// progressCh
+//  @Description: 返回下一次进展时会被close的channel
+//  @receiver d
+//  @return <-chan struct{}
+//
+func (d *Database) progressCh() <-chan struct{} {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	return d.progress
+}
+
+//
+// stallState
+//  @Description: 按配置的触发条件判断写入是否需要减速或者阻塞
+//  @receiver d
+//  @return stallKind
+//
+func (d *Database) stallState() stallKind {
+	cfg := d.cfg
+	if cfg.MaxImmutables > 0 && d.Immutables() >= cfg.MaxImmutables {
+		return stallStop
+	}
+	// 没有配置SSTable相关的条件时不用统计
+	if cfg.Level0SlowdownTrigger <= 0 && cfg.Level0StopTrigger <= 0 && cfg.PendingCompactionSlowdown <= 0 && cfg.PendingCompactionStop <= 0 {
+		return stallNone
+	}
+	level0, pending := d.SSTableTree.CompactionPressure()
+	switch {
+	case cfg.Level0StopTrigger > 0 && level0 >= cfg.Level0StopTrigger,
+		cfg.PendingCompactionStop > 0 && pending >= cfg.PendingCompactionStop:
+		return stallStop
+	case cfg.Level0SlowdownTrigger > 0 && level0 >= cfg.Level0SlowdownTrigger,
+		cfg.PendingCompactionSlowdown > 0 && pending >= cfg.PendingCompactionSlowdown:
+		return stallSlowdown
+	}
+	return stallNone
+}
+
+//
+// throttle
+//  @Description: 写入之前调用: 需要阻塞时通知后台协程并等待落盘和压缩追上, 需要减速时延迟一次;
+//  数据库关闭时返回ErrClosed. 不能持有任何锁, 否则后台的落盘和Close都可能被挡住
+//  @receiver d
+//  @return error
+//
+func (d *Database) throttle() error {
+	switch d.stallState() {
+	case stallNone:
+		return nil
+	case stallSlowdown:
+		start := time.Now()
+		time.Sleep(slowdownDelay)
+		atomic.AddUint64(&d.stalls.slowdowns, 1)
+		atomic.AddInt64(&d.stalls.slowdownNanos, int64(time.Since(start)))
+		return nil
+	}
+	log.Println("Writes stopped, waiting for flush and compaction")
+	start := time.Now()
+	defer func() {
+		atomic.AddUint64(&d.stalls.stops, 1)
+		atomic.AddInt64(&d.stalls.stopNanos, int64(time.Since(start)))
+	}()
+	timer := time.NewTimer(stallRecheck)
+	defer timer.Stop()
+	for {
+		// 先取channel再检查, 检查之后的进展不会漏掉; 阻塞过的写入不再减速
+		progress := d.progressCh()
+		if d.stallState() != stallStop {
+			return nil
+		}
+		d.requestFlush()
+		select {
+		case <-progress:
+		case <-d.stop:
+			return kv.ErrClosed
+		case <-timer.C:
+			timer.Reset(stallRecheck)
+		}
+	}
+}
+
+//
+// throttleBatch
+//  @Description: 批量写入之前对涉及的每个列族调用throttle
+//  @receiver d
+//  @param values
+//  @return error
+//
+func (d *Database) throttleBatch(values []kv.Value) error {
+	families := make(map[*Database]bool)
+	d.familyMu.RLock()
+	for _, value := range values {
+		if fam, ok := d.families[familyOf(value)]; ok {
+			families[fam] = true
+		}
+	}
+	d.familyMu.RUnlock()
+	for fam := range families {
+		if err := fam.throttle(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
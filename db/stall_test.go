@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 10:04
+ * @Func:
+ **/
+
+func TestStallImmutables(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 2, Threshold: 10, MaxImmutables: 1}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	// 落盘比写入慢, 写满一个内存表之后的写入要等它落盘
+	d.Background(func(stop <-chan struct{}) {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-d.FlushRequests():
+				time.Sleep(20 * time.Millisecond)
+				if err := d.Flush(); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	})
+	for i := 0; i < 30; i++ {
+		if err = Set[int](d, fmt.Sprintf("k%02d", i), i); err != nil {
+			t.Fatal(err)
+		}
+		if n := d.Immutables(); n > 1 {
+			t.Fatal("immutables", n)
+		}
+	}
+	stats := d.Stats()
+	if stats.StoppedWrites == 0 || stats.StopTime < 10*time.Millisecond {
+		t.Errorf("stats %+v", stats)
+	}
+	for i := 0; i < 30; i++ {
+		if v, ok, err := Get[int](d, fmt.Sprintf("k%02d", i)); !ok || err != nil || v != i {
+			t.Errorf("k%02d = %d %v %v", i, v, ok, err)
+		}
+	}
+}
+
+func TestStallLevel0(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, PartSize: 10, Threshold: 100,
+		Level0SlowdownTrigger: 2, Level0StopTrigger: 3}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			// level 0有两个SSTable, 写入减速
+			if stats := d.Stats(); stats.Level0Tables != 2 {
+				t.Fatalf("stats %+v", stats)
+			}
+		}
+		_ = Set[int](d, "a", i)
+		if err = d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := d.Stats(); stats.SlowdownWrites != 1 || stats.SlowdownTime < time.Millisecond {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// 三个SSTable时写入阻塞, 没有后台压缩, 直到关闭数据库
+	done := make(chan error, 1)
+	go func() {
+		done <- Set[int](d, "b", 1)
+	}()
+	select {
+	case err = <-done:
+		t.Fatal("write not stopped", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_ = d.Close()
+	if err = <-done; !errors.Is(err, kv.ErrClosed) {
+		t.Error("stopped write after close", err)
+	}
+}
+
+func TestStallLastLevel(t *testing.T) {
+	cfg := config.Config{DataDir: t.TempDir(), Level0Size: 1, Threshold: 100, PendingCompactionStop: 1}
+	d, err := NewDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	// PartSize为0时不按数量压缩; 数据压缩到最底层之后, 压缩不能让它变小, 不算作等待压缩
+	_ = Set[int](d, "a", 1)
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := d.Stats(); stats.PendingCompactionBytes != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Set[int](d, "b", 2)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write stopped")
+	}
+}
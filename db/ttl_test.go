@@ -0,0 +1,65 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:17
+ * @Func:
+ **/
+
+func TestTTL(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "session:a", 1)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 覆盖落盘的旧值, 过期后旧值也不能重新可见
+	_ = SetWithTTL[int](d, "session:a", 10, 50*time.Millisecond)
+	_ = SetWithTTL[int](d, "session:b", 2, 50*time.Millisecond)
+	_ = SetWithTTL[int](d, "session:c", 3, time.Hour)
+	if v, ok, _ := Get[int](d, "session:a"); !ok || v != 10 {
+		t.Fatal(v, ok)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_ = SetWithTTL[int](d, "session:d", 4, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	check := func(stage string) {
+		for _, key := range []string{"session:a", "session:b", "session:d"} {
+			if _, ok, _ := Get[int](d, key); ok {
+				t.Errorf("%s: the key %s should be expired", stage, key)
+			}
+		}
+		keys, _ := scanKeys(t, d.Scan("", ""))
+		if !reflect.DeepEqual(keys, []string{"session:c"}) {
+			t.Errorf("%s: scan %v", stage, keys)
+		}
+	}
+	check("memory")
+	if ok, _ := SetIfAbsent[int](d, "session:b", 20); !ok {
+		t.Error("SetIfAbsent on an expired key")
+	}
+	_ = Delete(d, "session:b")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("compact")
+	// 压缩后过期元素的数据被清理, 最深层不需要的删除标记也一起清理
+	for _, key := range []string{"session:a", "session:d"} {
+		value, result, err := d.SSTableTree.Get(key)
+		if err != nil || (result != kv.None && (!value.Deleted || value.Value != nil)) {
+			t.Errorf("the data of %s should be dropped by compaction, got %+v %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"log"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:15
+ * @Func: 乐观事务, 提交时检查读过的key是否被其他写入修改
+ **/
+
+//
+//  Txn
+//  @Description: 乐观事务: 读操作基于事务开始时的快照, 写操作缓存在事务中, 事务内的读可以看到自己的写;
+//  Commit时如果读过的key在事务开始后被其他写入修改过, 返回ErrConflict, 否则原子地写入所有缓存的写操作
+//
+type Txn struct {
+	d       *Database
+	snap    *Snapshot
+	writes  *WriteBatch         // 按顺序缓存的写操作
+	pending map[string]kv.Value // 每个key最后一次缓存的写操作, 用于读自己的写
+	reads   map[string]struct{} // 读过的key
+	done    bool
+}
+
+//
+// Begin
+//  @Description: 开始一个事务, 用完需要Commit或者Rollback
+//  @receiver d
+//  @return *Txn
+//  @return error
+//
+func (d *Database) Begin() (*Txn, error) {
+	snap, err := d.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		d:       d,
+		snap:    snap,
+		writes:  d.NewWriteBatch(),
+		pending: make(map[string]kv.Value),
+		reads:   make(map[string]struct{}),
+	}, nil
+}
+
+//
+// Get
+//  @Description: 查询key, 先查事务中缓存的写操作, 再查事务开始时的快照; 查询过的key会在Commit时检查冲突
+//  @receiver t
+//  @param key
+//  @param value	必须是一个指针
+//  @return bool
+//  @return error
+//
+func (t *Txn) Get(key string, value any) (bool, error) {
+	if t.done {
+		return false, kv.ErrTxnDone
+	}
+	if data, ok := t.pending[key]; ok {
+		if data.Deleted {
+			return false, nil
+		}
+		return decodeValue(data, value)
+	}
+	t.reads[key] = struct{}{}
+	return t.snap.Get(key, value)
+}
+
+//
+// Set
+//  @Description: 在事务中插入元素, Commit之前其他读操作看不到
+//  @receiver t
+//  @param key
+//  @param value
+//  @return error
+//
+func (t *Txn) Set(key string, value any) error {
+	if t.done {
+		return kv.ErrTxnDone
+	}
+	if err := t.writes.Put(key, value); err != nil {
+		return err
+	}
+	t.pending[key] = t.writes.values[t.writes.Len()-1]
+	return nil
+}
+
+//
+// Delete
+//  @Description: 在事务中删除元素
+//  @receiver t
+//  @param key
+//  @return error
+//
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return kv.ErrTxnDone
+	}
+	t.writes.Delete(key)
+	t.pending[key] = t.writes.values[t.writes.Len()-1]
+	return nil
+}
+
+//
+// Commit
+//  @Description: 提交事务: 读过的key在事务开始后被修改过则返回ErrConflict, 否则原子地写入所有缓存的写操作;
+//  无论成功与否事务都会结束
+//  @receiver t
+//  @return error
+//
+func (t *Txn) Commit() error {
+	if t.done {
+		return kv.ErrTxnDone
+	}
+	defer t.Rollback()
+	d := t.d
+	if err := d.throttleBatch(t.writes.values); err != nil {
+		return err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return kv.ErrClosed
+	}
+	log.Print("Commit transaction of ", t.writes.Len())
+
+	// 持有写锁, 检查冲突和写入之间不会有其他写入
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	for key := range t.reads {
+		seq, err := d.latestSeq(key)
+		if err != nil {
+			return err
+		}
+		if seq > t.snap.Seq() {
+			return kv.ErrConflict
+		}
+	}
+	if t.writes.Len() == 0 {
+		return nil
+	}
+	return d.writeBatch(t.writes.values)
+}
+
+//
+// Rollback
+//  @Description: 放弃事务中缓存的写操作并结束事务, 重复调用是安全的
+//  @receiver t
+//
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.snap.Release()
+	t.writes.Clear()
+	t.pending = nil
+	t.reads = nil
+}
+
+//
+// latestSeq
+//  @Description: 返回最后一次写入key(包括删除)的序列号, 没有写入过返回0; 调用方需要持有d.mu的读锁
+//  @receiver d
+//  @param key
+//  @return uint64
+//  @return error
+//
+func (d *Database) latestSeq(key string) (uint64, error) {
+	value, _, err := d.current(key)
+	if err != nil {
+		return 0, err
+	}
+	return value.Seq, nil
+}
+
+//
+// GetIn[T any]
+//  @Description: 在事务t中查询key, 并反序列化为类型T
+//  @param t
+//  @param key
+//  @return T
+//  @return bool
+//  @return error
+//
+func GetIn[T any](t *Txn, key string) (T, bool, error) {
+	var value T
+	ok, err := t.Get(key, &value)
+	return value, ok, err
+}
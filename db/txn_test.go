@@ -0,0 +1,92 @@
+package db
+
+import (
+	"errors"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:15
+ * @Func:
+ **/
+
+func TestTxn(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "balance:a", 100)
+	_ = Set[int](d, "balance:b", 0)
+
+	txn, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _, _ := GetIn[int](txn, "balance:a")
+	b, _, _ := GetIn[int](txn, "balance:b")
+	_ = txn.Set("balance:a", a-30)
+	_ = txn.Set("balance:b", b+30)
+	// 事务内可以读到自己的写, 提交前其他读操作看不到
+	if v, _, _ := GetIn[int](txn, "balance:a"); v != 70 {
+		t.Error(v)
+	}
+	if v, _, _ := Get[int](d, "balance:a"); v != 100 {
+		t.Error(v)
+	}
+	if err = txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(); !errors.Is(err, kv.ErrTxnDone) {
+		t.Error(err)
+	}
+	if v, _, _ := Get[int](d, "balance:b"); v != 30 {
+		t.Error(v)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	d := openTestDatabase(t)
+	_ = Set[int](d, "a", 1)
+	_ = Set[int](d, "b", 2)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := d.Begin()
+	_, _, _ = GetIn[int](txn, "a")
+	_ = txn.Delete("b")
+	// 读过的key被其他写入修改, 即使已经落盘也能发现冲突
+	_ = Set[int](d, "a", 10)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("got %v, want ErrConflict", err)
+	}
+	if _, ok, _ := Get[int](d, "b"); !ok {
+		t.Error("the key 'b' should not be deleted by a conflicting transaction")
+	}
+
+	// 只写没读过的key不冲突
+	txn, _ = d.Begin()
+	_ = txn.Set("c", 3)
+	_ = Delete(d, "c")
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := Get[int](d, "c"); !ok || v != 3 {
+		t.Error(v, ok)
+	}
+
+	// 读一个不存在的key, 之后被其他写入创建, 也算冲突
+	txn, _ = d.Begin()
+	_, _, _ = GetIn[int](txn, "d")
+	_ = txn.Set("e", 5)
+	_ = Set[int](d, "d", 4)
+	if err := txn.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("got %v, want ErrConflict", err)
+	}
+	txn.Rollback()
+	if seqs := d.snapshotSeqs(); len(seqs) != 0 {
+		t.Error("transactions should release their snapshots", seqs)
+	}
+}
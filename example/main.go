@@ -5,7 +5,6 @@ import (
 	"fmt"
 	lsm "github.com/ygzhang-yolo/lsmtree"
 	"github.com/ygzhang-yolo/lsmtree/config"
-	db "github.com/ygzhang-yolo/lsmtree/db"
 	"math/rand"
 	"os"
 	"strconv"
@@ -25,6 +24,14 @@ type TestValue struct {
 	D string
 }
 
+var cfg = config.Config{
+	DataDir:       `D:\study\杂项\lsmData`,
+	Level0Size:    100,
+	PartSize:      4,
+	Threshold:     10000,
+	CheckInterval: 3,
+}
+
 func main() {
 	defer func() {
 		r := recover()
@@ -34,15 +41,9 @@ func main() {
 			_, _ = inputReader.ReadString('\n')
 		}
 	}()
-	lsm.Start(config.Config{
-		DataDir:       `D:\study\杂项\lsmData`,
-		Level0Size:    100,
-		PartSize:      4,
-		Threshold:     10000,
-		CheckInterval: 3,
-	})
-
-	fmt.Println(db.DB)
+	if err := lsm.Start(cfg); err != nil {
+		panic(err)
+	}
 
 	//---------------some tests---------------------//
 	//basicGetAndSet()
@@ -62,7 +63,7 @@ func basicGetAndSet() {
 	fmt.Println("-------------------Test BasicGetAndSet()--------------------")
 	// 先query aaa
 	start := time.Now()
-	v, _ := lsm.Get[TestValue]("aaa")
+	v, _, _ := lsm.Get[TestValue]("aaa")
 	elapse := time.Since(start)
 	fmt.Println("查找 aaaaaa 完成，消耗时间：", elapse)
 	fmt.Println(v)
@@ -77,7 +78,7 @@ func basicGetAndSet() {
 
 	// 再query
 	start = time.Now()
-	v, _ = lsm.Get[TestValue]("aaa")
+	v, _, _ = lsm.Get[TestValue]("aaa")
 	elapse = time.Since(start)
 	fmt.Println("查找 aaaaaa 完成，消耗时间：", elapse)
 	fmt.Println(v)
@@ -87,7 +88,7 @@ func crashWithWal() {
 	fmt.Println("-------------------Test CrashWithWal()--------------------")
 	// 直接query aaa, 内存表会根据wal.log重建
 	start := time.Now()
-	v, _ := lsm.Get[TestValue]("aaa")
+	v, _, _ := lsm.Get[TestValue]("aaa")
 	elapse := time.Since(start)
 	fmt.Println("查找 aaaaaa 完成，消耗时间：", elapse)
 	fmt.Println(v)
@@ -109,7 +110,6 @@ func writeSSTable() {
 	}
 
 	// 休眠 2 * CheckInterval 保证SSTable压缩一定会执行
-	cfg := config.GetConfig()
 	time.Sleep(2 * time.Duration(cfg.CheckInterval) * time.Second)
 
 	// 随机选择一个Get
@@ -137,7 +137,6 @@ func sstCompaction() {
 	}
 
 	// 休眠 2 * CheckInterval 保证SSTable压缩一定会执行
-	cfg := config.GetConfig()
 	time.Sleep(2 * time.Duration(cfg.CheckInterval) * time.Second)
 
 	// 随机选择一个Get
@@ -150,7 +149,7 @@ func sstCompaction() {
 
 func query(key string) {
 	start := time.Now()
-	v, _ := lsm.Get[TestValue](key)
+	v, _, _ := lsm.Get[TestValue](key)
 	elapse := time.Since(start)
 	fmt.Println("查找 ", key, "完成，消耗时间：", elapse)
 	fmt.Println(v)
@@ -0,0 +1,165 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:19
+ * @Func: 值的编码方式, 编码方式的名字随数据一起保存, 解码时总是使用写入时的编码方式
+ **/
+
+//
+//  Codec
+//  @Description: 值的编码方式, Name会记录在每个元素中, 必须唯一且不能改变
+//
+type Codec interface {
+	Name() string
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, value any) error
+}
+
+// 内置的编码方式
+var (
+	JSON Codec = jsonCodec{} // encoding/json, 默认的编码方式
+	Gob  Codec = gobCodec{}  // encoding/gob, 能保留time.Time精度, 大整数等类型
+	Raw  Codec = rawCodec{}  // 不做编码, 值必须是[]byte或string
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSON.Name(): JSON,
+		Gob.Name():  Gob,
+		Raw.Name():  Raw,
+	}
+)
+
+//
+// RegisterCodec
+//  @Description: 注册自定义的编码方式, 读取用它写入的数据之前必须先注册
+//  @param codec
+//
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+//
+// CodecByName
+//  @Description: 根据名字查找编码方式, 空名字是加入编码方式之前写入的数据, 使用JSON
+//  @param name
+//  @return Codec
+//  @return error
+//
+func CodecByName(name string) (Codec, error) {
+	if name == "" {
+		return JSON, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("lsm: unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+//
+// Encode
+//  @Description: 用codec编码value, 并记录编码方式的名字
+//  @receiver v
+//  @param codec
+//  @param value
+//  @return error
+//
+func (v *Value) Encode(codec Codec, value any) error {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	v.Value = data
+	v.Codec = codec.Name()
+	return nil
+}
+
+//
+// Decode
+//  @Description: 用写入时的编码方式把值解码到value指向的对象中
+//  @receiver v
+//  @param value	必须是一个指针
+//  @return error
+//
+func (v *Value) Decode(value any) error {
+	codec, err := CodecByName(v.Codec)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(v.Value, value)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value any) error {
+	return json.Unmarshal(data, value)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, value any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return append([]byte(nil), v...), nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("lsm: raw codec cannot marshal %T", value)
+}
+
+func (rawCodec) Unmarshal(data []byte, value any) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+	return fmt.Errorf("lsm: raw codec cannot unmarshal into %T", value)
+}
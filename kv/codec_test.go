@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:19
+ * @Func:
+ **/
+
+type codecTest struct {
+	At   time.Time
+	Big  int64
+	Data []byte
+}
+
+func TestCodec(t *testing.T) {
+	want := codecTest{At: time.Unix(1700000000, 123456789), Big: math.MaxInt64, Data: []byte{0, 1, 2}}
+	for _, codec := range []Codec{JSON, Gob} {
+		var v Value
+		if err := v.Encode(codec, want); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if v.Codec != codec.Name() {
+			t.Errorf("codec name %q, want %q", v.Codec, codec.Name())
+		}
+		got, err := Get[codecTest](&v)
+		if err != nil || !got.At.Equal(want.At) || got.Big != want.Big || !reflect.DeepEqual(got.Data, want.Data) {
+			t.Errorf("%s: got %+v, %v", codec.Name(), got, err)
+		}
+	}
+
+	var v Value
+	if err := v.Encode(Raw, []byte("raw bytes")); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Value) != "raw bytes" {
+		t.Error(string(v.Value))
+	}
+	if s, err := Get[string](&v); err != nil || s != "raw bytes" {
+		t.Error(s, err)
+	}
+	if err := v.Encode(Raw, 1); err == nil {
+		t.Error("raw codec should reject non-byte values")
+	}
+
+	// 没有记录编码方式的旧数据使用JSON
+	old := Value{Value: []byte(`{"Big":1}`)}
+	if got, err := Get[codecTest](&old); err != nil || got.Big != 1 {
+		t.Error(got, err)
+	}
+	unknown := Value{Value: []byte{1}, Codec: "unknown"}
+	if _, err := Get[int](&unknown); err == nil {
+		t.Error("unknown codec should fail")
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	values := []Value{
+		{Key: "a", Value: []byte{0, 1, 2}, Seq: 3, ExpireAt: 100, Codec: "raw"},
+		{Key: "b", Deleted: true, Seq: 4},
+		{Key: "", Value: []byte{}},
+		{Key: "c", Value: []byte("1"), Seq: 5, Merge: true},
+		{Key: "d", Value: []byte("2"), Seq: 6, Family: "users"},
+	}
+	for _, want := range values {
+		data, err := Encode(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 值原样保存在末尾
+		if !bytes.HasSuffix(data, want.Value) {
+			t.Errorf("the value of %q should be stored as is", want.Key)
+		}
+		got, err := Decode(data)
+		if err != nil || got.Key != want.Key || !bytes.Equal(got.Value, want.Value) || got.Deleted != want.Deleted ||
+			got.Merge != want.Merge || got.Family != want.Family || got.Seq != want.Seq || got.ExpireAt != want.ExpireAt || got.Codec != want.Codec {
+			t.Errorf("got %+v %v, want %+v", got, err, want)
+		}
+	}
+	// 兼容旧的JSON编码
+	if got, err := Decode([]byte(`{"Key":"k","Value":"MTIz","Deleted":false}`)); err != nil || got.Key != "k" || string(got.Value) != "123" {
+		t.Error(got, err)
+	}
+	for _, data := range [][]byte{nil, {9}, {1, 0, 0x80}} {
+		if _, err := Decode(data); err == nil {
+			t.Errorf("decode %v should fail", data)
+		}
+	}
+}
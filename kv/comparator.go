@@ -0,0 +1,80 @@
+package kv
+
+import (
+	"bytes"
+	"strings"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:24
+ * @Func: key的比较器, 决定内存表, SSTable和迭代器中key的顺序
+ **/
+
+//
+//  Comparator
+//  @Description: key的全序比较器, Compare返回0当且仅当两个key的字节完全相同;
+//  Name会保存在数据目录中, 用不同的比较器打开同一个目录会被拒绝
+//
+type Comparator interface {
+	Name() string
+	Compare(a []byte, b []byte) int // a < b 返回负数, a == b 返回0, a > b 返回正数
+}
+
+// 内置的比较器
+var (
+	Bytewise Comparator = bytewiseComparator{} // 按字节序升序, 默认的比较器
+	Reverse  Comparator = reverseComparator{}  // 按字节序降序
+)
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "bytewise"
+}
+
+func (bytewiseComparator) Compare(a []byte, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string {
+	return "reverse-bytewise"
+}
+
+func (reverseComparator) Compare(a []byte, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+//
+// CompareKeys
+//  @Description: 用cmp比较两个key, cmp为空时使用Bytewise; key以string保存, 可以包含任意字节
+//  @param cmp
+//  @param a
+//  @param b
+//  @return int
+//
+func CompareKeys(cmp Comparator, a string, b string) int {
+	// 内置的比较器直接比较string, 避免转换成[]byte
+	switch cmp.(type) {
+	case nil, bytewiseComparator:
+		return strings.Compare(a, b)
+	case reverseComparator:
+		return strings.Compare(b, a)
+	}
+	return cmp.Compare([]byte(a), []byte(b))
+}
+
+//
+// InRange
+//  @Description: 判断key是否在[start, end)范围内, start为空表示没有下界, end为空表示没有上界
+//  @param cmp
+//  @param key
+//  @param start
+//  @param end
+//  @return bool
+//
+func InRange(cmp Comparator, key string, start string, end string) bool {
+	return (start == "" || CompareKeys(cmp, key, start) >= 0) && (end == "" || CompareKeys(cmp, key, end) < 0)
+}
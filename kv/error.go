@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:02
+ * @Func: 各存储层共用的错误类型
+ **/
+
+var (
+	ErrIO            = errors.New("lsm: io error")                     // 读写磁盘文件失败
+	ErrCorrupt       = errors.New("lsm: data corrupted")               // 磁盘上的数据无法解析
+	ErrClosed        = errors.New("lsm: database is closed")           // 数据库已经关闭
+	ErrConflict      = errors.New("lsm: transaction conflict")         // 事务读过的key在事务开始后被其他写入修改
+	ErrTxnDone       = errors.New("lsm: transaction has finished")     // 事务已经提交或者回滚
+	ErrComparator    = errors.New("lsm: comparator mismatch")          // 打开数据目录的比较器与写入时的不同
+	ErrMergeOperator = errors.New("lsm: no merge operator configured") // 写入或者读取合并操作数时没有配置合并操作
+	ErrNoFamily      = errors.New("lsm: column family does not exist") // 列族不存在或者已经删除
+	ErrFamilyExists  = errors.New("lsm: column family already exists") // 创建的列族已经存在
+	ErrSlowConsumer  = errors.New("lsm: subscriber fell behind")       // 订阅者没有及时读取事件, 缓冲区满后订阅被关闭
+	ErrTruncated     = errors.New("lsm: wal.log truncated")            // 要恢复的序列号之后的写入已经不在wal.log中
+)
+
+//
+//  Error
+//  @Description: 带有出错位置的错误, 可以用 errors.Is(err, ErrIO) 判断错误类型,
+//  用 errors.Unwrap 拿到底层的错误
+//
+type Error struct {
+	Kind error  // 错误类型, ErrIO 或 ErrCorrupt
+	Op   string // 出错的操作
+	Path string // 出错的文件
+	Err  error  // 底层错误
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error() + ": " + e.Op
+	if e.Path != "" {
+		msg += " " + e.Path
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//
+// IOError
+//  @Description: 构造一个 ErrIO 类型的错误
+//  @param op
+//  @param path
+//  @param err
+//  @return error
+//
+func IOError(op string, path string, err error) error {
+	return &Error{Kind: ErrIO, Op: op, Path: path, Err: err}
+}
+
+//
+// CorruptError
+//  @Description: 构造一个 ErrCorrupt 类型的错误, format 描述损坏的原因
+//  @param path
+//  @param format
+//  @param args
+//  @return error
+//
+func CorruptError(path string, format string, args ...any) error {
+	return &Error{Kind: ErrCorrupt, Op: fmt.Sprintf(format, args...), Path: path}
+}
@@ -0,0 +1,97 @@
+package kv
+
+import "sort"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:04
+ * @Func: 有序遍历的迭代器接口, 内存表和SSTable都实现它, 由db层做多路归并
+ **/
+
+//
+//  Iterator
+//  @Description: 按key有序遍历元素的迭代器, 可以双向移动, 遍历到的元素可能是删除标记
+//
+type Iterator interface {
+	Seek(key string)        // 定位到第一个 >= key 的元素, 大小由比较器决定
+	SeekForPrev(key string) // 定位到最后一个 <= key 的元素
+	SeekToFirst()           // 定位到第一个元素
+	SeekToLast()            // 定位到最后一个元素
+	Valid() bool            // 当前是否指向一个元素
+	Next()                  // 移动到下一个元素
+	Prev()                  // 移动到上一个元素
+	Key() string            // 当前元素的key, 只有Valid时可以调用
+	Value() Value           // 当前元素, 只有Valid时可以调用
+	Err() error             // 遍历过程中遇到的错误
+	Close() error           // 释放迭代器持有的资源
+}
+
+//
+//  SliceIterator
+//  @Description: 遍历一个按比较器升序排列的Value切片
+//
+type SliceIterator struct {
+	values []Value
+	index  int
+	cmp    Comparator
+}
+
+//
+// NewSliceIterator
+//  @Description: 创建一个切片迭代器, values必须按cmp升序排列
+//  @param values
+//  @param cmp
+//  @return *SliceIterator
+//
+func NewSliceIterator(values []Value, cmp Comparator) *SliceIterator {
+	return &SliceIterator{values: values, cmp: cmp}
+}
+
+func (it *SliceIterator) Seek(key string) {
+	it.index = sort.Search(len(it.values), func(i int) bool {
+		return CompareKeys(it.cmp, it.values[i].Key, key) >= 0
+	})
+}
+
+func (it *SliceIterator) SeekForPrev(key string) {
+	it.index = sort.Search(len(it.values), func(i int) bool {
+		return CompareKeys(it.cmp, it.values[i].Key, key) > 0
+	}) - 1
+}
+
+func (it *SliceIterator) SeekToFirst() {
+	it.index = 0
+}
+
+func (it *SliceIterator) SeekToLast() {
+	it.index = len(it.values) - 1
+}
+
+func (it *SliceIterator) Valid() bool {
+	return it.index >= 0 && it.index < len(it.values)
+}
+
+func (it *SliceIterator) Next() {
+	it.index++
+}
+
+func (it *SliceIterator) Prev() {
+	it.index--
+}
+
+func (it *SliceIterator) Key() string {
+	return it.values[it.index].Key
+}
+
+func (it *SliceIterator) Value() Value {
+	return it.values[it.index]
+}
+
+func (it *SliceIterator) Err() error {
+	return nil
+}
+
+func (it *SliceIterator) Close() error {
+	it.values = nil
+	return nil
+}
@@ -1,6 +1,10 @@
 package kv
 
-import "encoding/json"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
 
 /**
  * @Author: ygzhang
@@ -15,6 +19,7 @@ const (
 	None SearchResult = iota
 	Deleted
 	Success
+	MergeOperand // 查到的是合并操作数, 需要继续向下查找旧版本一起合并
 )
 
 //
@@ -22,9 +27,15 @@ const (
 //  @Description: Value表示一个kv对
 //
 type Value struct {
-	Key     string
-	Value   []byte
-	Deleted bool
+	Key      string
+	Value    []byte
+	Deleted  bool
+	Seq      uint64 `json:",omitempty"` // 写入时分配的序列号, 单调递增
+	ExpireAt int64  `json:",omitempty"` // 过期时间, Unix纳秒时间戳, 0表示永不过期
+	Codec    string `json:",omitempty"` // 值的编码方式, 为空表示JSON
+	Merge    bool   `json:",omitempty"` // 值是一个合并操作数, 读取时要和更旧的版本一起合并
+	Family   string `json:",omitempty"` // 所属的列族, 只记录在wal.log中, 为空表示默认列族
+	Range    bool   `json:",omitempty"` // 范围删除标记, 只记录在wal.log中, key是范围的起点, 值是终点
 }
 
 //
@@ -35,57 +46,151 @@ type Value struct {
 //
 func (v *Value) Copy() *Value {
 	return &Value{
-		Key:     v.Key,
-		Value:   v.Value,
-		Deleted: v.Deleted,
+		Key:      v.Key,
+		Value:    v.Value,
+		Deleted:  v.Deleted,
+		Seq:      v.Seq,
+		ExpireAt: v.ExpireAt,
+		Codec:    v.Codec,
+		Merge:    v.Merge,
+		Family:   v.Family,
+		Range:    v.Range,
 	}
 }
 
+//
+// Expired
+//  @Description: 判断元素在now(Unix纳秒时间戳)时是否已经过期
+//  @receiver v
+//  @param now
+//  @return bool
+//
+func (v *Value) Expired(now int64) bool {
+	return v.ExpireAt > 0 && v.ExpireAt <= now
+}
+
 // NOTE: [T any] 表示这个函数是一个泛型函数，它可以接受任意类型 T 作为参数。
 //
 // Get[T any]
-//  @Description: Get 反序列化元素中的值
+//  @Description: Get 用写入时的编码方式反序列化元素中的值
 //  @param v
 //  @return T
 //  @return error
 //
 func Get[T any](v *Value) (T, error) {
 	var value T
-	err := json.Unmarshal(v.Value, &value)
+	err := v.Decode(&value)
 	return value, err
 }
 
 //
 // Convert[T any]
-//  @Description: Convert 将值序列化为二进制
+//  @Description: Convert 用默认的JSON编码将值序列化为二进制
 //  @param value
 //  @return []byte
 //  @return error
 //
 func Convert[T any](value T) ([]byte, error) {
-	return json.Marshal(value)
+	return JSON.Marshal(value)
 }
 
+// 二进制编码的格式版本, 总是第一个字节; 旧的JSON编码第一个字节总是'{'
+const binaryFormat byte = 1
+
+// 二进制编码第二个字节中的标记位
+const (
+	flagDeleted byte = 1 << iota
+	flagMerge
+	flagFamily // key之后还有列族的名字
+	flagRange  // 范围删除标记
+)
+
 //
 // Decode
-//  @Description: Decode 二进制数据反序列化为 Value
+//  @Description: Decode 二进制数据反序列化为 Value, 同时兼容旧的JSON编码
 //  @param data
 //  @return Value
 //  @return error
 //
 func Decode(data []byte) (Value, error) {
 	var value Value
-	err := json.Unmarshal(data, &value)
-	return value, err
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &value)
+		return value, err
+	}
+	if len(data) < 2 || data[0] != binaryFormat {
+		return value, errors.New("unknown value format")
+	}
+	flags := data[1]
+	value.Deleted = flags&flagDeleted != 0
+	value.Merge = flags&flagMerge != 0
+	value.Range = flags&flagRange != 0
+	data = data[2:]
+	seq, n := binary.Uvarint(data)
+	if n <= 0 {
+		return value, errors.New("invalid seq")
+	}
+	value.Seq, data = seq, data[n:]
+	expireAt, n := binary.Varint(data)
+	if n <= 0 {
+		return value, errors.New("invalid expire time")
+	}
+	value.ExpireAt, data = expireAt, data[n:]
+	fields := make([][]byte, 2, 3)
+	if flags&flagFamily != 0 {
+		fields = fields[:3]
+	}
+	for i := range fields {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return value, errors.New("invalid field length")
+		}
+		fields[i], data = data[n:n+int(size)], data[n+int(size):]
+	}
+	value.Codec, value.Key = string(fields[0]), string(fields[1])
+	if len(fields) == 3 {
+		value.Family = string(fields[2])
+	}
+	// 剩下的字节就是值本身, 不做任何转换; 复制一份, 不引用调用方的缓冲区
+	if !value.Deleted {
+		value.Value = append([]byte{}, data...)
+	}
+	return value, nil
 }
 
 //
 // Encode
-//  @Description: Encode 将 Value 序列化为二进制
+//  @Description: Encode 将 Value 序列化为二进制: 格式版本, 标记位, 序列号, 过期时间, 编码方式和key,
+//  不是默认列族时还有列族的名字, 最后是原样保存的值
 //  @param value
 //  @return []byte
 //  @return error
 //
 func Encode(value Value) ([]byte, error) {
-	return json.Marshal(value)
+	data := make([]byte, 2, 2+5*binary.MaxVarintLen64+len(value.Codec)+len(value.Key)+len(value.Family)+len(value.Value))
+	data[0] = binaryFormat
+	if value.Deleted {
+		data[1] |= flagDeleted
+	}
+	if value.Merge {
+		data[1] |= flagMerge
+	}
+	if value.Family != "" {
+		data[1] |= flagFamily
+	}
+	if value.Range {
+		data[1] |= flagRange
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	data = append(data, buf[:binary.PutUvarint(buf, value.Seq)]...)
+	data = append(data, buf[:binary.PutVarint(buf, value.ExpireAt)]...)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(len(value.Codec)))]...)
+	data = append(data, value.Codec...)
+	data = append(data, buf[:binary.PutUvarint(buf, uint64(len(value.Key)))]...)
+	data = append(data, value.Key...)
+	if value.Family != "" {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(value.Family)))]...)
+		data = append(data, value.Family...)
+	}
+	return append(data, value.Value...), nil
 }
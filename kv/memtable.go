@@ -0,0 +1,102 @@
+package kv
+
+import "unsafe"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:57
+ * @Func: 内存表接口, 默认实现是跳表skiplist, 也可以使用二叉搜索树bst
+ **/
+
+//
+//  MemTable
+//  @Description: 内存表, 保存还没有落盘的写入; 每个key保存最新版本, 以及为快照和合并操作数保留的旧版本.
+//  所有方法都可以并发调用
+//
+type MemTable interface {
+	Get(key string) (Value, SearchResult)                              // 查找key的最新版本
+	GetAt(key string, seq uint64) (Value, SearchResult)                // 查找key在序列号seq时的版本
+	GetChainAt(key string, seq uint64) []Value                         // key在序列号seq时需要合并的一串版本, 从新到旧排列
+	Set(key string, value []byte) (Value, bool)                        // 设置key的值并返回旧值
+	Delete(key string) (Value, bool)                                   // 写入key的删除标记并返回旧值
+	Put(value Value, retain uint64) (Value, bool)                      // 写入一个版本, Seq <= retain的旧版本保留下来
+	PutBatch(values []Value, retain uint64)                            // 依次写入一批版本, 序列号由调用方在写完后发布
+	PutRange(r RangeTombstone)                                         // 写入一个范围删除标记
+	RangesAt(seq uint64) []RangeTombstone                              // 对序列号seq可见的范围删除标记
+	Covering(key string, seq uint64, at uint64) (RangeTombstone, bool) // 对序列号at可见, 遮住序列号为seq的key的最新的范围删除标记
+	NewIterator(start string, end string, seq uint64) Iterator         // [start, end)内对序列号seq可见的版本的迭代器
+	GetVersions() []Value                                              // 所有版本, 按key升序, 同一个key从新到旧排列, 用于落盘
+	ApproximateRange(start string, end string) (int64, int)            // 估算[start, end)内的数据大小和key数量
+	ApproximateSize() int64                                            // 估算内存表占用的内存, 包括节点和版本的开销
+	GetCount() int                                                     // key的数量
+	Entries() int                                                      // 条目的数量, 包括删除标记和范围删除标记, 用于按数量落盘
+	MaxSeq() uint64                                                    // 最大的序列号
+	Empty() bool                                                       // 是否没有任何写入
+	Swap() MemTable                                                    // 清空内存表, 返回一个包含原有数据的内存表
+}
+
+//
+// VersionSize
+//  @Description: 一个版本在内存表中大约占用的字节数, 包括值和Value结构体本身; key由保存它的节点计算
+//  @param value
+//  @return int64
+//
+func VersionSize(value Value) int64 {
+	return int64(unsafe.Sizeof(value)) + int64(len(value.Value))
+}
+
+//
+// RangeSize
+//  @Description: 一个范围删除标记在内存表中大约占用的字节数
+//  @param r
+//  @return int64
+//
+func RangeSize(r RangeTombstone) int64 {
+	return int64(unsafe.Sizeof(r)) + int64(len(r.Start)+len(r.End))
+}
+
+//
+// PublishedBefore
+//  @Description: 写入序列号为seq的版本时已经发布的序列号; 写入按序列号的顺序进行, 写完之后才发布
+//  @param seq
+//  @return uint64
+//
+func PublishedBefore(seq uint64) uint64 {
+	if seq == 0 {
+		return 0
+	}
+	return seq - 1
+}
+
+//
+// KeepVersions
+//  @Description: 写入value覆盖versions(从新到旧排列)时, 计算需要保留和可以丢掉的旧版本.
+//  序列号不大于floor的最新版本总是保留: value的序列号发布之前, 读取还停在floor上, 要看到这个版本;
+//  其余的旧版本在 Seq <= retain, 或者更新的保留版本是合并操作数时保留
+//  @param value
+//  @param versions
+//  @param retain	最新的存活快照的序列号, 没有快照时为0
+//  @param floor	已经发布的序列号, 为0时不需要为读取保留
+//  @return []Value	保留的旧版本, 从新到旧排列
+//  @return []Value	丢掉的旧版本
+//
+func KeepVersions(value Value, versions []Value, retain uint64, floor uint64) ([]Value, []Value) {
+	kept := make([]Value, 0, len(versions))
+	var dropped []Value
+	merge := value.Merge
+	published := floor == 0
+	for _, v := range versions {
+		keep := merge || (retain > 0 && v.Seq <= retain) || (!published && v.Seq <= floor)
+		if v.Seq <= floor {
+			published = true
+		}
+		if keep {
+			kept = append(kept, v)
+			merge = v.Merge
+		} else {
+			dropped = append(dropped, v)
+			merge = false
+		}
+	}
+	return kept, dropped
+}
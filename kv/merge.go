@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:30
+ * @Func: 合并操作, 写入时只记录操作数, 读取和压缩时再把操作数合并到旧值上
+ **/
+
+//
+//  MergeOperator
+//  @Description: 合并操作, 把一串操作数合并到key的旧值上, 用于计数器, 追加等读-改-写的场景;
+//  Merge必须是确定的, 同样的输入总是得到同样的结果
+//
+type MergeOperator interface {
+	Name() string
+	// Merge 把operands按从旧到新的顺序合并到existing上, existing为nil表示key不存在或者已经被删除
+	Merge(key string, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// 内置的合并操作
+var (
+	Int64Add    MergeOperator = int64Add{}    // 值和操作数都是十进制整数(JSON或Raw编码的int64), 结果是它们的和
+	BytesAppend MergeOperator = bytesAppend{} // 把操作数的字节依次追加到旧值后面, 一般和Raw编码一起使用
+)
+
+//
+// ResolveMerge
+//  @Description: 合并同一个key的一串版本: chain从新到旧排列, 除了最后一个都是合并操作数,
+//  最后一个不是操作数时作为旧值, 删除标记和已经过期的旧值当作不存在. 结果的序列号是最新操作数的序列号,
+//  编码方式沿用旧值的, 没有旧值时使用最新操作数的
+//  @param op
+//  @param chain
+//  @param now
+//  @return Value
+//  @return error
+//
+func ResolveMerge(op MergeOperator, chain []Value, now int64) (Value, error) {
+	if op == nil {
+		return Value{}, ErrMergeOperator
+	}
+	result := Value{Key: chain[0].Key, Seq: chain[0].Seq, Codec: chain[0].Codec}
+	operands := chain
+	var existing []byte
+	if base := chain[len(chain)-1]; !base.Merge {
+		operands = chain[:len(chain)-1]
+		if !base.Deleted && !base.Expired(now) {
+			existing = base.Value
+			// 没有旧值时existing为nil, 旧值为空时也要和不存在区分开
+			if existing == nil {
+				existing = []byte{}
+			}
+			result.Codec, result.ExpireAt = base.Codec, base.ExpireAt
+		}
+	}
+	// 操作数从旧到新交给op
+	data := make([][]byte, len(operands))
+	for i, operand := range operands {
+		data[len(operands)-1-i] = operand.Value
+	}
+	value, err := op.Merge(result.Key, existing, data)
+	if err != nil {
+		return Value{}, fmt.Errorf("lsm: merge %q with %s: %w", result.Key, op.Name(), err)
+	}
+	result.Value = value
+	return result, nil
+}
+
+type int64Add struct{}
+
+func (int64Add) Name() string {
+	return "int64-add"
+}
+
+func (int64Add) Merge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(existing)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(operand)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return strconv.AppendInt(nil, sum, 10), nil
+}
+
+type bytesAppend struct{}
+
+func (bytesAppend) Name() string {
+	return "bytes-append"
+}
+
+func (bytesAppend) Merge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	value := append([]byte{}, existing...)
+	for _, operand := range operands {
+		value = append(value, operand...)
+	}
+	return value, nil
+}
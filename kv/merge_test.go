@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:30
+ * @Func:
+ **/
+
+func TestResolveMerge(t *testing.T) {
+	operands := []Value{
+		{Key: "k", Value: []byte("3"), Seq: 5, Merge: true},
+		{Key: "k", Value: []byte("2"), Seq: 4, Merge: true},
+	}
+	for _, tt := range []struct {
+		base Value
+		want string
+	}{
+		{Value{Key: "k", Value: []byte("10"), Seq: 3}, "15"},
+		{Value{Key: "k", Deleted: true, Seq: 3}, "5"},
+		{Value{Key: "k", Value: []byte("10"), Seq: 3, ExpireAt: 1}, "5"},
+	} {
+		got, err := ResolveMerge(Int64Add, append(operands, tt.base), 2)
+		if err != nil || string(got.Value) != tt.want || got.Seq != 5 || got.Merge {
+			t.Errorf("merge onto %+v: got %+v %v, want %s", tt.base, got, err, tt.want)
+		}
+	}
+	// 没有旧值
+	if got, err := ResolveMerge(Int64Add, operands, 0); err != nil || string(got.Value) != "5" {
+		t.Error(got, err)
+	}
+	// 操作数按从旧到新的顺序追加
+	chain := []Value{
+		{Key: "s", Value: []byte("c"), Seq: 3, Merge: true},
+		{Key: "s", Value: []byte("b"), Seq: 2, Merge: true},
+		{Key: "s", Value: []byte("a"), Seq: 1, Codec: "raw"},
+	}
+	if got, err := ResolveMerge(BytesAppend, chain, 0); err != nil || string(got.Value) != "abc" || got.Codec != "raw" {
+		t.Error(got, err)
+	}
+	if _, err := ResolveMerge(nil, chain, 0); !errors.Is(err, ErrMergeOperator) {
+		t.Error(err)
+	}
+	if _, err := ResolveMerge(Int64Add, chain, 0); err == nil {
+		t.Error("int64-add should reject a non-integer value")
+	}
+}
+
+func TestRetainMergeVersions(t *testing.T) {
+	versions := []Value{
+		{Key: "k", Seq: 9, Merge: true},
+		{Key: "k", Seq: 7, Merge: true},
+		{Key: "k", Seq: 5},
+		{Key: "k", Seq: 3, Merge: true},
+		{Key: "k", Seq: 2},
+		{Key: "k", Seq: 1},
+	}
+	// 最新的一串操作数连同旧值都要保留, 快照4能看到的操作数也要连同它的旧值保留
+	got := RetainVersions(versions, []uint64{4})
+	seqs := make([]uint64, 0, len(got))
+	for _, value := range got {
+		seqs = append(seqs, value.Seq)
+	}
+	if want := []uint64{9, 7, 5, 3, 2}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("retained seqs %v, want %v", seqs, want)
+	}
+	if got = RetainVersions(versions, nil); !reflect.DeepEqual(got, versions[:3]) {
+		t.Errorf("retained %v without snapshots", got)
+	}
+}
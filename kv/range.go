@@ -0,0 +1,344 @@
+package kv
+
+import "sort"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:44
+ * @Func: 范围删除标记, 一条记录删除[Start, End)内所有更旧的版本
+ **/
+
+//
+//  RangeTombstone
+//  @Description: 范围删除标记, 遮住key在[Start, End)内且序列号比Seq小的所有版本; End为空表示没有上界
+//
+type RangeTombstone struct {
+	Start string
+	End   string
+	Seq   uint64
+}
+
+//
+// Covers
+//  @Description: 判断序列号为seq的key的版本是否被这个范围删除标记遮住
+//  @receiver r
+//  @param cmp
+//  @param key
+//  @param seq
+//  @return bool
+//
+func (r RangeTombstone) Covers(cmp Comparator, key string, seq uint64) bool {
+	return r.Seq > seq && InRange(cmp, key, r.Start, r.End)
+}
+
+//
+// Value
+//  @Description: 转换为写入wal.log的记录: key是Start, 值是End
+//  @receiver r
+//  @return Value
+//
+func (r RangeTombstone) Value() Value {
+	return Value{Key: r.Start, Value: []byte(r.End), Seq: r.Seq, Range: true}
+}
+
+//
+// RangeOf
+//  @Description: 从wal.log的记录还原范围删除标记
+//  @param value
+//  @return RangeTombstone
+//
+func RangeOf(value Value) RangeTombstone {
+	return RangeTombstone{Start: value.Key, End: string(value.Value), Seq: value.Seq}
+}
+
+//
+//  RangeIndex
+//  @Description: 范围删除标记的索引. 标记被切成互不重叠的片段, 查找遮住一个key的标记时
+//  二分找到key所在的片段, 只检查真正覆盖key的标记
+//
+type RangeIndex struct {
+	cmp       Comparator
+	ranges    []RangeTombstone // 所有标记, 按Start排列
+	fragments []rangeFragment  // 按start排列, 互不重叠
+}
+
+//
+//  rangeFragment
+//  @Description: [start, end)内的一段, 覆盖这一段的标记完全相同; start为空表示没有下界, end为空表示没有上界
+//
+type rangeFragment struct {
+	start  string
+	end    string
+	ranges []RangeTombstone // 覆盖这一段的标记, 按Seq从大到小排列; 只会整体替换, 片段之间可以共享
+}
+
+//
+// NewRangeIndex
+//  @Description: 用ranges的副本创建索引
+//  @param cmp
+//  @param ranges
+//  @return RangeIndex
+//
+func NewRangeIndex(cmp Comparator, ranges []RangeTombstone) RangeIndex {
+	x := RangeIndex{cmp: cmp, ranges: append([]RangeTombstone(nil), ranges...)}
+	sort.SliceStable(x.ranges, func(i, j int) bool {
+		return x.compareStart(x.ranges[i].Start, x.ranges[j].Start) < 0
+	})
+	x.fragment()
+	return x
+}
+
+//
+// fragment
+//  @Description: 用所有标记的边界把key空间切成基本区间, 把每个标记放进它覆盖的区间, 去掉空的区间
+//  @receiver x
+//
+func (x *RangeIndex) fragment() {
+	var bounds []string
+	for _, r := range x.ranges {
+		for _, b := range [...]string{r.Start, r.End} {
+			if b != "" {
+				bounds = append(bounds, b)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool {
+		return CompareKeys(x.cmp, bounds[i], bounds[j]) < 0
+	})
+	unique := bounds[:0]
+	for _, b := range bounds {
+		if len(unique) == 0 || CompareKeys(x.cmp, unique[len(unique)-1], b) != 0 {
+			unique = append(unique, b)
+		}
+	}
+	// 第i个基本区间是[unique[i-1], unique[i]), 两头分别没有下界和上界
+	index := func(b string) int {
+		return sort.Search(len(unique), func(i int) bool {
+			return CompareKeys(x.cmp, unique[i], b) >= 0
+		})
+	}
+	covered := make([][]RangeTombstone, len(unique)+1)
+	for _, r := range x.ranges {
+		first, last := 0, len(unique)
+		if r.Start != "" {
+			first = index(r.Start) + 1
+		}
+		if r.End != "" {
+			last = index(r.End)
+		}
+		for i := first; i <= last; i++ {
+			covered[i] = append(covered[i], r)
+		}
+	}
+	x.fragments = nil
+	for i, ranges := range covered {
+		if len(ranges) == 0 {
+			continue
+		}
+		sort.Slice(ranges, func(a, b int) bool {
+			return ranges[a].Seq > ranges[b].Seq
+		})
+		f := rangeFragment{ranges: ranges}
+		if i > 0 {
+			f.start = unique[i-1]
+		}
+		if i < len(unique) {
+			f.end = unique[i]
+		}
+		x.fragments = append(x.fragments, f)
+	}
+}
+
+//
+// compareStart
+//  @Description: 比较两个Start, 为空表示没有下界, 排在最前面
+//  @receiver x
+//  @param a
+//  @param b
+//  @return int
+//
+func (x *RangeIndex) compareStart(a string, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	case b == "":
+		return 1
+	}
+	return CompareKeys(x.cmp, a, b)
+}
+
+//
+// before
+//  @Description: 判断下界start是否小于上界end; start为空表示没有下界, end为空表示没有上界
+//  @receiver x
+//  @param start
+//  @param end
+//  @return bool
+//
+func (x *RangeIndex) before(start string, end string) bool {
+	return start == "" || end == "" || CompareKeys(x.cmp, start, end) < 0
+}
+
+//
+// Add
+//  @Description: 插入一个范围删除标记: 在它的两个边界切开已有的片段, 把它加进范围内的片段, 并补上范围内的空隙
+//  @receiver x
+//  @param r
+//
+func (x *RangeIndex) Add(r RangeTombstone) {
+	i := sort.Search(len(x.ranges), func(i int) bool {
+		return x.compareStart(x.ranges[i].Start, r.Start) > 0
+	})
+	x.ranges = append(x.ranges, RangeTombstone{})
+	copy(x.ranges[i+1:], x.ranges[i:])
+	x.ranges[i] = r
+
+	if r.Start != "" {
+		x.split(r.Start)
+	}
+	if r.End != "" {
+		x.split(r.End)
+	}
+	gap := func(start string) rangeFragment {
+		return rangeFragment{start: start, end: r.End, ranges: []RangeTombstone{r}}
+	}
+	fragments := make([]rangeFragment, 0, len(x.fragments)+2)
+	// cursor之前的部分已经处理完; done表示[r.Start, r.End)已经全部处理完
+	cursor, done := r.Start, !x.before(r.Start, r.End)
+	for _, f := range x.fragments {
+		switch {
+		case x.compareStart(f.start, r.Start) < 0:
+		case !done && x.before(f.start, r.End):
+			if x.compareStart(cursor, f.start) < 0 {
+				fragments = append(fragments, rangeFragment{start: cursor, end: f.start, ranges: []RangeTombstone{r}})
+			}
+			f.ranges = withRange(f.ranges, r)
+			cursor, done = f.end, f.end == ""
+		case !done:
+			if x.before(cursor, r.End) {
+				fragments = append(fragments, gap(cursor))
+			}
+			done = true
+		}
+		fragments = append(fragments, f)
+	}
+	if !done && x.before(cursor, r.End) {
+		fragments = append(fragments, gap(cursor))
+	}
+	x.fragments = fragments
+}
+
+//
+// split
+//  @Description: 如果有片段的内部包含key, 在key处把它切成两段
+//  @receiver x
+//  @param key
+//
+func (x *RangeIndex) split(key string) {
+	i := x.search(key)
+	if i < 0 || x.compareStart(x.fragments[i].start, key) == 0 || !x.before(key, x.fragments[i].end) {
+		return
+	}
+	f := x.fragments[i]
+	x.fragments = append(x.fragments, rangeFragment{})
+	copy(x.fragments[i+1:], x.fragments[i:])
+	x.fragments[i].end = key
+	x.fragments[i+1] = rangeFragment{start: key, end: f.end, ranges: f.ranges}
+}
+
+//
+// search
+//  @Description: 返回start不大于key的最后一个片段的下标, 没有时返回-1
+//  @receiver x
+//  @param key
+//  @return int
+//
+func (x *RangeIndex) search(key string) int {
+	return sort.Search(len(x.fragments), func(i int) bool {
+		return x.compareStart(x.fragments[i].start, key) > 0
+	}) - 1
+}
+
+//
+// withRange
+//  @Description: 返回加入r后按Seq从大到小排列的新切片, 不修改ranges
+//  @param ranges
+//  @param r
+//  @return []RangeTombstone
+//
+func withRange(ranges []RangeTombstone, r RangeTombstone) []RangeTombstone {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].Seq < r.Seq
+	})
+	merged := make([]RangeTombstone, 0, len(ranges)+1)
+	merged = append(merged, ranges[:i]...)
+	merged = append(merged, r)
+	return append(merged, ranges[i:]...)
+}
+
+//
+// Len
+//  @Description: 范围删除标记的数量
+//  @receiver x
+//  @return int
+//
+func (x *RangeIndex) Len() int {
+	return len(x.ranges)
+}
+
+//
+// RangesAt
+//  @Description: 返回对序列号seq可见的范围删除标记
+//  @receiver x
+//  @param seq
+//  @return []RangeTombstone
+//
+func (x *RangeIndex) RangesAt(seq uint64) []RangeTombstone {
+	return RangesAt(x.ranges, seq)
+}
+
+//
+// Covering
+//  @Description: 找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记
+//  @receiver x
+//  @param key
+//  @param seq
+//  @param at
+//  @return RangeTombstone
+//  @return bool
+//
+func (x *RangeIndex) Covering(key string, seq uint64, at uint64) (RangeTombstone, bool) {
+	i := x.search(key)
+	if i < 0 || !x.before(key, x.fragments[i].end) {
+		return RangeTombstone{}, false
+	}
+	// 片段内的标记都覆盖key, 最新的可见标记遮不住时更旧的也遮不住
+	for _, r := range x.fragments[i].ranges {
+		if r.Seq <= at {
+			if r.Seq > seq {
+				return r, true
+			}
+			break
+		}
+	}
+	return RangeTombstone{}, false
+}
+
+//
+// RangesAt
+//  @Description: 返回ranges中对序列号seq可见的范围删除标记
+//  @param ranges
+//  @param seq
+//  @return []RangeTombstone
+//
+func RangesAt(ranges []RangeTombstone, seq uint64) []RangeTombstone {
+	visible := make([]RangeTombstone, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Seq <= seq {
+			visible = append(visible, r)
+		}
+	}
+	return visible
+}
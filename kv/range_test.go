@@ -0,0 +1,114 @@
+package kv
+
+import (
+	"math/rand"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 11:11
+ * @Func:
+ **/
+
+func TestRangeIndexCovering(t *testing.T) {
+	type lookup struct {
+		key     string
+		seq, at uint64
+		want    uint64 // 遮住key的最新标记的序列号, 0表示没有被遮住
+	}
+	for _, tt := range []struct {
+		cmp     Comparator
+		ranges  []RangeTombstone
+		lookups []lookup
+	}{
+		{Bytewise, []RangeTombstone{
+			{Start: "m", End: "", Seq: 9},
+			{Start: "c", End: "f", Seq: 5},
+			{Start: "", End: "b", Seq: 7},
+			{Start: "a", End: "e", Seq: 3},
+		}, []lookup{
+			{"d", 1, MaxSeq, 5},
+			{"d", 1, 4, 3},
+			{"d", 1, 2, 0},
+			{"d", 6, MaxSeq, 0},
+			{"a", 1, MaxSeq, 7},
+			{"z", 1, MaxSeq, 9},
+			{"g", 1, MaxSeq, 0},
+		}},
+		{Reverse, []RangeTombstone{
+			{Start: "m", End: "", Seq: 2},
+			{Start: "f", End: "c", Seq: 5},
+			{Start: "", End: "x", Seq: 7},
+			{Start: "e", End: "a", Seq: 3},
+		}, []lookup{
+			{"d", 1, MaxSeq, 5},
+			{"d", 1, 4, 3},
+			{"d", 1, 2, 2},
+			{"b", 1, MaxSeq, 3},
+			{"z", 1, MaxSeq, 7},
+			{"p", 1, MaxSeq, 0},
+		}},
+	} {
+		x := NewRangeIndex(tt.cmp, nil)
+		for _, r := range tt.ranges {
+			x.Add(r)
+		}
+		for _, c := range tt.lookups {
+			r, ok := x.Covering(c.key, c.seq, c.at)
+			if ok != (c.want > 0) || r.Seq != c.want {
+				t.Errorf("%T: covering %s@%d at %d got %+v %v, want seq %d", tt.cmp, c.key, c.seq, c.at, r, ok, c.want)
+			}
+		}
+		// 一次建立和逐个插入得到同样的结果
+		sorted := NewRangeIndex(tt.cmp, tt.ranges)
+		for _, c := range tt.lookups {
+			want, _ := x.Covering(c.key, c.seq, c.at)
+			if r, _ := sorted.Covering(c.key, c.seq, c.at); r != want {
+				t.Errorf("%T: covering %s@%d at %d got %+v, want %+v", tt.cmp, c.key, c.seq, c.at, r, want)
+			}
+		}
+	}
+}
+
+func TestRangeIndexFragments(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bound := func() string {
+		if rnd.Intn(8) == 0 {
+			return ""
+		}
+		return string(rune('a' + rnd.Intn(20)))
+	}
+	for _, cmp := range []Comparator{Bytewise, Reverse} {
+		for round := 0; round < 200; round++ {
+			var ranges []RangeTombstone
+			x := NewRangeIndex(cmp, nil)
+			for i := rnd.Intn(12); i > 0; i-- {
+				r := RangeTombstone{Start: bound(), End: bound(), Seq: uint64(rnd.Intn(30) + 1)}
+				ranges = append(ranges, r)
+				x.Add(r)
+			}
+			built := NewRangeIndex(cmp, ranges)
+			for k := 'a' - 1; k <= 'a'+20; k++ {
+				key := string(k)
+				for seq := uint64(0); seq <= 31; seq += 3 {
+					for _, at := range []uint64{5, 17, MaxSeq} {
+						// 逐个检查所有标记, 得到遮住key的最新的可见标记
+						var want RangeTombstone
+						for _, r := range ranges {
+							if r.Seq <= at && r.Covers(cmp, key, seq) && r.Seq > want.Seq {
+								want = r
+							}
+						}
+						for _, idx := range []*RangeIndex{&x, &built} {
+							r, ok := idx.Covering(key, seq, at)
+							if ok != (want.Seq > 0) || r.Seq != want.Seq || !ok && r != want {
+								t.Fatalf("%T: %+v covering %s@%d at %d got %+v %v, want %+v", cmp, ranges, key, seq, at, r, ok, want)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
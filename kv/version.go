@@ -0,0 +1,55 @@
+package kv
+
+import "math"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:14
+ * @Func: 多版本和快照相关的辅助函数
+ **/
+
+// MaxSeq 不属于任何快照的读操作使用的序列号, 可以看到所有版本
+const MaxSeq uint64 = math.MaxUint64
+
+//
+// RetainVersions
+//  @Description: 同一个key的多个版本中, 去掉所有快照都不会再看到的旧版本;
+//  最新版本总是保留, 旧版本只有是某个快照能看到的最新版本, 或者紧跟在一个保留下来的合并操作数后面时才保留
+//  @param versions	同一个key的所有版本, 从新到旧排列
+//  @param snapshots	存活的快照序列号, 升序排列
+//  @return []Value
+//
+func RetainVersions(versions []Value, snapshots []uint64) []Value {
+	if len(versions) <= 1 {
+		return versions
+	}
+	retained := versions[:1:1]
+	// 保留下来的合并操作数需要更旧的版本才能算出值
+	needed := versions[0].Merge
+	for i := 1; i < len(versions); i++ {
+		// 快照S看到的是 Seq <= S 的最新版本, 所以versions[i]对 [versions[i].Seq, versions[i-1].Seq) 内的快照可见
+		keep := needed || Visible(snapshots, versions[i].Seq, versions[i-1].Seq)
+		if keep {
+			retained = append(retained, versions[i])
+		}
+		needed = keep && versions[i].Merge
+	}
+	return retained
+}
+
+//
+// Visible
+//  @Description: 判断是否有快照的序列号落在[low, high)内
+//  @param snapshots
+//  @param low
+//  @param high
+//  @return bool
+//
+func Visible(snapshots []uint64, low uint64, high uint64) bool {
+	for _, snapshot := range snapshots {
+		if snapshot >= low && snapshot < high {
+			return true
+		}
+	}
+	return false
+}
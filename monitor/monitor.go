@@ -1,7 +1,6 @@
 package monitor
 
 import (
-	"github.com/ygzhang-yolo/lsmtree/config"
 	"github.com/ygzhang-yolo/lsmtree/db"
 	"log"
 	"time"
@@ -13,29 +12,66 @@ import (
  * @Func:
  **/
 
-func Monitor() {
-	cfg := config.GetConfig()
-	ticker := time.Tick(time.Duration(cfg.CheckInterval) * time.Second)
-	for _ = range ticker {
+//
+// Monitor
+//  @Description: 后台监视协程, 周期性检查数据库d每个列族的内存表和SSTable, 内存表写满时也会马上检查;
+//  stop被关闭时退出
+//  @param d
+//  @param stop
+//
+func Monitor(d *db.Database, stop <-chan struct{}) {
+	cfg := d.Config()
+	// 没有配置检查间隔时不做周期性检查, 只处理内存表写满的通知
+	var tick <-chan time.Time
+	if cfg.CheckInterval > 0 {
+		ticker := time.NewTicker(time.Duration(cfg.CheckInterval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			log.Println("Monitor stopped")
+			return
+		case <-tick:
+			check(d)
+		case <-d.FlushRequests():
+			check(d)
+		}
+	}
+}
+
+//
+// check
+//  @Description: 每个列族按自己的配置检查内存表和SSTable
+//  @param d
+//
+func check(d *db.Database) {
+	for _, cf := range d.Families() {
 		// 检查内存表是否超出大小限制, 需要落盘生成SSTable
-		CheckMemory()
+		if err := CheckMemory(cf); err != nil {
+			log.Println("Failed to flush the memory table: ", err)
+		}
 		// 检查数据文件是否过大, 需要压缩compaction
-		db.DB.SSTableTree.Check()
+		if err := cf.Compact(); err != nil {
+			log.Println("Failed to compact the SSTable files: ", err)
+		}
 	}
 }
 
-func CheckMemory() {
-	cfg := config.GetConfig()
-	// 检查内存表大小是否超过限制
-	count := db.DB.MemoryTree.GetCount()
-	if count < cfg.Threshold {
-		return
+//
+// CheckMemory
+//  @Description: 检查数据库(或者列族)d的内存表大小, 有等待落盘的不可变内存表, 估算的字节数超过WriteBufferSize,
+//  或者配置了Threshold且kv数量超过它时落盘为SSTable
+//  @param d
+//  @return error
+//
+func CheckMemory(d *db.Database) error {
+	// 检查内存表大小是否超过限制, 数量限制是可选的
+	if d.Immutables() == 0 && !d.MemTableFull() {
+		return nil
 	}
 	// 内存表过大, 需要转为SSTable存储
 	log.Println("Compressing memory")
-	tmpTree := db.DB.MemoryTree.Swap()
-
-	// 将内存表存储到 SsTable 中
-	db.DB.SSTableTree.CreateTableInLevel(tmpTree.GetKV())
-	db.DB.Wal.Reset()
+	return d.Flush()
 }
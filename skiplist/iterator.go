@@ -0,0 +1,129 @@
+package skiplist
+
+import "github.com/ygzhang-yolo/lsmtree/kv"
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:57
+ * @Func: 跳表的有序迭代器, 不加锁, 和写入并发进行
+ **/
+
+//
+//  Iterator
+//  @Description: 双向遍历跳表中[start, end)内对序列号seq可见的版本; 只使用创建时的头节点,
+//  之后Swap出去的数据仍然可以遍历完, 序列号比seq新的写入不可见
+//
+type Iterator struct {
+	list  *SkipList
+	head  *node
+	start string // 为空表示没有下界
+	end   string // 为空表示没有上界
+	seq   uint64
+	node  *node
+	value kv.Value // 当前节点对seq可见的版本
+}
+
+//
+// NewIterator
+//  @Description: 创建[start, end)内序列号seq时的迭代器, 初始位置在第一个元素
+//  @receiver s
+//  @param start
+//  @param end
+//  @param seq
+//  @return kv.Iterator
+//
+func (s *SkipList) NewIterator(start string, end string, seq uint64) kv.Iterator {
+	it := &Iterator{list: s, head: s.loadHead(), start: start, end: end, seq: seq}
+	it.SeekToFirst()
+	return it
+}
+
+func (it *Iterator) Seek(key string) {
+	if it.start != "" && it.list.compare(key, it.start) < 0 {
+		key = it.start
+	}
+	it.node = it.list.seek(it.head, key)
+	it.skip(false)
+}
+
+func (it *Iterator) SeekForPrev(key string) {
+	if it.end != "" && it.list.compare(key, it.end) >= 0 {
+		it.node = it.list.findLessThan(it.head, it.end)
+	} else if x := it.list.findGreaterOrEqual(it.head, key, nil); x != nil && it.list.compare(x.key, key) == 0 {
+		it.node = x
+	} else {
+		it.node = it.list.findLessThan(it.head, key)
+	}
+	it.skip(true)
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.start)
+}
+
+func (it *Iterator) SeekToLast() {
+	if it.end != "" {
+		it.node = it.list.findLessThan(it.head, it.end)
+	} else {
+		it.node = it.list.findLast(it.head)
+	}
+	it.skip(true)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *Iterator) Next() {
+	it.node = it.node.loadNext(0)
+	it.skip(false)
+}
+
+func (it *Iterator) Prev() {
+	it.node = it.list.findLessThan(it.head, it.node.key)
+	it.skip(true)
+}
+
+//
+// skip
+//  @Description: 沿遍历方向跳过没有可见版本的节点, 超出范围时迭代器失效
+//  @receiver it
+//  @param reverse
+//
+func (it *Iterator) skip(reverse bool) {
+	for it.node != nil && it.node != it.head {
+		if reverse && it.start != "" && it.list.compare(it.node.key, it.start) < 0 {
+			break
+		}
+		if !reverse && it.end != "" && it.list.compare(it.node.key, it.end) >= 0 {
+			break
+		}
+		if value, ok := it.node.visible(it.seq); ok {
+			it.value = value
+			return
+		}
+		if reverse {
+			it.node = it.list.findLessThan(it.head, it.node.key)
+		} else {
+			it.node = it.node.loadNext(0)
+		}
+	}
+	it.node = nil
+}
+
+func (it *Iterator) Key() string {
+	return it.node.key
+}
+
+func (it *Iterator) Value() kv.Value {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return nil
+}
+
+func (it *Iterator) Close() error {
+	it.node = nil
+	return nil
+}
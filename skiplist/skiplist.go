@@ -0,0 +1,537 @@
+package skiplist
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:57
+ * @Func: 跳表实现的内存表, 写入互斥, 读取不加锁
+ **/
+
+const (
+	maxHeight = 12 // 最大层数, 每层的节点数约为下一层的1/4, 足够容纳千万级的key
+	branching = 4
+)
+
+//
+//  node
+//  @Description: 跳表节点, 一个key对应一个节点; 节点的链接和版本列表都是原子替换的, 读取不需要加锁
+//
+type node struct {
+	key      string
+	versions unsafe.Pointer   // *[]kv.Value, 从新到旧排列, 每次写入整体替换
+	next     []unsafe.Pointer // 每一层的下一个节点, *node
+}
+
+func newNode(key string, height int) *node {
+	return &node{key: key, next: make([]unsafe.Pointer, height)}
+}
+
+func (n *node) loadNext(level int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *node) storeNext(level int, next *node) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *node) loadVersions() []kv.Value {
+	return *(*[]kv.Value)(atomic.LoadPointer(&n.versions))
+}
+
+func (n *node) storeVersions(versions []kv.Value) {
+	atomic.StorePointer(&n.versions, unsafe.Pointer(&versions))
+}
+
+//
+// visible
+//  @Description: 返回节点中对序列号seq可见的最新版本
+//  @receiver n
+//  @param seq
+//  @return kv.Value
+//  @return bool
+//
+func (n *node) visible(seq uint64) (kv.Value, bool) {
+	for _, value := range n.loadVersions() {
+		if value.Seq <= seq {
+			return value, true
+		}
+	}
+	return kv.Value{}, false
+}
+
+//
+//  SkipList
+//  @Description: 跳表实现的内存表; 写入由mu互斥, 读取和迭代器不加锁, 顺序写入也不会退化
+//
+type SkipList struct {
+	count   int64  // 未删除的key的数量, 原子读写
+	entries int64  // key(包括只有删除标记的)和范围删除标记的数量, 原子读写
+	size    int64  // 估算占用的内存字节数, 包括节点和版本的开销, 原子读写
+	maxSeq  uint64 // 最大的序列号, 原子读写
+	height  int32  // 当前使用的层数, 原子读写
+
+	head unsafe.Pointer // 头节点*node, Swap时整体替换
+	cmp  kv.Comparator  // key的比较器
+	mu   sync.Mutex     // 写入互斥
+	rnd  *rand.Rand     // 随机层数, 由mu保护
+
+	rangeMu sync.RWMutex
+	ranges  kv.RangeIndex // 范围删除标记, 按Start排列
+}
+
+//
+// New
+//  @Description: 创建一个按cmp排列key的跳表内存表
+//  @param cmp
+//  @return kv.MemTable
+//
+func New(cmp kv.Comparator) kv.MemTable {
+	return NewSkipList(cmp)
+}
+
+//
+// NewSkipList
+//  @Description: 创建一个按cmp排列key的空跳表
+//  @param cmp
+//  @return *SkipList
+//
+func NewSkipList(cmp kv.Comparator) *SkipList {
+	return &SkipList{
+		height: 1,
+		head:   unsafe.Pointer(newNode("", maxHeight)),
+		cmp:    cmp,
+		ranges: kv.NewRangeIndex(cmp, nil),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *SkipList) loadHead() *node {
+	return (*node)(atomic.LoadPointer(&s.head))
+}
+
+func (s *SkipList) compare(a string, b string) int {
+	return kv.CompareKeys(s.cmp, a, b)
+}
+
+//
+// findGreaterOrEqual
+//  @Description: 找到第一个 >= key 的节点, 没有时返回nil; prev不为空时记录每一层最后一个 < key 的节点
+//  @receiver s
+//  @param head
+//  @param key
+//  @param prev
+//  @return *node
+//
+func (s *SkipList) findGreaterOrEqual(head *node, key string, prev []*node) *node {
+	x := head
+	level := int(atomic.LoadInt32(&s.height)) - 1
+	for {
+		next := x.loadNext(level)
+		if next != nil && s.compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+//
+// seek
+//  @Description: 定位到第一个不小于start的节点, start为空表示没有下界; 非字节序的比较器下空串不一定最小
+//  @receiver s
+//  @param head
+//  @param start
+//  @return *node
+//
+func (s *SkipList) seek(head *node, start string) *node {
+	if start == "" {
+		return head.loadNext(0)
+	}
+	return s.findGreaterOrEqual(head, start, nil)
+}
+
+//
+// findLessThan
+//  @Description: 找到最后一个 < key 的节点, 没有时返回头节点
+//  @receiver s
+//  @param head
+//  @param key
+//  @return *node
+//
+func (s *SkipList) findLessThan(head *node, key string) *node {
+	x := head
+	level := int(atomic.LoadInt32(&s.height)) - 1
+	for {
+		next := x.loadNext(level)
+		if next != nil && s.compare(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+//
+// findLast
+//  @Description: 找到最后一个节点, 跳表为空时返回头节点
+//  @receiver s
+//  @param head
+//  @return *node
+//
+func (s *SkipList) findLast(head *node) *node {
+	x := head
+	level := int(atomic.LoadInt32(&s.height)) - 1
+	for {
+		if next := x.loadNext(level); next != nil {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+//
+// find
+//  @Description: 找到key对应的节点, 没有时返回nil
+//  @receiver s
+//  @param key
+//  @return *node
+//
+func (s *SkipList) find(key string) *node {
+	x := s.findGreaterOrEqual(s.loadHead(), key, nil)
+	if x == nil || s.compare(x.key, key) != 0 {
+		return nil
+	}
+	return x
+}
+
+func (s *SkipList) Get(key string) (kv.Value, kv.SearchResult) {
+	return s.GetAt(key, kv.MaxSeq)
+}
+
+//
+// GetAt
+//  @Description: 查找key在序列号seq时的值, 即 Seq <= seq 的最新版本
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//
+func (s *SkipList) GetAt(key string, seq uint64) (kv.Value, kv.SearchResult) {
+	x := s.find(key)
+	if x == nil {
+		return kv.Value{}, kv.None
+	}
+	value, ok := x.visible(seq)
+	switch {
+	case !ok:
+		return kv.Value{}, kv.None
+	case value.Deleted:
+		return value, kv.Deleted
+	case value.Merge:
+		return value, kv.MergeOperand
+	}
+	return value, kv.Success
+}
+
+//
+// GetChainAt
+//  @Description: 返回key在序列号seq时需要合并的一串版本, 从新到旧排列, 到第一个不是合并操作数的版本为止
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return []kv.Value
+//
+func (s *SkipList) GetChainAt(key string, seq uint64) []kv.Value {
+	chain := make([]kv.Value, 0)
+	x := s.find(key)
+	if x == nil {
+		return chain
+	}
+	for _, value := range x.loadVersions() {
+		if value.Seq > seq {
+			continue
+		}
+		chain = append(chain, value)
+		if !value.Merge {
+			break
+		}
+	}
+	return chain
+}
+
+func (s *SkipList) Set(key string, value []byte) (kv.Value, bool) {
+	return s.Put(kv.Value{Key: key, Value: value}, 0)
+}
+
+func (s *SkipList) Delete(key string) (kv.Value, bool) {
+	return s.Put(kv.Value{Key: key, Deleted: true}, 0)
+}
+
+//
+// Put
+//  @Description: 写入一个版本并返回旧值; 保留哪些旧版本见 kv.KeepVersions, 写入之前已经发布的版本总是保留
+//  @receiver s
+//  @param value
+//  @param retain	最新的存活快照的序列号, 没有快照时为0
+//  @return kv.Value	旧值
+//  @return bool	是否有未删除的旧值
+//
+func (s *SkipList) Put(value kv.Value, retain uint64) (kv.Value, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(value, retain, kv.PublishedBefore(value.Seq))
+}
+
+//
+// PutBatch
+//  @Description: 依次写入values; 跳表的读取不加锁, 写入过程中的读取可能只看到一部分,
+//  需要原子性的调用方要在写入完成后再发布序列号
+//  @receiver s
+//  @param values
+//  @param retain
+//
+func (s *SkipList) PutBatch(values []kv.Value, retain uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(values) == 0 {
+		return
+	}
+	// 整批写完之后才发布序列号, 读取一直停在第一条之前
+	floor := kv.PublishedBefore(values[0].Seq)
+	for _, value := range values {
+		s.put(value, retain, floor)
+	}
+}
+
+func (s *SkipList) put(value kv.Value, retain uint64, floor uint64) (kv.Value, bool) {
+	if value.Seq > atomic.LoadUint64(&s.maxSeq) {
+		atomic.StoreUint64(&s.maxSeq, value.Seq)
+	}
+	head := s.loadHead()
+	var prev [maxHeight]*node
+	x := s.findGreaterOrEqual(head, value.Key, prev[:])
+	if x != nil && s.compare(x.key, value.Key) == 0 {
+		// key已经存在, 复制一份新的版本列表再整体替换, 正在读取的协程看到的旧列表不受影响
+		versions := x.loadVersions()
+		old := versions[0]
+		kept, dropped := kv.KeepVersions(value, versions, retain, floor)
+		x.storeVersions(append([]kv.Value{value}, kept...))
+		for _, v := range dropped {
+			atomic.AddInt64(&s.size, -kv.VersionSize(v))
+		}
+		atomic.AddInt64(&s.size, kv.VersionSize(value))
+		if old.Deleted && !value.Deleted {
+			atomic.AddInt64(&s.count, 1)
+		} else if !old.Deleted && value.Deleted {
+			atomic.AddInt64(&s.count, -1)
+		}
+		if old.Deleted {
+			return kv.Value{}, false
+		}
+		return old, true
+	}
+
+	// key不存在, 插入新节点; 删除不存在的key也会插入一个删除节点
+	height := s.randomHeight()
+	if current := int(atomic.LoadInt32(&s.height)); height > current {
+		for i := current; i < height; i++ {
+			prev[i] = head
+		}
+		atomic.StoreInt32(&s.height, int32(height))
+	}
+	n := newNode(value.Key, height)
+	n.storeVersions([]kv.Value{value})
+	// 从下往上链接, 读取的协程在任意时刻看到的都是一个有序的跳表
+	for i := 0; i < height; i++ {
+		n.storeNext(i, prev[i].loadNext(i))
+		prev[i].storeNext(i, n)
+	}
+	atomic.AddInt64(&s.size, nodeSize(value.Key, height)+kv.VersionSize(value))
+	atomic.AddInt64(&s.entries, 1)
+	if !value.Deleted {
+		atomic.AddInt64(&s.count, 1)
+	}
+	return kv.Value{}, false
+}
+
+//
+// randomHeight
+//  @Description: 随机生成新节点的层数, 调用方需要持有s.mu
+//  @receiver s
+//  @return int
+//
+func (s *SkipList) randomHeight() int {
+	height := 1
+	for height < maxHeight && s.rnd.Intn(branching) == 0 {
+		height++
+	}
+	return height
+}
+
+//
+// entrySize
+//  @Description: 一个版本的数据字节数, 按key和值的长度计算, 用于估算范围内的数据大小
+//  @param value
+//  @return int64
+//
+func entrySize(value kv.Value) int64 {
+	return int64(len(value.Key) + len(value.Value))
+}
+
+//
+// nodeSize
+//  @Description: 一个高度为height的节点和它的key大约占用的字节数, 不包括版本
+//  @param key
+//  @param height
+//  @return int64
+//
+func nodeSize(key string, height int) int64 {
+	pointers := uintptr(height) * unsafe.Sizeof(unsafe.Pointer(nil))
+	return int64(unsafe.Sizeof(node{})+pointers+unsafe.Sizeof([]kv.Value{})) + int64(len(key))
+}
+
+//
+// PutRange
+//  @Description: 写入一个范围删除标记, 跳表中被它遮住的版本不会修改, 读取时再判断
+//  @receiver s
+//  @param r
+//
+func (s *SkipList) PutRange(r kv.RangeTombstone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Seq > atomic.LoadUint64(&s.maxSeq) {
+		atomic.StoreUint64(&s.maxSeq, r.Seq)
+	}
+	s.rangeMu.Lock()
+	s.ranges.Add(r)
+	s.rangeMu.Unlock()
+	atomic.AddInt64(&s.entries, 1)
+	atomic.AddInt64(&s.size, kv.RangeSize(r))
+}
+
+func (s *SkipList) RangesAt(seq uint64) []kv.RangeTombstone {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+	return s.ranges.RangesAt(seq)
+}
+
+//
+// Covering
+//  @Description: 找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记
+//  @receiver s
+//  @param key
+//  @param seq
+//  @param at
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (s *SkipList) Covering(key string, seq uint64, at uint64) (kv.RangeTombstone, bool) {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+	return s.ranges.Covering(key, seq, at)
+}
+
+//
+// GetVersions
+//  @Description: 按key升序返回所有版本, 同一个key从新到旧排列
+//  @receiver s
+//  @return []kv.Value
+//
+func (s *SkipList) GetVersions() []kv.Value {
+	values := make([]kv.Value, 0, atomic.LoadInt64(&s.count))
+	for x := s.loadHead().loadNext(0); x != nil; x = x.loadNext(0) {
+		values = append(values, x.loadVersions()...)
+	}
+	return values
+}
+
+//
+// ApproximateRange
+//  @Description: 估算key在[start, end)内的数据大小和key数量, 包括删除标记和为快照保留的旧版本
+//  @receiver s
+//  @param start
+//  @param end
+//  @return int64
+//  @return int
+//
+func (s *SkipList) ApproximateRange(start string, end string) (int64, int) {
+	var size int64
+	count := 0
+	for x := s.seek(s.loadHead(), start); x != nil; x = x.loadNext(0) {
+		if end != "" && s.compare(x.key, end) >= 0 {
+			break
+		}
+		count++
+		for _, value := range x.loadVersions() {
+			size += entrySize(value)
+		}
+	}
+	return size, count
+}
+
+func (s *SkipList) ApproximateSize() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+func (s *SkipList) GetCount() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+func (s *SkipList) Entries() int {
+	return int(atomic.LoadInt64(&s.entries))
+}
+
+func (s *SkipList) MaxSeq() uint64 {
+	return atomic.LoadUint64(&s.maxSeq)
+}
+
+func (s *SkipList) Empty() bool {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+	return s.loadHead().loadNext(0) == nil && s.ranges.Len() == 0
+}
+
+//
+// Swap
+//  @Description: 清空跳表, 返回一个包含原有数据的跳表; 已经开始的读取和迭代器继续使用原有的节点
+//  @receiver s
+//  @return kv.MemTable
+//
+func (s *SkipList) Swap() kv.MemTable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+	old := NewSkipList(s.cmp)
+	old.count, old.entries, old.size, old.maxSeq = s.count, s.entries, s.size, s.maxSeq
+	old.height, old.head, old.ranges = s.height, s.head, s.ranges
+	atomic.StorePointer(&s.head, unsafe.Pointer(newNode("", maxHeight)))
+	atomic.StoreInt32(&s.height, 1)
+	atomic.StoreInt64(&s.count, 0)
+	atomic.StoreInt64(&s.entries, 0)
+	atomic.StoreInt64(&s.size, 0)
+	s.ranges = kv.NewRangeIndex(s.cmp, nil)
+	return old
+}
@@ -0,0 +1,185 @@
+package skiplist
+
+import (
+	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:57
+ * @Func:
+ **/
+
+func TestSkipList(t *testing.T) {
+	list := NewSkipList(kv.Bytewise)
+	if _, hasOld := list.Set("a", []byte{1}); hasOld {
+		t.Error("set a new key")
+	}
+	old, hasOld := list.Set("a", []byte{2})
+	if !hasOld || !reflect.DeepEqual(old.Value, []byte{1}) {
+		t.Error(old, hasOld)
+	}
+	list.Set("c", []byte{3})
+	list.Set("b", []byte{2})
+	if count := list.GetCount(); count != 3 {
+		t.Error(count)
+	}
+	list.Delete("a")
+	list.Delete("a")
+	if count := list.GetCount(); count != 2 {
+		t.Error(count)
+	}
+	// 按数量落盘时删除标记也算一个条目
+	list.Delete("z")
+	if entries := list.Entries(); entries != 4 {
+		t.Error("entries", entries)
+	}
+	if _, result := list.Get("a"); result != kv.Deleted {
+		t.Error(result)
+	}
+	if value, result := list.Get("b"); result != kv.Success || !reflect.DeepEqual(value.Value, []byte{2}) {
+		t.Error(value, result)
+	}
+	if _, result := list.Get("d"); result != kv.None {
+		t.Error(result)
+	}
+
+	// 估算的内存包括节点和版本的开销, 覆盖写入不保留旧版本时大小不变
+	size := list.ApproximateSize()
+	if size <= 3 {
+		t.Error("size", size)
+	}
+	list.Set("c", []byte{4})
+	if list.ApproximateSize() != size {
+		t.Error("size after overwrite", list.ApproximateSize(), size)
+	}
+
+	old2 := list.Swap()
+	if list.ApproximateSize() != 0 || old2.ApproximateSize() != size {
+		t.Error("size after swap", list.ApproximateSize(), old2.ApproximateSize())
+	}
+	if !list.Empty() || list.GetCount() != 0 || old2.GetCount() != 2 {
+		t.Error("swap", list.GetCount(), old2.GetCount())
+	}
+	if _, result := old2.Get("c"); result != kv.Success {
+		t.Error(result)
+	}
+}
+
+func TestSkipListVersions(t *testing.T) {
+	list := NewSkipList(kv.Bytewise)
+	list.Put(kv.Value{Key: "a", Value: []byte("1"), Seq: 1}, 0)
+	list.Put(kv.Value{Key: "a", Value: []byte("2"), Seq: 2}, 1)
+	list.Put(kv.Value{Key: "a", Value: []byte("3"), Seq: 3}, 1)
+	versions := func() []uint64 {
+		var seqs []uint64
+		for _, value := range list.GetVersions() {
+			seqs = append(seqs, value.Seq)
+		}
+		return seqs
+	}
+	// 序列号3发布之前读取停在2上, 版本2还要保留
+	if seqs := versions(); !reflect.DeepEqual(seqs, []uint64{3, 2, 1}) {
+		t.Error(seqs)
+	}
+	// 快照1之后的旧版本2不再需要, 版本1保留
+	list.Put(kv.Value{Key: "a", Value: []byte("4"), Seq: 4}, 1)
+	if seqs := versions(); !reflect.DeepEqual(seqs, []uint64{4, 3, 1}) {
+		t.Error(seqs)
+	}
+	if value, _ := list.GetAt("a", 2); string(value.Value) != "1" {
+		t.Error(string(value.Value))
+	}
+	if _, result := list.GetAt("a", 0); result != kv.None {
+		t.Error(result)
+	}
+	if list.MaxSeq() != 4 {
+		t.Error(list.MaxSeq())
+	}
+
+	list.Put(kv.Value{Key: "a", Value: []byte("+5"), Merge: true, Seq: 5}, 0)
+	if chain := list.GetChainAt("a", kv.MaxSeq); len(chain) != 2 || !chain[0].Merge {
+		t.Error(chain)
+	}
+}
+
+func TestSkipListIterator(t *testing.T) {
+	for _, tt := range []struct {
+		cmp  kv.Comparator
+		want []string
+	}{
+		{kv.Bytewise, []string{"k00", "k01", "k02", "k03", "k04", "k05", "k06", "k07", "k08", "k09"}},
+		{kv.Reverse, []string{"k09", "k08", "k07", "k06", "k05", "k04", "k03", "k02", "k01", "k00"}},
+	} {
+		list := NewSkipList(tt.cmp)
+		// 顺序写入, 第一个key的新版本对seq 10不可见
+		for i := 0; i < 10; i++ {
+			list.Put(kv.Value{Key: fmt.Sprintf("k%02d", i), Value: []byte{byte(i)}, Seq: uint64(i + 1)}, 0)
+		}
+		list.Put(kv.Value{Key: tt.want[0], Deleted: true, Seq: 11}, 10)
+
+		var keys []string
+		for it := list.NewIterator("", "", 10); it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if !reflect.DeepEqual(keys, tt.want) {
+			t.Errorf("%s: scan %v", tt.cmp.Name(), keys)
+		}
+
+		keys = nil
+		it := list.NewIterator(tt.want[2], tt.want[5], kv.MaxSeq)
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			keys = append(keys, it.Key())
+		}
+		if !reflect.DeepEqual(keys, []string{tt.want[4], tt.want[3], tt.want[2]}) {
+			t.Errorf("%s: reverse scan %v", tt.cmp.Name(), keys)
+		}
+		if it.Seek(tt.want[1]); !it.Valid() || it.Key() != tt.want[2] {
+			t.Errorf("%s: seek below start", tt.cmp.Name())
+		}
+		if it.SeekForPrev(tt.want[9]); !it.Valid() || it.Key() != tt.want[4] {
+			t.Errorf("%s: seek for prev above end", tt.cmp.Name())
+		}
+		if _, count := list.ApproximateRange("", tt.want[5]); count != 5 {
+			t.Errorf("%s: approximate count %d", tt.cmp.Name(), count)
+		}
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+	list := NewSkipList(kv.Bytewise)
+	const n = 2000
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			list.Put(kv.Value{Key: fmt.Sprintf("%05d", i), Value: []byte{1}, Seq: uint64(i + 1)}, 0)
+		}
+	}()
+	// 读取不加锁, 迭代器看到的key始终有序
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				prev := ""
+				for it := list.NewIterator("", "", kv.MaxSeq); it.Valid(); it.Next() {
+					if it.Key() <= prev {
+						t.Errorf("out of order %s after %s", it.Key(), prev)
+						return
+					}
+					prev = it.Key()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if count := list.GetCount(); count != n {
+		t.Error(count)
+	}
+}
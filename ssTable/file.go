@@ -3,9 +3,9 @@ package ssTable
 import (
 	"encoding/binary"
 	"encoding/json"
-	"log"
+	"github.com/ygzhang-yolo/lsmtree/kv"
 	"os"
-	"sort"
+	"sync/atomic"
 )
 
 /**
@@ -14,139 +14,332 @@ import (
  * @Func: 与磁盘文件file交互的功能
  **/
 
+const metaDataSize = 8 * 5 // 元数据区的大小, 5个int64
+
+const (
+	tableVersion  = 1 // 当前写入的文件格式版本: 稀疏索引记录一个key的所有版本, 元数据之前是范围删除区
+	legacyVersion = 0 // 最早的文件格式: 每个key只有一个版本, 没有范围删除区
+)
+
 //
 // writeDataToFile
 //  @Description: 创建SSTable用于将SSTable中的数据,索引,元数据等信息落盘
 //  @param path
 //  @param data
 //  @param index
+//  @param ranges
 //  @param meta
+//  @return error
 //
-func writeDataToFile(path string, data []byte, index []byte, meta MetaData) {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+func writeDataToFile(path string, data []byte, index []byte, ranges []byte, meta MetaData) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		log.Fatal("Fail to create file, ", path, err)
+		return kv.IOError("create file", path, err)
+	}
+	// 出错时关闭并删除写了一半的文件
+	fail := func(op string, err error) error {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return kv.IOError(op, path, err)
 	}
 	if _, err = f.Write(data); err != nil {
-		log.Fatal("Fail to write data to file", path, err)
+		return fail("write data to file", err)
 	}
 	if _, err = f.Write(index); err != nil {
-		log.Fatal("Fail to write index to file", path, err)
+		return fail("write index to file", err)
+	}
+	if _, err = f.Write(ranges); err != nil {
+		return fail("write range tombstones to file", err)
 	}
 	// 写入元数据到文件末尾
 	// NOTE: 右侧必须能够识别字节长度的类型，不能使用 int 这种类型，只能使用 int32、int64等
-	_ = binary.Write(f, binary.LittleEndian, &meta.Version)
-	_ = binary.Write(f, binary.LittleEndian, &meta.DataStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.DataLen)
-	_ = binary.Write(f, binary.LittleEndian, &meta.IndexStart)
-	_ = binary.Write(f, binary.LittleEndian, &meta.IndexLen)
+	if err = binary.Write(f, binary.LittleEndian, &meta); err != nil {
+		return fail("write metadata to file", err)
+	}
 	if err = f.Sync(); err != nil {
-		log.Fatal(" Fail to write index to file,", path, err)
+		return fail("sync file", err)
 	}
 	if err = f.Close(); err != nil {
-		log.Fatal(" Fail to close file,", path, err)
+		return kv.IOError("close file", path, err)
 	}
+	return nil
 }
 
-func (s *SSTable) loadFileHandler() {
+func (s *SSTable) loadFileHandler() error {
 	if s.F == nil {
 		// 如果文件句柄f为空, 则创建一个文件给它
 		f, err := os.OpenFile(s.Path, os.O_RDONLY, 0666)
 		if err != nil {
-			log.Println(" error open file ", s.Path)
-			panic(err)
+			return kv.IOError("open file", s.Path, err)
 		}
 		s.F = f
 	}
+	return nil
+}
+
+//
+// Close
+//  @Description: 关闭SSTable的文件句柄
+//  @receiver s
+//  @return error
+//
+func (s *SSTable) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.F == nil {
+		return nil
+	}
+	err := s.F.Close()
+	s.F = nil
+	if err != nil {
+		return kv.IOError("close file", s.Path, err)
+	}
+	return nil
+}
+
+//
+// Ref
+//  @Description: 增加一个引用, 保证在Unref之前文件不会被关闭和删除
+//  @receiver s
+//
+func (s *SSTable) Ref() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+//
+// Unref
+//  @Description: 释放一个引用, 引用归零时关闭文件, 如果已经被废弃还会删除文件
+//  @receiver s
+//  @return error
+//
+func (s *SSTable) Unref() error {
+	if atomic.AddInt32(&s.refs, -1) > 0 {
+		return nil
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	obsolete := s.obsolete
+	s.mu.Unlock()
+	if obsolete {
+		if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+			return kv.IOError("remove file", s.Path, err)
+		}
+	}
+	return nil
+}
+
+//
+// Obsolete
+//  @Description: 标记SSTable已经废弃并释放SSTableTree持有的引用, 没有迭代器在使用时立即删除文件
+//  @receiver s
+//  @return error
+//
+func (s *SSTable) Obsolete() error {
+	s.mu.Lock()
+	s.obsolete = true
+	s.mu.Unlock()
+	return s.Unref()
 }
 
 //
 // loadIndex
 //  @Description: 加载稀疏索引区到内存
 //  @receiver s
+//  @return error
 //
-func (s *SSTable) loadIndex() {
+func (s *SSTable) loadIndex() error {
 	// 根据meta.indexLen读取索引区
 	bytes := make([]byte, s.Meta.IndexLen)
-	if _, err := s.F.Seek(s.Meta.IndexStart, 0); err != nil {
-		log.Println(" error open file ", s.Path)
-		panic(err)
-	}
-	if _, err := s.F.Read(bytes); err != nil {
-		log.Println(" error open file ", s.Path)
-		panic(err)
+	if _, err := s.F.ReadAt(bytes, s.Meta.IndexStart); err != nil {
+		return kv.IOError("read index", s.Path, err)
 	}
 	// 反序列化到内存
-	s.Index = make(map[string]Position)
-	err := json.Unmarshal(bytes, &s.Index)
+	index, err := decodeIndex(bytes)
 	if err != nil {
-		log.Println(" error open file ", s.Path)
-		panic(err)
+		return kv.CorruptError(s.Path, "invalid index: %v", err)
 	}
-	_, _ = s.F.Seek(0, 0)
+	s.Index = index
 
 	// 反序列化有序的keys
 	keys := make([]string, 0, len(s.Index))
-	for k := range s.Index {
+	for k, pos := range s.Index {
+		for _, version := range append([]Position{pos}, pos.Versions...) {
+			if version.Start < s.Meta.DataStart || version.Len < 0 || version.Start+version.Len > s.Meta.DataStart+s.Meta.DataLen {
+				return kv.CorruptError(s.Path, "position of key %q out of data area", k)
+			}
+			if version.Seq > s.MaxSeq {
+				s.MaxSeq = version.Seq
+			}
+		}
 		keys = append(keys, k)
 	}
-	sort.Strings(keys)
+	sortKeys(keys, s.cmp)
 	s.Keys = keys
+	return nil
 }
 
 //
-// loadMetaData
-//  @Description: 加载meta, 就是把5个8字节的int64分别加载进来
-//  @receiver s
+//  indexEntry
+//  @Description: 稀疏索引区中的一项, key以[]byte保存, 可以包含任意字节
+//
+type indexEntry struct {
+	Key []byte
+	Position
+}
+
+//
+// encodeIndex
+//  @Description: 按keys的顺序序列化稀疏索引
+//  @param keys
+//  @param positions
+//  @return []byte
+//  @return error
 //
-func (s *SSTable) loadMetaData() {
-	f := s.F
-	if _, err := f.Seek(0, 0); err != nil {
-		log.Println(" error open file ", s.Path)
-		panic(err)
+func encodeIndex(keys []string, positions map[string]Position) ([]byte, error) {
+	entries := make([]indexEntry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, indexEntry{Key: []byte(key), Position: positions[key]})
 	}
+	return json.Marshal(entries)
+}
 
-	info, _ := f.Stat() //获取文件大小
-	if _, err := f.Seek(info.Size()-8*5, 0); err != nil {
-		log.Println("Error reading metadata version", s.Path)
-		panic(err)
+//
+// decodeIndex
+//  @Description: 反序列化稀疏索引, 兼容旧版本以JSON对象保存的索引
+//  @param data
+//  @return map[string]Position
+//  @return error
+//
+func decodeIndex(data []byte) (map[string]Position, error) {
+	index := make(map[string]Position)
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &index)
+		return index, err
+	}
+	var entries []indexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
 	}
-	_ = binary.Read(f, binary.LittleEndian, &s.Meta.Version) //先读版本号version
+	for _, entry := range entries {
+		index[string(entry.Key)] = entry.Position
+	}
+	return index, nil
+}
 
-	if _, err := f.Seek(info.Size()-8*4, 0); err != nil {
-		log.Println("Error reading metadata dataStart", s.Path)
-		panic(err)
+//
+//  rangeEntry
+//  @Description: 范围删除区中的一项, 边界以[]byte保存
+//
+type rangeEntry struct {
+	Start []byte
+	End   []byte `json:",omitempty"`
+	Seq   uint64
+}
+
+//
+// encodeRanges
+//  @Description: 序列化范围删除标记, 没有时范围删除区为空
+//  @param ranges
+//  @return []byte
+//  @return error
+//
+func encodeRanges(ranges []kv.RangeTombstone) ([]byte, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	entries := make([]rangeEntry, 0, len(ranges))
+	for _, r := range ranges {
+		entries = append(entries, rangeEntry{Start: []byte(r.Start), End: []byte(r.End), Seq: r.Seq})
 	}
-	_ = binary.Read(f, binary.LittleEndian, &s.Meta.DataStart) //再读dataStart
+	return json.Marshal(entries)
+}
 
-	if _, err := f.Seek(info.Size()-8*3, 0); err != nil {
-		log.Println("Error reading metadata dataLen", s.Path)
-		panic(err)
+//
+// loadRanges
+//  @Description: 加载稀疏索引区和元数据之间的范围删除区
+//  @receiver s
+//  @return error
+//
+func (s *SSTable) loadRanges() error {
+	if s.Meta.Version == legacyVersion {
+		return nil
+	}
+	info, err := s.F.Stat()
+	if err != nil {
+		return kv.IOError("stat file", s.Path, err)
+	}
+	start := s.Meta.IndexStart + s.Meta.IndexLen
+	length := info.Size() - metaDataSize - start
+	if length <= 0 {
+		return nil
+	}
+	bytes := make([]byte, length)
+	if _, err = s.F.ReadAt(bytes, start); err != nil {
+		return kv.IOError("read range tombstones", s.Path, err)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &s.Meta.DataLen) //再读dataLen
+	var entries []rangeEntry
+	if err = json.Unmarshal(bytes, &entries); err != nil {
+		return kv.CorruptError(s.Path, "invalid range tombstones: %v", err)
+	}
+	s.Ranges = make([]kv.RangeTombstone, 0, len(entries))
+	for _, entry := range entries {
+		s.Ranges = append(s.Ranges, kv.RangeTombstone{Start: string(entry.Start), End: string(entry.End), Seq: entry.Seq})
+		if entry.Seq > s.MaxSeq {
+			s.MaxSeq = entry.Seq
+		}
+	}
+	s.ranges = kv.NewRangeIndex(s.cmp, s.Ranges)
+	return nil
+}
 
-	if _, err := f.Seek(info.Size()-8*2, 0); err != nil {
-		log.Println("Error reading metadata indexStart", s.Path)
-		panic(err)
+//
+// loadMetaData
+//  @Description: 加载meta, 就是把文件末尾5个8字节的int64分别加载进来
+//  @receiver s
+//  @return error
+//
+func (s *SSTable) loadMetaData() error {
+	info, err := s.F.Stat() //获取文件大小
+	if err != nil {
+		return kv.IOError("stat file", s.Path, err)
+	}
+	size := info.Size()
+	s.size = size
+	if size < metaDataSize {
+		return kv.CorruptError(s.Path, "file size %d is smaller than metadata", size)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &s.Meta.IndexStart) //再读indexStart
+	bytes := make([]byte, metaDataSize)
+	if _, err = s.F.ReadAt(bytes, size-metaDataSize); err != nil {
+		return kv.IOError("read metadata", s.Path, err)
+	}
+	// 依次是 version, dataStart, dataLen, indexStart, indexLen
+	s.Meta.Version = int64(binary.LittleEndian.Uint64(bytes[0:]))
+	s.Meta.DataStart = int64(binary.LittleEndian.Uint64(bytes[8:]))
+	s.Meta.DataLen = int64(binary.LittleEndian.Uint64(bytes[16:]))
+	s.Meta.IndexStart = int64(binary.LittleEndian.Uint64(bytes[24:]))
+	s.Meta.IndexLen = int64(binary.LittleEndian.Uint64(bytes[32:]))
 
-	if _, err := f.Seek(info.Size()-8*1, 0); err != nil {
-		log.Println("Error reading metadata indexLen", s.Path)
-		panic(err)
+	if s.Meta.Version != tableVersion && s.Meta.Version != legacyVersion {
+		return kv.CorruptError(s.Path, "unknown table version %d", s.Meta.Version)
+	}
+	// 检查各个区域都在文件范围内
+	m := s.Meta
+	if m.DataStart < 0 || m.DataLen < 0 || m.IndexStart < 0 || m.IndexLen < 0 ||
+		m.DataStart+m.DataLen > size-metaDataSize || m.IndexStart+m.IndexLen > size-metaDataSize {
+		return kv.CorruptError(s.Path, "invalid metadata %+v", m)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &s.Meta.IndexLen) //再读indexLen
+	return nil
 }
 
 //
 // GetDbSize
-//  @Description: 获取SSTable的db文件大小
+//  @Description: 获取SSTable的db文件大小, SSTable写入后不再修改, 返回创建或加载时记录的大小
 //  @receiver s
+//  @return int64
+//  @return error
 //
-func (s *SSTable) GetDbSize() int64 {
-	info, err := os.Stat(s.Path)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return info.Size()
+func (s *SSTable) GetDbSize() (int64, error) {
+	return s.size, nil
 }
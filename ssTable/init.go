@@ -1,6 +1,9 @@
 package ssTable
 
-import "sync"
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"sync"
+)
 
 /**
  * @Author: ygzhang
@@ -13,15 +16,32 @@ import "sync"
 //  @Description: SSTable的加载函数
 //  @receiver s
 //  @param path
+//  @param cmp	key的比较器
+//  @return error
 //
-func (s *SSTable) Init(path string) {
+func (s *SSTable) Init(path string, cmp kv.Comparator) error {
 	s.Path = path
+	s.cmp = cmp
 	s.mu = &sync.Mutex{}
+	s.refs = 1
 	//从文件中加载SSTable对象
 
 	//从文件中加载SSTable 文件句柄
-	s.loadFileHandler()
-	// 加载SSTable剩下的两项, 稀疏索引和元数据
-	s.loadMetaData()
-	s.loadIndex()
+	if err := s.loadFileHandler(); err != nil {
+		return err
+	}
+	// 加载SSTable剩下的三项, 元数据, 稀疏索引和范围删除标记
+	if err := s.loadMetaData(); err != nil {
+		_ = s.Close()
+		return err
+	}
+	if err := s.loadIndex(); err != nil {
+		_ = s.Close()
+		return err
+	}
+	if err := s.loadRanges(); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,139 @@
+package ssTable
+
+import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
+	"sort"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 09:04
+ * @Func: SSTable的有序迭代器, 通过有序的Keys定位, 需要时才从磁盘读取数据
+ **/
+
+//
+//  Iterator
+//  @Description: 按key有序双向遍历一个SSTable, 持有SSTable的一个引用, 用完需要Close
+//
+type Iterator struct {
+	table *SSTable
+	seq   uint64    // 只能看到 Seq <= seq 的版本, 没有可见版本的key直接跳过
+	index int       // 当前在table.Keys中的下标
+	value *kv.Value // 当前元素的缓存, 第一次访问时从磁盘读取
+	err   error
+}
+
+//
+// NewIterator
+//  @Description: 创建SSTable在序列号seq时的迭代器, 初始位置在第一个key
+//  @receiver s
+//  @param seq
+//  @return *Iterator
+//
+func (s *SSTable) NewIterator(seq uint64) *Iterator {
+	s.Ref()
+	it := &Iterator{table: s, seq: seq}
+	it.skip(false)
+	return it
+}
+
+func (it *Iterator) Seek(key string) {
+	it.index = it.table.search(key)
+	it.skip(false)
+}
+
+func (it *Iterator) SeekForPrev(key string) {
+	keys := it.table.Keys
+	it.index = sort.Search(len(keys), func(i int) bool {
+		return kv.CompareKeys(it.table.cmp, keys[i], key) > 0
+	}) - 1
+	it.skip(true)
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.index = 0
+	it.skip(false)
+}
+
+func (it *Iterator) SeekToLast() {
+	it.index = len(it.table.Keys) - 1
+	it.skip(true)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.table != nil && it.index >= 0 && it.index < len(it.table.Keys)
+}
+
+func (it *Iterator) Next() {
+	it.index++
+	it.skip(false)
+}
+
+func (it *Iterator) Prev() {
+	it.index--
+	it.skip(true)
+}
+
+//
+// skip
+//  @Description: 沿遍历方向跳过所有版本都比seq新的key
+//  @receiver it
+//  @param reverse
+//
+func (it *Iterator) skip(reverse bool) {
+	it.value = nil
+	for it.Valid() {
+		if _, ok := it.table.Index[it.Key()].visible(it.seq); ok {
+			return
+		}
+		if reverse {
+			it.index--
+		} else {
+			it.index++
+		}
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.table.Keys[it.index]
+}
+
+//
+// Value
+//  @Description: 返回当前元素, 删除标记不需要读取磁盘; 读取失败时返回空Value, 错误通过Err获取
+//  @receiver it
+//  @return kv.Value
+//
+func (it *Iterator) Value() kv.Value {
+	if it.value != nil {
+		return *it.value
+	}
+	key := it.table.Keys[it.index]
+	pos, _ := it.table.Index[key].visible(it.seq)
+	value := kv.Value{Key: key, Deleted: true, Seq: pos.Seq}
+	if !pos.Deleted {
+		it.table.mu.Lock()
+		v, err := it.table.readValue(key, pos)
+		it.table.mu.Unlock()
+		if err != nil {
+			it.err = err
+			return kv.Value{Key: key}
+		}
+		value = v
+	}
+	it.value = &value
+	return value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() error {
+	if it.table == nil {
+		return nil
+	}
+	err := it.table.Unref()
+	it.table = nil
+	return err
+}
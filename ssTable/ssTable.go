@@ -1,10 +1,7 @@
 package ssTable
 
 import (
-	"encoding/json"
-	"github.com/ygzhang-yolo/lsmtree/config"
 	"github.com/ygzhang-yolo/lsmtree/kv"
-	"log"
 	"os"
 	"sort"
 	"strconv"
@@ -21,27 +18,37 @@ import (
 //  @Description: SSTable的结构定义, 主要是元数据,
 //
 type SSTable struct {
-	F     *os.File            //文件句柄, 注意os的文件句柄数量有限制
-	Path  string              //文件路径
-	Meta  MetaData            //元数据
-	Index map[string]Position //文件的稀疏索引列表
-	Keys  []string            //排序后的key列表
-	mu    sync.Locker         //互斥锁
+	F      *os.File            //文件句柄, 注意os的文件句柄数量有限制
+	Path   string              //文件路径
+	Meta   MetaData            //元数据
+	Index  map[string]Position //文件的稀疏索引列表
+	Keys   []string            //按比较器排序后的key列表
+	Ranges []kv.RangeTombstone //范围删除标记
+	ranges kv.RangeIndex       //按Start排列的范围删除标记, 创建和加载时建立, 用于点查
+	MaxSeq uint64              //表中最大的序列号
+	size   int64               //文件大小, 创建和加载时记录, 文件不会再修改
+	cmp    kv.Comparator       //key的比较器
+	mu     sync.Locker         //互斥锁
+	refs   int32               //引用计数, SSTableTree持有一个引用, 每个迭代器各持有一个
+	// 被压缩后废弃的SSTable, 引用计数归零时删除文件
+	obsolete bool
 	//keys 是有序的，便于 CPU 缓存等，还可以使用布隆过滤器，有助于快速查找。
 	//keys 找到后，使用 index 快速定位
 }
 
 /*
 SSTable在文件中的存储方式：索引是从数据区开始！
-0 ─────────────────────────────────────────────────────────►
+0 ────────────────────────────────────────────────────────────────────────►
 ◄───────────────────────────
           dataLen          ◄──────────────────
-                                indexLen     ◄──────────────┐
-┌──────────────────────────┬─────────────────┬──────────────┤
-│                          │                 │              │
-│          数据区           │   稀疏索引区     │    元数据     │
-│                          │                 │              │
-└──────────────────────────┴─────────────────┴──────────────┘
+                                indexLen     ◄─────────────
+                                                 rangeLen  ◄──────────────┐
+┌──────────────────────────┬─────────────────┬─────────────┬──────────────┤
+│                          │                 │             │              │
+│          数据区           │   稀疏索引区     │  范围删除区  │    元数据     │
+│                          │                 │             │              │
+└──────────────────────────┴─────────────────┴─────────────┴──────────────┘
+范围删除区在稀疏索引区和元数据之间, 长度由文件大小算出, 旧版本的文件没有这一区
 */
 
 //
@@ -61,9 +68,32 @@ type MetaData struct {
 //  @Description: Position元素定位，存储在稀疏索引区中，表示一个元素的起始位置和长度
 //
 type Position struct {
-	Start   int64 // 起始索引
-	Len     int64 // 长度
-	Deleted bool  // Key 已经被删除
+	Start    int64      // 起始索引
+	Len      int64      // 长度
+	Deleted  bool       // Key 已经被删除
+	Merge    bool       `json:",omitempty"` // 值是一个合并操作数
+	Seq      uint64     `json:",omitempty"` // 序列号
+	Versions []Position `json:",omitempty"` // 为快照保留的旧版本, 从新到旧排列
+}
+
+//
+// visible
+//  @Description: 返回对序列号seq可见的最新版本
+//  @receiver p
+//  @param seq
+//  @return Position
+//  @return bool
+//
+func (p Position) visible(seq uint64) (Position, bool) {
+	if p.Seq <= seq {
+		return p, true
+	}
+	for _, version := range p.Versions {
+		if version.Seq <= seq {
+			return version, true
+		}
+	}
+	return Position{}, false
 }
 
 //===========================核心功能, Get, 二分法查找key================//
@@ -74,8 +104,23 @@ type Position struct {
 //  @param key
 //  @return kv.Value
 //  @return kv.SearchResult
+//  @return error
 //
-func (s *SSTable) Get(key string) (kv.Value, kv.SearchResult) {
+func (s *SSTable) Get(key string) (kv.Value, kv.SearchResult, error) {
+	return s.GetAt(key, kv.MaxSeq)
+}
+
+//
+// GetAt
+//  @Description: 查找元素key在序列号seq时的值, 即 Seq <= seq 的最新版本
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//  @return error
+//
+func (s *SSTable) GetAt(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -83,76 +128,261 @@ func (s *SSTable) Get(key string) (kv.Value, kv.SearchResult) {
 		Start: -1,
 	}
 	// keys是有序的, 可以用二分法查找
-	l, r := 0, len(s.Keys)-1
-	for l <= r {
-		m := l + (r-l)/2
-		if s.Keys[m] == key {
-			pos = s.Index[key]
-			// 判断元素是否已经删除
-			if pos.Deleted {
-				return kv.Value{}, kv.Deleted
-			}
-			break
-		} else if s.Keys[m] < key {
-			l = m + 1
-		} else {
-			r = m - 1
+	if i := s.search(key); i < len(s.Keys) && s.Keys[i] == key {
+		var ok bool
+		if pos, ok = s.Index[key].visible(seq); !ok {
+			// 所有版本都比seq新, 相当于不存在
+			return kv.Value{}, kv.None, nil
+		}
+		// 判断元素是否已经删除
+		if pos.Deleted {
+			return kv.Value{Key: key, Deleted: true, Seq: pos.Seq}, kv.Deleted, nil
 		}
 	}
 	// 如果没有查找到, 返回None
 	if pos.Start == -1 {
-		return kv.Value{}, kv.None
+		return kv.Value{}, kv.None, nil
 	}
 
 	// 找到了对应的key, 需要从磁盘的数据区拿到数据原始值
-	bytes := make([]byte, pos.Len)
-	if _, err := s.F.Seek(pos.Start, 0); err != nil {
-		log.Println(err)
-		return kv.Value{}, kv.None
+	value, err := s.readValue(key, pos)
+	if err != nil {
+		return kv.Value{}, kv.None, err
+	}
+	value.Seq = pos.Seq
+	if value.Merge {
+		return value, kv.MergeOperand, nil
+	}
+	return value, kv.Success, nil
+}
+
+//
+// GetChainAt
+//  @Description: 返回key在序列号seq时需要合并的一串版本, 从新到旧排列, 到第一个不是合并操作数的版本为止
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return []kv.Value
+//  @return error
+//
+func (s *SSTable) GetChainAt(key string, seq uint64) ([]kv.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chain := make([]kv.Value, 0)
+	latest, ok := s.Index[key]
+	if !ok {
+		return chain, nil
 	}
-	// Read出数据的字节流bytes
-	if _, err := s.F.Read(bytes); err != nil {
-		log.Println(err)
-		return kv.Value{}, kv.None
+	for _, pos := range append([]Position{latest}, latest.Versions...) {
+		if pos.Seq > seq {
+			continue
+		}
+		if pos.Deleted {
+			// 删除标记不需要读取数据
+			return append(chain, kv.Value{Key: key, Deleted: true, Seq: pos.Seq}), nil
+		}
+		value, err := s.readValue(key, pos)
+		if err != nil {
+			return nil, err
+		}
+		value.Seq = pos.Seq
+		chain = append(chain, value)
+		if !value.Merge {
+			break
+		}
+	}
+	return chain, nil
+}
+
+//
+// RangesAt
+//  @Description: 返回对序列号seq可见的范围删除标记
+//  @receiver s
+//  @param seq
+//  @return []kv.RangeTombstone
+//
+func (s *SSTable) RangesAt(seq uint64) []kv.RangeTombstone {
+	return kv.RangesAt(s.Ranges, seq)
+}
+
+//
+// Covering
+//  @Description: 找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记
+//  @receiver s
+//  @param key
+//  @param seq
+//  @param at
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (s *SSTable) Covering(key string, seq uint64, at uint64) (kv.RangeTombstone, bool) {
+	return s.ranges.Covering(key, seq, at)
+}
+
+//
+// ApproximateRange
+//  @Description: 估算key在[start, end)内的数据大小和key数量, end为空表示没有上界; 只使用内存中的索引, 不读取数据.
+//  数据区按key的顺序写入, 范围内第一个key的起始位置到范围后第一个key的起始位置就是范围内所有版本的数据
+//  @receiver s
+//  @param start
+//  @param end
+//  @return int64	数据区中的字节数
+//  @return int	key的数量, 包括删除标记
+//
+func (s *SSTable) ApproximateRange(start string, end string) (int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last := 0, len(s.Keys)
+	if start != "" {
+		first = s.search(start)
+	}
+	if end != "" {
+		last = s.search(end)
+	}
+	if first >= last {
+		return 0, 0
+	}
+	offset := func(i int) int64 {
+		if i == len(s.Keys) {
+			return s.Meta.DataStart + s.Meta.DataLen
+		}
+		return s.Index[s.Keys[i]].Start
+	}
+	return offset(last) - offset(first), last - first
+}
+
+//
+// Overlaps
+//  @Description: 判断SSTable的key范围是否与[start, end)有交集, end为空表示没有上界
+//  @receiver s
+//  @param start
+//  @param end
+//  @return bool
+//
+func (s *SSTable) Overlaps(start string, end string) bool {
+	if len(s.Keys) == 0 {
+		return false
+	}
+	first, last := s.Keys[0], s.Keys[len(s.Keys)-1]
+	return (start == "" || kv.CompareKeys(s.cmp, last, start) >= 0) && (end == "" || kv.CompareKeys(s.cmp, first, end) < 0)
+}
+
+//
+// search
+//  @Description: 二分查找第一个 >= key 的下标
+//  @receiver s
+//  @param key
+//  @return int
+//
+func (s *SSTable) search(key string) int {
+	return sort.Search(len(s.Keys), func(i int) bool {
+		return kv.CompareKeys(s.cmp, s.Keys[i], key) >= 0
+	})
+}
+
+//
+// sortKeys
+//  @Description: 按比较器对keys排序
+//  @param keys
+//  @param cmp
+//
+func sortKeys(keys []string, cmp kv.Comparator) {
+	sort.Slice(keys, func(i, j int) bool {
+		return kv.CompareKeys(cmp, keys[i], keys[j]) < 0
+	})
+}
+
+//
+// readValue
+//  @Description: 根据pos从磁盘的数据区读取并反序列化一个元素, 调用方需要持有s.mu
+//  @receiver s
+//  @param key
+//  @param pos
+//  @return kv.Value
+//  @return error
+//
+func (s *SSTable) readValue(key string, pos Position) (kv.Value, error) {
+	if s.F == nil {
+		return kv.Value{}, kv.ErrClosed
+	}
+	bytes := make([]byte, pos.Len)
+	if _, err := s.F.ReadAt(bytes, pos.Start); err != nil {
+		return kv.Value{}, kv.IOError("read data", s.Path, err)
 	}
 	// 反序列化为kv.Value
 	value, err := kv.Decode(bytes)
 	if err != nil {
-		log.Println(err)
-		return kv.Value{}, kv.None
+		return kv.Value{}, kv.CorruptError(s.Path, "invalid value of key %q: %v", key, err)
 	}
-	return value, kv.Success
+	return value, nil
 }
 
 //
 // NewSSTable
-//  @Description: 根据传入的values, 创建一个对应的SSTable
-//  @param values
+//  @Description: 根据传入的values, 在dir目录下创建一个对应的SSTable
+//  @param dir
+//  @param values	按key升序排列, 同一个key的多个版本从新到旧相邻排列
+//  @param ranges	范围删除标记
+//  @param level
+//  @param number	文件编号, 文件名为 level.number.db
+//  @param cmp	key的比较器
+//  @return *SSTable
+//  @return error
 //
-func NewSSTable(values []kv.Value, level int, node int) *SSTable {
+func NewSSTable(dir string, values []kv.Value, ranges []kv.RangeTombstone, level int, number int, cmp kv.Comparator) (*SSTable, error) {
 	// 生成数据区, 就是把values中所有的value序列化为字节流存起来
 	keys := make([]string, 0, len(values)) //记录所有的key
 	positions := make(map[string]Position) //记录每个value的起始位置
 	data := make([]byte, 0)                //数据区的字节流
+	var maxSeq uint64
 	for _, value := range values {
-		vdata, _ := kv.Encode(value) //将每个value序列化为二进制
-		keys = append(keys, value.Key)
+		vdata, err := kv.Encode(value) //将每个value序列化为二进制
+		if err != nil {
+			return nil, err
+		}
 		// 记录字节流的文件偏移, 方便定位
-		positions[value.Key] = Position{
+		pos := Position{
 			Start:   int64(len(data)),
 			Len:     int64(len(vdata)),
 			Deleted: value.Deleted,
+			Merge:   value.Merge,
+			Seq:     value.Seq,
+		}
+		if latest, ok := positions[value.Key]; ok {
+			// 同一个key的旧版本
+			latest.Versions = append(latest.Versions, pos)
+			positions[value.Key] = latest
+		} else {
+			keys = append(keys, value.Key)
+			positions[value.Key] = pos
+		}
+		if value.Seq > maxSeq {
+			maxSeq = value.Seq
 		}
 		data = append(data, vdata...)
 	}
-	sort.Strings(keys) //对key进行排序, 保证有序的key
+	sortKeys(keys, cmp) //对key进行排序, 保证有序的key
+	for _, r := range ranges {
+		if r.Seq > maxSeq {
+			maxSeq = r.Seq
+		}
+	}
 
 	// 生成稀疏索引区
-	index, _ := json.Marshal(positions) //序列化为字节流
+	index, err := encodeIndex(keys, positions) //序列化为字节流
+	if err != nil {
+		return nil, err
+	}
+	// 生成范围删除区
+	rangeData, err := encodeRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
 
 	// 生成元数据
 	var meta = MetaData{
-		Version:    0,
+		Version:    tableVersion,
 		DataStart:  0,
 		DataLen:    int64(len(data)),
 		IndexStart: int64(len(data)),
@@ -160,19 +390,30 @@ func NewSSTable(values []kv.Value, level int, node int) *SSTable {
 	}
 
 	// 生成对应的文件句柄
-	cfg := config.GetConfig()
-	path := cfg.DataDir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(node) + ".db"
-	writeDataToFile(path, data, index, meta) //将SSTable数据落盘
-	f, _ := os.OpenFile(path, os.O_RDONLY, 0666)
+	path := dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(number) + ".db"
+	//将SSTable数据落盘
+	if err = writeDataToFile(path, data, index, rangeData, meta); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, kv.IOError("open file", path, err)
+	}
 
 	// 生成SSTable
 	table := SSTable{
-		F:     f,
-		Path:  path,
-		Meta:  meta,
-		Index: positions,
-		Keys:  keys,
-		mu:    &sync.RWMutex{},
-	}
-	return &table
+		F:      f,
+		Path:   path,
+		Meta:   meta,
+		Index:  positions,
+		Keys:   keys,
+		Ranges: ranges,
+		ranges: kv.NewRangeIndex(cmp, ranges),
+		MaxSeq: maxSeq,
+		size:   int64(len(data)+len(index)+len(rangeData)) + metaDataSize,
+		cmp:    cmp,
+		mu:     &sync.RWMutex{},
+		refs:   1,
+	}
+	return &table, nil
 }
@@ -1,11 +1,10 @@
 package sstTree
 
 import (
-	"github.com/ygzhang-yolo/lsmtree/bst"
-	"github.com/ygzhang-yolo/lsmtree/config"
 	"github.com/ygzhang-yolo/lsmtree/kv"
+	sst "github.com/ygzhang-yolo/lsmtree/ssTable"
 	"log"
-	"os"
+	"sort"
 	"time"
 )
 
@@ -19,21 +18,29 @@ import (
 // Check
 //  @Description: 检查是否需要压缩数据库文件
 //  @receiver s
+//  @param snapshots	存活的快照序列号, 升序排列, 压缩时会保留它们还能看到的旧版本
+//  @return error
 //
-func (s *SSTableTree) Check() {
-	s.majorCompact()
+func (s *SSTableTree) Check(snapshots []uint64) error {
+	return s.majorCompact(snapshots)
 }
 
-func (s *SSTableTree) majorCompact() {
-	cfg := config.GetConfig()
+func (s *SSTableTree) majorCompact(snapshots []uint64) error {
 	for levelIndex, _ := range s.levels {
-		tableSize := int(s.GetLevelSize(levelIndex) / 1000 / 1000) //转为MB单位
+		levelSize, err := s.GetLevelSize(levelIndex)
+		if err != nil {
+			return err
+		}
+		tableSize := int(levelSize / 1000 / 1000) //转为MB单位
 		// 检查当前level的SSTable总大小和总个数是否超出阈值
-		if s.GetTableNums(levelIndex) > cfg.PartSize || tableSize > levelMaxSize[levelIndex] {
+		if s.GetTableNums(levelIndex) > s.cfg.PartSize || tableSize > s.levelMaxSize[levelIndex] {
 			// 需要对SSTable进行压缩compact
-			s.majorCompactLevel(levelIndex)
+			if err = s.majorCompactLevel(levelIndex, snapshots); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 //
@@ -41,8 +48,10 @@ func (s *SSTableTree) majorCompact() {
 //  @Description: 对level层进行Compact, 压缩当前层的文件到下一层
 //  @receiver s
 //  @param level
+//  @param snapshots
+//  @return error
 //
-func (s *SSTableTree) majorCompactLevel(level int) {
+func (s *SSTableTree) majorCompactLevel(level int, snapshots []uint64) error {
 	log.Println("Compressing layer ", level, " files")
 	start := time.Now()
 	defer func() {
@@ -51,13 +60,27 @@ func (s *SSTableTree) majorCompactLevel(level int) {
 	}()
 	//-------------compact start--------------------//
 	log.Printf("Compressing layer %d.db files\r\n", level)
-	tableMem := make([]byte, levelMaxSize[level]) //将所有SSTable都加载到内存
-	cur := s.levels[level]
-	// 将level层的所有SSTable合并到一个BST中
-	memTree := bst.NewBSTree()
-	s.mu.Lock()
-	for cur != nil {
-		table := cur.table
+	tableMem := make([]byte, s.levelMaxSize[level]) //将所有SSTable都加载到内存
+	// 收集level层所有SSTable中每个key的所有版本, 记录参与压缩的SSTable数量
+	s.mu.RLock()
+	tables := make([]*sst.SSTable, 0)
+	for cur := s.levels[level]; cur != nil; cur = cur.next {
+		tables = append(tables, cur.table)
+	}
+	// 更深的层没有数据时, 这一层就包含了所有的旧版本
+	bottom := s.emptyBelow(level)
+	s.mu.RUnlock()
+	compacted := len(tables)
+	if compacted == 0 {
+		return nil
+	}
+	versions := make(map[string][]kv.Value)
+	ranges := make([]kv.RangeTombstone, 0)
+	now := time.Now().UnixNano()
+	// 从最新的SSTable开始, 保证序列号相同(旧版本数据没有序列号)时新的排在前面
+	for i := len(tables) - 1; i >= 0; i-- {
+		table := tables[i]
+		ranges = append(ranges, table.Ranges...)
 		// 数据区加载到内存中
 		// 注意如果数据区长度dataLen更大, 要对tableMem进行扩容
 		if int64(len(tableMem)) < table.Meta.DataLen {
@@ -65,46 +88,173 @@ func (s *SSTableTree) majorCompactLevel(level int) {
 		}
 		newSlice := tableMem[0:table.Meta.DataLen]
 		// 读取数据区
-		if _, err := table.F.Seek(0, 0); err != nil {
-			log.Println(" error open file ", table.Path)
-			panic(err)
-		}
-		if _, err := table.F.Read(newSlice); err != nil {
-			log.Println(" error read file ", table.Path)
-			panic(err)
+		if _, err := table.F.ReadAt(newSlice, table.Meta.DataStart); err != nil {
+			return kv.IOError("read data", table.Path, err)
 		}
-		// 从稀疏索引表中记录的每一个Value, 设置对应的memTree
-		for k, pos := range table.Index {
-			// 根据是否删除, 调用Delete和Set方法();
-			if pos.Deleted {
-				memTree.Delete(k)
-			} else {
-				value, err := kv.Decode(newSlice[pos.Start:(pos.Start + pos.Len)]) //还原每一个Value
+		// 从稀疏索引表中记录的每一个Value的每个版本, 还原到versions中
+		for k, latest := range table.Index {
+			for _, pos := range append([]sst.Position{latest}, latest.Versions...) {
+				// 删除标记不需要读取数据
+				if pos.Deleted {
+					versions[k] = append(versions[k], kv.Value{Key: k, Deleted: true, Seq: pos.Seq})
+					continue
+				}
+				start := pos.Start - table.Meta.DataStart
+				value, err := kv.Decode(newSlice[start:(start + pos.Len)]) //还原每一个Value
 				if err != nil {
-					log.Fatal(err)
+					return kv.CorruptError(table.Path, "invalid value of key %q: %v", k, err)
+				}
+				value.Key, value.Seq = k, pos.Seq
+				// 已经过期的元素丢掉数据, 只留下删除标记, 避免更深层的旧版本重新可见
+				if value.Expired(now) {
+					value = kv.Value{Key: k, Deleted: true, Seq: pos.Seq}
 				}
-				memTree.Set(k, value.Value)
+				versions[k] = append(versions[k], value)
 			}
 		}
-		cur = cur.next
 	}
-	s.mu.Unlock()
 
-	//
-	values := memTree.GetKV()
+	// 按key排序, 每个key的版本按序列号从新到旧排列, 合并操作数合并成普通的值, 去掉快照都看不到的旧版本
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	cmp := s.cfg.GetComparator()
+	sort.Slice(keys, func(i, j int) bool {
+		return kv.CompareKeys(cmp, keys[i], keys[j]) < 0
+	})
+	values := make([]kv.Value, 0, len(keys))
+	for _, k := range keys {
+		vs := versions[k]
+		sort.SliceStable(vs, func(i, j int) bool {
+			return vs[i].Seq > vs[j].Seq
+		})
+		vs, covered := coverVersions(cmp, vs, ranges)
+		vs = s.collapseMerge(vs, snapshots, bottom, now)
+		retained := make([]kv.Value, 0, len(vs))
+		for _, v := range kv.RetainVersions(vs, snapshots) {
+			// 代替范围删除标记的删除标记不写入, 范围删除标记本身还在
+			if !covered[v.Seq] {
+				retained = append(retained, v)
+			}
+		}
+		// 更深的层没有数据时, 没有快照需要旧版本的删除标记已经遮不住任何数据, 直接丢掉
+		if len(retained) == 0 || (bottom && len(retained) == 1 && retained[0].Deleted) {
+			continue
+		}
+		values = append(values, retained...)
+	}
+	// 范围删除标记到了最深的层, 而且没有快照还能看到它遮住的数据时, 直接丢掉
+	keptRanges := make([]kv.RangeTombstone, 0, len(ranges))
+	for _, r := range ranges {
+		if !bottom || kv.Visible(snapshots, 0, r.Seq) {
+			keptRanges = append(keptRanges, r)
+		}
+	}
+
 	nextLevel := level + 1
-	// 不能超出level Max Num限制
+	// 不能超出level Max Num限制, 最底层压缩到自己
 	if nextLevel >= levelMaxNum {
-		nextLevel = levelMaxNum
+		nextLevel = levelMaxNum - 1
+	}
+	// 先在新层写好SSTable文件, 失败时旧层的数据保持不变; 所有数据都被删除时不需要新的SSTable
+	var created *SSTableNode
+	if len(values) > 0 || len(keptRanges) > 0 {
+		var err error
+		if created, err = s.createTable(values, keptRanges, nextLevel); err != nil {
+			return err
+		}
 	}
-	// 在新层创建新的SSTable
-	s.createTableInLevel(values, nextLevel)
-	// 旧层删掉现有的, 最底层不能删
+	// 插入新的SSTable和删掉参与压缩的SSTable在同一个临界区中, 读取不会同时看到新旧两份数据, 也不会两份都看不到.
+	// 新的SSTable都追加在链表末尾, 所以参与压缩的就是链表的前compacted个节点
+	s.mu.Lock()
 	oldNodeData := s.levels[level]
-	if level < levelMaxNum {
-		s.levels[level] = nil
-		s.freeLevelData(oldNodeData)
+	tail := oldNodeData
+	for i := 1; i < compacted; i++ {
+		tail = tail.next
+	}
+	s.levels[level] = tail.next
+	tail.next = nil
+	if created != nil {
+		s.link(created, nextLevel)
+	}
+	s.mu.Unlock()
+	return s.freeLevelData(oldNodeData)
+}
+
+//
+// collapseMerge
+//  @Description: 把同一个key最新的一串合并操作数和它们的旧值合并成一个普通的值; 有快照会读到中间的版本时不合并,
+//  这一层找不到旧值而更深的层还有数据时也不合并, 等压缩到旧值所在的层时再合并
+//  @receiver s
+//  @param vs	同一个key的所有版本, 从新到旧排列
+//  @param snapshots
+//  @param bottom	更深的层是否没有数据
+//  @param now
+//  @return []kv.Value
+//
+func (s *SSTableTree) collapseMerge(vs []kv.Value, snapshots []uint64, bottom bool, now int64) []kv.Value {
+	op := s.cfg.MergeOperator
+	if op == nil || !vs[0].Merge {
+		return vs
+	}
+	end := 1
+	for end < len(vs) && vs[end-1].Merge {
+		end++
+	}
+	if (vs[end-1].Merge && !bottom) || kv.Visible(snapshots, vs[end-1].Seq, vs[0].Seq) {
+		return vs
+	}
+	value, err := kv.ResolveMerge(op, vs[:end], now)
+	if err != nil {
+		// 合并失败时保留操作数, 读取时会返回这个错误
+		log.Println(err)
+		return vs
+	}
+	return append([]kv.Value{value}, vs[end:]...)
+}
+
+//
+// coverVersions
+//  @Description: 同一个key被参与压缩的范围删除标记遮住时, 在标记的序列号处插入一个删除标记,
+//  之后和普通的删除标记一样决定哪些旧版本可以丢掉
+//  @param cmp
+//  @param vs	同一个key的所有版本, 从新到旧排列
+//  @param ranges
+//  @return []kv.Value	插入删除标记后的版本, 从新到旧排列
+//  @return map[uint64]bool	插入的删除标记的序列号
+//
+func coverVersions(cmp kv.Comparator, vs []kv.Value, ranges []kv.RangeTombstone) ([]kv.Value, map[uint64]bool) {
+	covered := make(map[uint64]bool)
+	oldest := vs[len(vs)-1]
+	for _, r := range ranges {
+		if !covered[r.Seq] && r.Covers(cmp, oldest.Key, oldest.Seq) {
+			covered[r.Seq] = true
+			vs = append(vs, kv.Value{Key: oldest.Key, Deleted: true, Seq: r.Seq})
+		}
+	}
+	if len(covered) > 0 {
+		sort.SliceStable(vs, func(i, j int) bool {
+			return vs[i].Seq > vs[j].Seq
+		})
+	}
+	return vs, covered
+}
+
+//
+// emptyBelow
+//  @Description: 判断level之下的层是否都没有SSTable, 调用方需要持有s.mu
+//  @receiver s
+//  @param level
+//  @return bool
+//
+func (s *SSTableTree) emptyBelow(level int) bool {
+	for i := level + 1; i < len(s.levels); i++ {
+		if s.levels[i] != nil {
+			return false
+		}
 	}
+	return true
 }
 
 //
@@ -112,25 +262,18 @@ func (s *SSTableTree) majorCompactLevel(level int) {
 //  @Description: 释放清理掉level层的数据
 //  @receiver s
 //  @param node
+//  @return error
 //
-func (s *SSTableTree) freeLevelData(node *SSTableNode) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *SSTableTree) freeLevelData(node *SSTableNode) error {
 	// 遍历链表, 释放每个链表的内存
 	for node != nil {
-		// 关闭文件
-		if err := node.table.F.Close(); err != nil {
-			log.Println(" error close file,", node.table.Path)
-			panic(err)
-		}
-		//删除文件
-		if err := os.Remove(node.table.Path); err != nil {
-			log.Println(" error delete file,", node.table.Path)
-			panic(err)
+		// 关闭并删除文件, 如果还有迭代器在读, 等迭代器关闭后再删除
+		if err := node.table.Obsolete(); err != nil {
+			return err
 		}
 		//置空指针
-		node.table.F = nil
 		node.table = nil
 		node = node.next
 	}
+	return nil
 }
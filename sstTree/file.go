@@ -1,9 +1,13 @@
 package sstTree
 
 import (
+	"github.com/ygzhang-yolo/lsmtree/kv"
 	"github.com/ygzhang-yolo/lsmtree/ssTable"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,8 +22,9 @@ import (
 //  @Description: 加载一个db文件到内存中的SSTableTree中
 //  @receiver s
 //  @param path
+//  @return error
 //
-func (s *SSTableTree) loadFileToMemory(path string) {
+func (s *SSTableTree) loadFileToMemory(path string) error {
 	log.Println("Loading the db file into Memory SSTableTree ", path)
 	start := time.Now()
 	defer func() {
@@ -29,13 +34,17 @@ func (s *SSTableTree) loadFileToMemory(path string) {
 
 	// 根据db文件名, 判断level和index
 	level, index, err := GetLevelFromDB(filepath.Base(path))
-	if err != nil {
-		return
+	if err != nil || level < 0 || level >= levelMaxNum {
+		// 不是SSTable的文件直接跳过
+		log.Println("Skip the file ", path)
+		return nil
 	}
 
 	// 创建对应的SSTable对象和SSTableNode
 	table := &ssTable.SSTable{}
-	table.Init(path)
+	if err = table.Init(path, s.cfg.GetComparator()); err != nil {
+		return err
+	}
 	node := &SSTableNode{
 		index: index,
 		table: table,
@@ -46,14 +55,14 @@ func (s *SSTableTree) loadFileToMemory(path string) {
 	if cur == nil {
 		// 空直接返回
 		s.levels[level] = node
-		return
+		return nil
 	}
 	if node.index < cur.index {
 		// 如果node比头节点的index还小, 插入到最前面
 		// FIXME: 这里应该能用一个dummyHead来统一两种写法
 		node.next = cur
 		s.levels[level] = node
-		return
+		return nil
 	}
 	// 否则遍历找到index对应的位置插入
 	for cur != nil {
@@ -65,4 +74,62 @@ func (s *SSTableTree) loadFileToMemory(path string) {
 			cur = cur.next
 		}
 	}
+	return nil
+}
+
+//
+// loadNextFile
+//  @Description: 恢复下一个SSTable的文件编号, 取记录下来的编号和已有文件的最大编号+1中较大的一个
+//  @receiver s
+//  @return error
+//
+func (s *SSTableTree) loadNextFile() error {
+	for _, node := range s.levels {
+		for ; node != nil; node = node.next {
+			if node.index >= s.nextFile {
+				s.nextFile = node.index + 1
+			}
+		}
+	}
+	path := filepath.Join(s.cfg.DataDir, nextFileName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return kv.IOError("read file", path, err)
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return kv.CorruptError(path, "invalid file number %q", data)
+	}
+	if number > s.nextFile {
+		s.nextFile = number
+	}
+	return nil
+}
+
+//
+// newFileNumber
+//  @Description: 分配一个新的SSTable文件编号; 先把下一个编号写到文件中再使用, 重启之后也不会用到已经分配过的编号.
+//  迭代器还在读的旧文件不会被新的SSTable覆盖, 同一层的文件编号也和链表的顺序一致
+//  @receiver s
+//  @return int
+//  @return error
+//
+func (s *SSTableTree) newFileNumber() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	number := s.nextFile
+	// 先写临时文件再改名, 写到一半时不会留下不完整的编号
+	path := filepath.Join(s.cfg.DataDir, nextFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(number+1)), 0666); err != nil {
+		return 0, kv.IOError("write file", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, kv.IOError("rename file", tmp, err)
+	}
+	s.nextFile = number + 1
+	return number, nil
 }
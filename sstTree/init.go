@@ -2,6 +2,7 @@ package sstTree
 
 import (
 	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/kv"
 	"io/ioutil"
 	"log"
 	"path"
@@ -15,17 +16,19 @@ import (
  * @Func:
  **/
 
-var levelMaxSize []int
-
-const levelMaxNum = 10 //最大层数为10
+const (
+	levelMaxNum  = 10         //最大层数为10
+	nextFileName = "nextfile" //数据目录中记录下一个SSTable文件编号的文件
+)
 
 //
 // Init
 //  @Description: 初始化SSTableTree
 //  @receiver s
-//  @param dir
+//  @param cfg
+//  @return error
 //
-func (s *SSTableTree) Init(dir string) {
+func (s *SSTableTree) Init(cfg config.Config) error {
 	log.Println("The SSTable list are being loaded")
 	start := time.Now()
 	defer func() {
@@ -34,33 +37,36 @@ func (s *SSTableTree) Init(dir string) {
 	}()
 
 	// 初始化每一层 SSTable 的文件总最大值, 每个是上一层的10倍大小
-	con := config.GetConfig()
-	levelMaxSize = make([]int, levelMaxNum)
-	levelMaxSize[0] = con.Level0Size
-	levelMaxSize[1] = levelMaxSize[0] * 10
-	levelMaxSize[2] = levelMaxSize[1] * 10
-	levelMaxSize[3] = levelMaxSize[2] * 10
-	levelMaxSize[4] = levelMaxSize[3] * 10
-	levelMaxSize[5] = levelMaxSize[4] * 10
-	levelMaxSize[6] = levelMaxSize[5] * 10
-	levelMaxSize[7] = levelMaxSize[6] * 10
-	levelMaxSize[8] = levelMaxSize[7] * 10
-	levelMaxSize[9] = levelMaxSize[8] * 10
+	s.cfg = cfg
+	s.levelMaxSize = make([]int, levelMaxNum)
+	s.levelMaxSize[0] = cfg.Level0Size
+	for i := 1; i < levelMaxNum; i++ {
+		s.levelMaxSize[i] = s.levelMaxSize[i-1] * 10
+	}
 
 	// 初始化SSTable Tree的成员
 	s.levels = make([]*SSTableNode, 10)
 	s.mu = &sync.RWMutex{}
 
 	// 检查路径下的db文件, 如果有要加载到内存中
+	dir := cfg.DataDir
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Println("Failed to read the database file")
-		panic(err)
+		return kv.IOError("read dir", dir, err)
 	}
 	for _, info := range infos {
 		// 如果是SSTable的db文件, 将其加载到内存中的SSTable中
 		if path.Ext(info.Name()) == ".db" {
-			s.loadFileToMemory(path.Join(dir, info.Name()))
+			if err = s.loadFileToMemory(path.Join(dir, info.Name())); err != nil {
+				// 已经加载的文件句柄要关闭
+				_ = s.Close()
+				return err
+			}
 		}
 	}
+	if err = s.loadNextFile(); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
 }
@@ -2,6 +2,7 @@ package sstTree
 
 import (
 	"fmt"
+	"github.com/ygzhang-yolo/lsmtree/config"
 	"github.com/ygzhang-yolo/lsmtree/kv"
 	sst "github.com/ygzhang-yolo/lsmtree/ssTable"
 	"sync"
@@ -18,8 +19,11 @@ import (
 //  @Description: SSTable Tree的结构, 包括多个level, 每个level都是一个SSTable的链表
 //
 type SSTableTree struct {
-	levels []*SSTableNode
-	mu     *sync.RWMutex
+	levels       []*SSTableNode
+	levelMaxSize []int         //每一层SSTable文件总大小的上限, 单位MB
+	cfg          config.Config //所属数据库实例的配置
+	nextFile     int           //下一个SSTable的文件编号, 只增不减, 旧文件名不会被新的SSTable重新使用
+	mu           *sync.RWMutex
 }
 
 //
@@ -27,7 +31,7 @@ type SSTableTree struct {
 //  @Description: SSTableNode对应一个SSTable的链表节点
 //
 type SSTableNode struct {
-	index int          //链表的索引
+	index int          //SSTable的文件编号, 链表按它升序排列, 越新的越大
 	table *sst.SSTable //链表的值是一个SSTable
 	next  *SSTableNode
 }
@@ -40,8 +44,23 @@ type SSTableNode struct {
 //  @param key
 //  @return kv.Value
 //  @return kv.SearchResult
+//  @return error
+//
+func (s *SSTableTree) Get(key string) (kv.Value, kv.SearchResult, error) {
+	return s.GetAt(key, kv.MaxSeq)
+}
+
+//
+// GetAt
+//  @Description: 从所有的SSTable中查找key在序列号seq时的值
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return kv.Value
+//  @return kv.SearchResult
+//  @return error
 //
-func (s *SSTableTree) Get(key string) (kv.Value, kv.SearchResult) {
+func (s *SSTableTree) GetAt(key string, seq uint64) (kv.Value, kv.SearchResult, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -55,61 +74,190 @@ func (s *SSTableTree) Get(key string) (kv.Value, kv.SearchResult) {
 		}
 		// 从最新的, 最后一个SSTable开始找
 		for i := len(tables) - 1; i >= 0; i-- {
-			value, result := tables[i].Get(key)
+			value, result, err := tables[i].GetAt(key, seq)
+			if err != nil {
+				return kv.Value{}, kv.None, err
+			}
 			if result == kv.None {
 				// 如果找不到就找下一个table
 				continue
 			} else {
-				return value, result
+				return value, result, nil
 			}
 		}
 	}
 	// 全部遍历完都没找到, 返回不存在None
-	return kv.Value{}, kv.None
+	return kv.Value{}, kv.None, nil
+}
+
+//
+// GetChainAt
+//  @Description: 从新到旧在所有的SSTable中收集key在序列号seq时需要合并的一串版本,
+//  到第一个不是合并操作数的版本为止
+//  @receiver s
+//  @param key
+//  @param seq
+//  @return []kv.Value
+//  @return error
+//
+func (s *SSTableTree) GetChainAt(key string, seq uint64) ([]kv.Value, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chain := make([]kv.Value, 0)
+	for _, node := range s.levels {
+		tables := make([]*sst.SSTable, 0)
+		for node != nil {
+			tables = append(tables, node.table)
+			node = node.next
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			versions, err := tables[i].GetChainAt(key, seq)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, versions...)
+			if len(chain) > 0 && !chain[len(chain)-1].Merge {
+				return chain, nil
+			}
+		}
+	}
+	return chain, nil
+}
+
+//
+// RangesAt
+//  @Description: 返回所有SSTable中对序列号seq可见的范围删除标记
+//  @receiver s
+//  @param seq
+//  @return []kv.RangeTombstone
+//
+func (s *SSTableTree) RangesAt(seq uint64) []kv.RangeTombstone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ranges := make([]kv.RangeTombstone, 0)
+	for _, node := range s.levels {
+		for ; node != nil; node = node.next {
+			ranges = append(ranges, node.table.RangesAt(seq)...)
+		}
+	}
+	return ranges
+}
+
+//
+// Covering
+//  @Description: 在所有SSTable中找出对序列号at可见, 遮住序列号为seq的key的版本的最新的范围删除标记
+//  @receiver s
+//  @param key
+//  @param seq
+//  @param at
+//  @return kv.RangeTombstone
+//  @return bool
+//
+func (s *SSTableTree) Covering(key string, seq uint64, at uint64) (kv.RangeTombstone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var newest kv.RangeTombstone
+	found := false
+	for _, node := range s.levels {
+		for ; node != nil; node = node.next {
+			if r, ok := node.table.Covering(key, seq, at); ok && (!found || r.Seq > newest.Seq) {
+				newest, found = r, true
+			}
+		}
+	}
+	return newest, found
+}
+
+//
+// NewIterators
+//  @Description: 为key范围与[start, end)有交集的SSTable创建序列号seq时的迭代器, end为空表示没有上界;
+//  按从新到旧排列: level越小越新, 同一level中越靠后越新
+//  @receiver s
+//  @param start
+//  @param end
+//  @param seq
+//  @return []kv.Iterator
+//
+func (s *SSTableTree) NewIterators(start string, end string, seq uint64) []kv.Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	iters := make([]kv.Iterator, 0)
+	for _, node := range s.levels {
+		tables := make([]*sst.SSTable, 0)
+		for node != nil {
+			// 跳过key范围不可能包含结果的SSTable
+			if node.table.Overlaps(start, end) {
+				tables = append(tables, node.table)
+			}
+			node = node.next
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			iters = append(iters, tables[i].NewIterator(seq))
+		}
+	}
+	return iters
 }
 
 //
-// CreateTableInLevel
-//  @Description: 创建一个新的SSTable, 一般是memTable满了调用, 在level0插入一个新的
+// CreateTable
+//  @Description: 为level0写一个新的SSTable文件, 一般是memTable满了调用; 写完之后还要用Install插入, 之前读取看不到它
 //  @receiver s
 //  @param values
+//  @param ranges	内存表中的范围删除标记
+//  @return *SSTableNode
+//  @return error
+//
+func (s *SSTableTree) CreateTable(values []kv.Value, ranges []kv.RangeTombstone) (*SSTableNode, error) {
+	return s.createTable(values, ranges, 0)
+}
+
+//
+// Install
+//  @Description: 把CreateTable写好的SSTable插入到level0末尾
+//  @receiver s
+//  @param node
 //
-func (s *SSTableTree) CreateTableInLevel(values []kv.Value) {
-	s.createTableInLevel(values, 0)
+func (s *SSTableTree) Install(node *SSTableNode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.link(node, 0)
 }
 
 //
-// createTableInLevel
-//  @Description: 创建一个SSTable并插入到level0末尾
+// createTable
+//  @Description: 用新的文件编号写一个level层的SSTable文件, 还没有插入到SSTableTree中, 读取看不到它;
+//  写文件期间不持有s.mu
 //  @receiver s
 //  @param values
+//  @param ranges
 //  @param level
-//  @return *sst.SSTable
+//  @return *SSTableNode
+//  @return error
 //
-func (s *SSTableTree) createTableInLevel(values []kv.Value, level int) *sst.SSTable {
-	node := s.GetTableNums(level)
-	table := sst.NewSSTable(values, level, node) //创建一个SSTable
-	s.insert(table, level)                       //根据SSTable创建一个SSTableNode插入到SSTableTree中
-	return table
+func (s *SSTableTree) createTable(values []kv.Value, ranges []kv.RangeTombstone, level int) (*SSTableNode, error) {
+	number, err := s.newFileNumber()
+	if err != nil {
+		return nil, err
+	}
+	table, err := sst.NewSSTable(s.cfg.DataDir, values, ranges, level, number, s.cfg.GetComparator()) //创建一个SSTable
+	if err != nil {
+		return nil, err
+	}
+	return &SSTableNode{index: number, table: table}, nil
 }
 
 //
-// insert
-//  @Description: 插入一个SSTable到指定层, 并创建对应SSTableNode
+// link
+//  @Description: 把SSTableNode尾插到指定层的链表, 它的文件编号比链表中已有的都大; 调用方需要持有s.mu的写锁
 //  @receiver s
-//  @param table
+//  @param sstNode
 //  @param level
 //
-func (s *SSTableTree) insert(table *sst.SSTable, level int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *SSTableTree) link(sstNode *SSTableNode, level int) {
 	// 尾插到链表的最后
 	node := s.levels[level]
-	sstNode := &SSTableNode{
-		index: 0,
-		table: table,
-		next:  nil,
-	}
 	if node == nil {
 		s.levels[level] = sstNode
 	} else {
@@ -117,28 +265,144 @@ func (s *SSTableTree) insert(table *sst.SSTable, level int) {
 		for node.next != nil {
 			node = node.next
 		}
-		sstNode.index = node.index + 1
 		node.next = sstNode
 	}
 }
 
+//
+// Close
+//  @Description: 关闭所有SSTable的文件句柄, 返回遇到的第一个错误
+//  @receiver s
+//  @return error
+//
+func (s *SSTableTree) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for _, node := range s.levels {
+		for node != nil {
+			if err := node.table.Close(); err != nil && first == nil {
+				first = err
+			}
+			node = node.next
+		}
+	}
+	return first
+}
+
+//
+// Drop
+//  @Description: 废弃所有的SSTable, 没有迭代器在使用的文件立即删除, 其他的等迭代器关闭后删除
+//  @receiver s
+//  @return error
+//
+func (s *SSTableTree) Drop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var first error
+	for i, node := range s.levels {
+		for node != nil {
+			if err := node.table.Obsolete(); err != nil && first == nil {
+				first = err
+			}
+			node = node.next
+		}
+		s.levels[i] = nil
+	}
+	return first
+}
+
 //=========================================一些辅助函数==========================================//
 
+//
+// MaxSeq
+//  @Description: 返回所有SSTable中最大的序列号
+//  @receiver s
+//  @return uint64
+//
+func (s *SSTableTree) MaxSeq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var maxSeq uint64
+	for _, node := range s.levels {
+		for node != nil {
+			if node.table.MaxSeq > maxSeq {
+				maxSeq = node.table.MaxSeq
+			}
+			node = node.next
+		}
+	}
+	return maxSeq
+}
+
+//
+// ApproximateRange
+//  @Description: 估算所有SSTable中key在[start, end)内的数据大小和key数量; 同一个key在多个SSTable中出现时会重复计算
+//  @receiver s
+//  @param start
+//  @param end
+//  @return int64
+//  @return int
+//
+func (s *SSTableTree) ApproximateRange(start string, end string) (int64, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var size int64
+	count := 0
+	for _, node := range s.levels {
+		for ; node != nil; node = node.next {
+			tableSize, tableCount := node.table.ApproximateRange(start, end)
+			size += tableSize
+			count += tableCount
+		}
+	}
+	return size, count
+}
+
+//
+// CompactionPressure
+//  @Description: 返回level 0的SSTable数量, 以及超出阈值等待压缩的层的总字节数, 用于写入限流.
+//  最底层压缩到自己, 压缩之后大小不会变小, 不算在内; PartSize <= 0 时不按数量计算
+//  @receiver s
+//  @return int
+//  @return int64
+//
+func (s *SSTableTree) CompactionPressure() (int, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.levels) == 0 {
+		return 0, 0
+	}
+	var pending int64
+	for level := 0; level < len(s.levels)-1; level++ {
+		size, _ := s.GetLevelSize(level)
+		if (s.cfg.PartSize > 0 && s.GetTableNums(level) > s.cfg.PartSize) || int(size/1000/1000) > s.levelMaxSize[level] {
+			pending += size
+		}
+	}
+	return s.GetTableNums(0), pending
+}
+
 //
 // GetLevelSize
 //  @Description: 获取指定层的SSTable大小
 //  @receiver s
 //  @param level
 //  @return int64
+//  @return error
 //
-func (s *SSTableTree) GetLevelSize(level int) int64 {
+func (s *SSTableTree) GetLevelSize(level int) (int64, error) {
 	var size int64
 	cur := s.levels[level]
 	for cur != nil {
-		size += cur.table.GetDbSize()
+		tableSize, err := cur.table.GetDbSize()
+		if err != nil {
+			return 0, err
+		}
+		size += tableSize
 		cur = cur.next
 	}
-	return size
+	return size, nil
 }
 
 //
@@ -3,8 +3,10 @@ package lsmtree
 import (
 	"github.com/ygzhang-yolo/lsmtree/config"
 	"github.com/ygzhang-yolo/lsmtree/db"
+	"github.com/ygzhang-yolo/lsmtree/kv"
 	"github.com/ygzhang-yolo/lsmtree/monitor"
 	"log"
+	"time"
 )
 
 /**
@@ -13,39 +15,357 @@ import (
  * @Func:
  **/
 
-func Start(cfg config.Config) {
-	// 保证database只能启动一次
-	if db.DB != nil {
-		return
-	}
-	// 初始化配置, 将配置保存到内存
-	log.Println("Loading a Configuration File")
-	config.Init(cfg)
+// DB 一个打开的数据库实例
+type DB = db.Database
+
+// 各存储层返回的错误类型, 可以用errors.Is判断
+var (
+	ErrIO            = kv.ErrIO
+	ErrCorrupt       = kv.ErrCorrupt
+	ErrClosed        = kv.ErrClosed
+	ErrConflict      = kv.ErrConflict
+	ErrTxnDone       = kv.ErrTxnDone
+	ErrComparator    = kv.ErrComparator
+	ErrMergeOperator = kv.ErrMergeOperator
+	ErrNoFamily      = kv.ErrNoFamily
+	ErrFamilyExists  = kv.ErrFamilyExists
+	ErrSlowConsumer  = kv.ErrSlowConsumer
+	ErrTruncated     = kv.ErrTruncated
+)
+
+// Codec 值的编码方式, 以及内置的几种编码方式
+type Codec = kv.Codec
+
+var (
+	JSON = kv.JSON
+	Gob  = kv.Gob
+	Raw  = kv.Raw
+)
+
+// Comparator key的比较器, 以及内置的几种比较器
+type Comparator = kv.Comparator
 
+var (
+	Bytewise = kv.Bytewise
+	Reverse  = kv.Reverse
+)
+
+// MergeOperator 合并操作, 以及内置的几种合并操作
+type MergeOperator = kv.MergeOperator
+
+var (
+	Int64Add    = kv.Int64Add
+	BytesAppend = kv.BytesAppend
+)
+
+// 默认实例, 由Start打开, 供包级别的辅助函数使用
+var defaultDB *DB
+
+//
+// Open
+//  @Description: 按照cfg打开一个独立的数据库实例, 每个实例拥有各自的内存表, WAL, SSTable和后台监视协程
+//  @param cfg
+//  @return *DB
+//  @return error
+//
+func Open(cfg config.Config) (*DB, error) {
 	// 初始化kv数据库databse
-	db.InitDatabase(cfg.DataDir)
+	log.Println("Loading a Configuration File")
+	d, err := db.NewDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	// 检查内存和数据库文件
-	monitor.CheckMemory()
-	db.DB.SSTableTree.Check()
+	// 检查每个列族的内存和数据库文件
+	for _, cf := range d.Families() {
+		if err = monitor.CheckMemory(cf); err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+		if err = cf.Compact(); err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
 
 	// 开启后台监视线程, 周期性检查memTable和SSTable大小
-	go monitor.Monitor()
+	d.Background(func(stop <-chan struct{}) {
+		monitor.Monitor(d, stop)
+	})
+	return d, nil
+}
+
+//
+// Start
+//  @Description: 打开默认实例, 之后可以使用包级别的Get, Set等函数
+//  @param cfg
+//  @return error
+//
+func Start(cfg config.Config) error {
+	// 保证默认实例只能启动一次
+	if defaultDB != nil {
+		return nil
+	}
+	d, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	defaultDB = d
+	return nil
+}
+
+//
+// Close
+//  @Description: 关闭Start打开的默认实例
+//  @return error
+//
+func Close() error {
+	if defaultDB == nil {
+		return nil
+	}
+	err := defaultDB.Close()
+	defaultDB = nil
+	return err
+}
+
+// 对外提供的方法的封装, 操作的都是默认实例, 没有Start时返回ErrClosed...
+func Get[T any](key string) (T, bool, error) {
+	if defaultDB == nil {
+		var nilValue T
+		return nilValue, false, ErrClosed
+	}
+	return db.Get[T](defaultDB, key)
+}
+
+func Set[T any](key string, value T) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.Set[T](defaultDB, key, value)
 }
 
-// 对外提供的方法的封装...
-func Get[T any](key string) (T, bool) {
-	return db.Get[T](key)
+func GetRaw(key string) ([]byte, bool, error) {
+	if defaultDB == nil {
+		return nil, false, ErrClosed
+	}
+	return defaultDB.GetRaw(key)
+}
+
+func SetRaw(key string, value []byte) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.SetRaw(key, value)
+}
+
+func DeleteRaw(key string) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.DeleteRaw(key)
+}
+
+func GetBytes(key []byte) ([]byte, bool, error) {
+	if defaultDB == nil {
+		return nil, false, ErrClosed
+	}
+	return defaultDB.GetBytes(key)
+}
+
+func SetBytes(key []byte, value []byte) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.SetBytes(key, value)
+}
+
+func DeleteBytes(key []byte) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.DeleteBytes(key)
+}
+
+func SetWith[T any](key string, value T, codec kv.Codec) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.SetWith[T](defaultDB, key, value, codec)
 }
 
-func Set[T any](key string, value T) bool {
-	return db.Set[T](key, value)
+func SetWithTTL[T any](key string, value T, ttl time.Duration) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.SetWithTTL[T](defaultDB, key, value, ttl)
+}
+
+func DeleteAndGet[T any](key string) (T, bool, error) {
+	if defaultDB == nil {
+		var nilValue T
+		return nilValue, false, ErrClosed
+	}
+	return db.DeleteAndGet[T](defaultDB, key)
 }
 
-func DeleteAndGet[T any](key string) (T, bool) {
-	return db.DeleteAndGet[T](key)
+func Delete[T any](key string) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.Delete(defaultDB, key)
+}
+
+func DeleteRange(start string, end string) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.DeleteRange(defaultDB, start, end)
+}
+
+func ApproximateSize(start string, end string) (int64, error) {
+	if defaultDB == nil {
+		return 0, ErrClosed
+	}
+	return db.ApproximateSize(defaultDB, start, end)
 }
 
-func Delete[T any](key string) {
-	db.Delete[T](key)
+func ApproximateCount(start string, end string) (int, error) {
+	if defaultDB == nil {
+		return 0, ErrClosed
+	}
+	return db.ApproximateCount(defaultDB, start, end)
+}
+
+func Stats() (db.Stats, error) {
+	if defaultDB == nil {
+		return db.Stats{}, ErrClosed
+	}
+	return defaultDB.Stats(), nil
+}
+
+func Subscribe(prefix string) (*db.Subscription, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return db.Subscribe(defaultDB, prefix)
+}
+
+func SubscribeFrom(prefix string, seq uint64) (*db.Subscription, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return db.SubscribeFrom(defaultDB, prefix, seq)
+}
+
+func Scan(start string, end string) *db.Iterator {
+	if defaultDB == nil {
+		return db.NewErrIterator(ErrClosed)
+	}
+	return db.Scan(defaultDB, start, end)
+}
+
+func ScanPrefix(prefix string) *db.Iterator {
+	if defaultDB == nil {
+		return db.NewErrIterator(ErrClosed)
+	}
+	return db.ScanPrefix(defaultDB, prefix)
+}
+
+func Snapshot() (*db.Snapshot, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return defaultDB.Snapshot()
+}
+
+func GetAt[T any](s *db.Snapshot, key string) (T, bool, error) {
+	return db.GetAt[T](s, key)
+}
+
+func NewWriteBatch() *db.WriteBatch {
+	if defaultDB == nil {
+		return db.NewWriteBatch()
+	}
+	return defaultDB.NewWriteBatch()
+}
+
+func Write(b *db.WriteBatch) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.Write(defaultDB, b)
+}
+
+func Begin() (*db.Txn, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return defaultDB.Begin()
+}
+
+func GetIn[T any](t *db.Txn, key string) (T, bool, error) {
+	return db.GetIn[T](t, key)
+}
+
+func CompareAndSwap[T any](key string, old T, new T) (bool, error) {
+	if defaultDB == nil {
+		return false, ErrClosed
+	}
+	return db.CompareAndSwap[T](defaultDB, key, old, new)
+}
+
+func SetIfAbsent[T any](key string, value T) (bool, error) {
+	if defaultDB == nil {
+		return false, ErrClosed
+	}
+	return db.SetIfAbsent[T](defaultDB, key, value)
+}
+
+func DeleteIfEquals[T any](key string, value T) (bool, error) {
+	if defaultDB == nil {
+		return false, ErrClosed
+	}
+	return db.DeleteIfEquals[T](defaultDB, key, value)
+}
+
+func Merge[T any](key string, operand T) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return db.Merge[T](defaultDB, key, operand)
+}
+
+func MergeRaw(key string, operand []byte) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.MergeRaw(key, operand)
+}
+
+func CreateFamily(name string, opts config.Config) (*DB, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return defaultDB.CreateFamily(name, opts)
+}
+
+func Family(name string) (*DB, error) {
+	if defaultDB == nil {
+		return nil, ErrClosed
+	}
+	return defaultDB.Family(name)
+}
+
+func DropFamily(name string) error {
+	if defaultDB == nil {
+		return ErrClosed
+	}
+	return defaultDB.DropFamily(name)
+}
+
+func Exists(key string) (bool, error) {
+	if defaultDB == nil {
+		return false, ErrClosed
+	}
+	return defaultDB.Exists(key)
 }
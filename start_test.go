@@ -0,0 +1,194 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/ygzhang-yolo/lsmtree/config"
+	"github.com/ygzhang-yolo/lsmtree/db"
+	"github.com/ygzhang-yolo/lsmtree/monitor"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/**
+ * @Author: agent
+ * @Date: 2026/10/18 08:59
+ * @Func:
+ **/
+
+func testConfig(dir string) config.Config {
+	return config.Config{
+		DataDir:       dir,
+		Level0Size:    1,
+		PartSize:      4,
+		Threshold:     100,
+		CheckInterval: 1,
+	}
+}
+
+func TestOpenIndependent(t *testing.T) {
+	cache, err := Open(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	meta, err := Open(testConfig(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta.Close()
+
+	if err = db.Set[string](cache, "a", "cache_value"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set[string](meta, "a", "meta_value"); err != nil {
+		t.Fatal(err)
+	}
+
+	v, ok, err := db.Get[string](cache, "a")
+	if err != nil || !ok || v != "cache_value" {
+		t.Errorf("cache got %q, %v, %v", v, ok, err)
+	}
+	v, ok, err = db.Get[string](meta, "a")
+	if err != nil || !ok || v != "meta_value" {
+		t.Errorf("meta got %q, %v, %v", v, ok, err)
+	}
+
+	if err = db.Delete(cache, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = db.Get[string](cache, "a"); ok {
+		t.Error("the key 'a' should be deleted in cache")
+	}
+	if _, ok, _ = db.Get[string](meta, "a"); !ok {
+		t.Error("the key 'a' should still exist in meta")
+	}
+}
+
+func TestCloseAndReopen(t *testing.T) {
+	for _, flush := range []bool{false, true} {
+		cfg := testConfig(t.TempDir())
+		cfg.FlushOnClose = flush
+		d, err := Open(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Set[int](d, "a", 1)
+		_ = db.Set[int](d, "b", 2)
+		_ = db.Delete(d, "a")
+		if err = d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// 重复关闭是安全的, 关闭后的读写返回ErrClosed
+		if err = d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Set[int](d, "c", 3); !errors.Is(err, ErrClosed) {
+			t.Errorf("set after close, got %v", err)
+		}
+
+		d, err = Open(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flush && d.MemoryTree.GetCount() != 0 {
+			t.Errorf("flush=%v, the memory table should be empty after reopen", flush)
+		}
+		if _, ok, _ := db.Get[int](d, "a"); ok {
+			t.Errorf("flush=%v, the key 'a' should be deleted", flush)
+		}
+		if v, ok, err := db.Get[int](d, "b"); err != nil || !ok || v != 2 {
+			t.Errorf("flush=%v, got %v, %v, %v", flush, v, ok, err)
+		}
+		if err = d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	if err := os.WriteFile(filepath.Join(cfg.DataDir, "0.0.db"), []byte("bad"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(cfg); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("open with a bad db file, got %v", err)
+	}
+}
+
+func TestOpenUnknownVersion(t *testing.T) {
+	cfg := testConfig(t.TempDir())
+	d, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set[string](d, "a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 元数据区在文件末尾, 第一个int64是版本号
+	path := filepath.Join(cfg.DataDir, "0.0.db")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint64(data[len(data)-8*5:], 7)
+	if err = os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(cfg); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("open with an unknown table version, got %v", err)
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		threshold int
+		buffer    int64
+		value     []byte // 为nil时写入删除标记
+	}{
+		// 按字节数落盘, 不限制数量
+		{"bytes", 0, 8 << 10, make([]byte, 1<<10)},
+		// 字节数没有超出, 数量超出
+		{"count", 10, 1 << 20, []byte("v")},
+		// 删除标记也计入数量
+		{"tombstones", 10, 1 << 20, nil},
+		// 只配置了数量时仍然使用默认的字节数限制
+		{"default bytes", 100, 0, make([]byte, config.DefaultWriteBufferSize/8)},
+	} {
+		cfg := testConfig(t.TempDir())
+		cfg.CheckInterval = 0
+		cfg.Threshold, cfg.WriteBufferSize = tt.threshold, tt.buffer
+		d, err := Open(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := func(key string) {
+			if tt.value == nil {
+				_ = d.Delete(key)
+			} else {
+				_ = d.SetRaw(key, tt.value)
+			}
+		}
+		for i := 0; i < 5; i++ {
+			write(string(rune('a' + i)))
+		}
+		if err = monitor.CheckMemory(d); err != nil || d.MemoryTree.Empty() {
+			t.Errorf("%s: flushed below the limits, %v", tt.name, err)
+		}
+		for i := 5; i < 10; i++ {
+			write(string(rune('a' + i)))
+		}
+		if err = monitor.CheckMemory(d); err != nil || !d.MemoryTree.Empty() {
+			t.Errorf("%s: not flushed above the limits, size %d, %v", tt.name, d.MemoryTree.ApproximateSize(), err)
+		}
+		_ = d.Close()
+	}
+}
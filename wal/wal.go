@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
-	"github.com/ygzhang-yolo/lsmtree/bst"
+	"errors"
+	"fmt"
 	"github.com/ygzhang-yolo/lsmtree/kv"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 )
@@ -24,21 +26,52 @@ import (
 //  @Description: WAL的对象
 //
 type Wal struct {
-	f    *os.File    //保存的文件句柄
-	path string      //保存的文件路径
-	mu   sync.Locker //保证文件资源互斥访问的锁
+	f        *os.File    //保存的文件句柄
+	path     string      //保存的文件路径
+	dir      string      //wal.log所在的目录
+	last     uint64      //wal.log中最大的序列号
+	segments []segment   //切换出去的旧文件, 从旧到新排列
+	next     int         //下一个旧文件的编号
+	mu       sync.Locker //保证文件资源互斥访问的锁
 }
 
-const walName = "wal.log" //定义wal log文件的默认日志名为wal.log
+//
+//  segment
+//  @Description: 随内存表切换出去的一段wal.log, 其中的写入都已经在不可变内存表中, 落盘之后可以删除
+//
+type segment struct {
+	path string
+	last uint64 //其中最大的序列号
+	size int64
+}
+
+const (
+	walName       = "wal.log"    //定义wal log文件的默认日志名为wal.log
+	segmentFormat = "wal.%d.log" //切换出去的旧文件的文件名, 编号越大越新
+)
+
+// 批量写入记录的第一个字节; 单个写入的记录就是kv.Encode的结果, 第一个字节是它的格式版本
+const batchRecord byte = 0xb0
+
+//
+//  jsonRecord
+//  @Description: 旧版本wal.log中JSON格式的记录, 单个写入只有Value; 批量写入的所有Value放在Batch中
+//
+type jsonRecord struct {
+	kv.Value
+	Batch []kv.Value `json:",omitempty"`
+}
 
 //
 // Init
-//  @Description: WAL对应的初始化操作
+//  @Description: WAL对应的初始化操作, 按从旧到新的顺序把切换出去的旧文件和wal.log中的每条记录交给replay,
+//  由调用方还原到各个列族的内存表中
 //  @receiver w
 //  @param dir
-//  @return *bst.BSTree
+//  @param replay	一条记录中的所有Value, 单个写入只有一个
+//  @return error
 //
-func (w *Wal) Init(dir string) *bst.BSTree {
+func (w *Wal) Init(dir string, replay func(values []kv.Value)) error {
 	log.Printf("Loading Wal log from file %v", walName)
 	// 统计启动的时间
 	start := time.Now()
@@ -46,90 +79,179 @@ func (w *Wal) Init(dir string) *bst.BSTree {
 		elapse := time.Since(start)
 		log.Println("Loaded Wal log finished, total time: ", elapse)
 	}()
+	w.dir = dir
+	w.mu = &sync.Mutex{}
+	if err := w.loadSegments(replay); err != nil {
+		return err
+	}
 	// 创建对应的wal.log文件
 	walPath := path.Join(dir, walName)
 	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		log.Printf("The %v file created failed", walName)
-		panic(err)
+		return kv.IOError("open file", walPath, err)
 	}
 	w.f = f
 	w.path = walPath
-	w.mu = &sync.Mutex{}
 	// 将wal.log文件加载到内存
-	return w.loadMemory()
+	if err = w.loadMemory(replay); err != nil {
+		_ = f.Close()
+		w.f = nil
+		return err
+	}
+	return nil
 }
 
 //
 // loadMemory
-//  @Description: 解析将wal.log文件的日志加载到内存, 建立MemTable
+//  @Description: 解析将wal.log文件的日志, 依次交给replay还原MemTable, 末尾写了一半的记录会被丢弃
 //  @receiver w
-//  @return *bst.BSTree
+//  @param replay
+//  @return error
 //
-func (w *Wal) loadMemory() *bst.BSTree {
+func (w *Wal) loadMemory(replay func(values []kv.Value)) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-
-	memTable := bst.NewBSTree()
-	info, _ := os.Stat(w.path)
-	size := info.Size() //文件大小
-
-	// 如果log文件为空, 返回空memTable
-	if size == 0 {
-		return &memTable
+	complete, size, err := read(w.f, w.path, func(values []kv.Value) {
+		w.last = maxSeq(w.last, values)
+		replay(values)
+	})
+	if err != nil {
+		return err
 	}
-	// NOTE: 从头读取日志文件, 必须要重置文件指针; Seek(0,0)设置文件读写指针移动到开始位置
-	_, err := w.f.Seek(0, 0)
+	if complete < size {
+		return w.truncate(complete)
+	}
+	return nil
+}
+
+//
+// loadSegments
+//  @Description: 按编号从旧到新重放切换出去的旧文件, 记录每个文件中最大的序列号
+//  @receiver w
+//  @param replay
+//  @return error
+//
+func (w *Wal) loadSegments(replay func(values []kv.Value)) error {
+	entries, err := os.ReadDir(w.dir)
 	if err != nil {
-		log.Println("Failed to open the wal.log")
-		panic(err)
+		return kv.IOError("read dir", w.dir, err)
+	}
+	numbers := make([]int, 0)
+	for _, entry := range entries {
+		var number int
+		if _, err = fmt.Sscanf(entry.Name(), segmentFormat, &number); err == nil && fmt.Sprintf(segmentFormat, number) == entry.Name() {
+			numbers = append(numbers, number)
+		}
 	}
-	// 同理, 只要文件打开成功, 读取结束, 要将文件指针移到最后, 方便下次追加
-	defer func(f *os.File, offset int64, whence int) {
-		_, err := f.Seek(offset, whence)
+	sort.Ints(numbers)
+	for _, number := range numbers {
+		seg := segment{path: path.Join(w.dir, fmt.Sprintf(segmentFormat, number))}
+		f, err := os.Open(seg.path)
 		if err != nil {
-			log.Println("Failed to open the wal.log")
-			panic(err)
+			return kv.IOError("open file", seg.path, err)
 		}
-	}(w.f, size-1, 0)
-	// 将log文件中的数据全部读到内存
-	data := make([]byte, size)
-	_, err = w.f.Read(data)
+		// 旧文件不再写入, 末尾写了一半的记录直接忽略
+		_, seg.size, err = read(f, seg.path, func(values []kv.Value) {
+			seg.last = maxSeq(seg.last, values)
+			replay(values)
+		})
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, seg)
+		w.next = number + 1
+	}
+	return nil
+}
+
+//
+// Read
+//  @Description: 按从旧到新的顺序把切换出去的旧文件和wal.log中当前的每条记录交给fn, 不修改文件; 用于从某个序列号开始重放写入
+//  @receiver w
+//  @param fn
+//  @return error
+//
+func (w *Wal) Read(fn func(values []kv.Value)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return kv.ErrClosed
+	}
+	for _, seg := range w.segments {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return kv.IOError("open file", seg.path, err)
+		}
+		_, _, err = read(f, seg.path, fn)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	_, _, err := read(w.f, w.path, fn)
+	return err
+}
+
+//
+// read
+//  @Description: 解析文件中的每条记录交给fn, 遇到写了一半的记录时停止; 读取wal.log时调用方需要持有w.mu
+//  @param f
+//  @param path
+//  @param fn
+//  @return int64	完整的记录的总长度
+//  @return int64	文件大小
+//  @return error
+//
+func read(f *os.File, path string, fn func(values []kv.Value)) (int64, int64, error) {
+	info, err := f.Stat()
 	if err != nil {
-		log.Println("Failed to read the wal.log")
-		panic(err)
+		return 0, 0, kv.IOError("stat file", path, err)
+	}
+	size := info.Size() //文件大小
+
+	// 如果log文件为空, 没有需要还原的数据
+	if size == 0 {
+		return 0, 0, nil
+	}
+	// 将log文件中的数据全部读到内存, 文件以O_APPEND打开, 之后的写入总是追加到末尾
+	data := make([]byte, size)
+	if _, err = f.ReadAt(data, 0); err != nil {
+		return 0, 0, kv.IOError("read file", path, err)
 	}
 
 	bodyLen := int64(0) //log每一项entry的长度
 	index := int64(0)   //遍历data的索引
 	for index < size {
 		// 前8字节header代表每一项Value的大小, 先提取出每一项entry的长度
+		if index+8 > size {
+			return index, size, nil
+		}
 		headerData := data[index:(index + 8)]
 		buf := bytes.NewBuffer(headerData)                    //创建字节缓冲区
 		err = binary.Read(buf, binary.LittleEndian, &bodyLen) //将headerData中的内容读到entryLen中
 		if err != nil {
-			log.Println("Fail to read header entryLen from buffer")
-			panic(err)
+			return 0, 0, kv.CorruptError(path, "invalid header at offset %d", index)
 		}
 		// 根据entryLen, 提取出entry的字节并还原为Value
+		if bodyLen < 0 {
+			return 0, 0, kv.CorruptError(path, "invalid header at offset %d", index)
+		}
+		if index+8+bodyLen > size {
+			return index, size, nil
+		}
 		index += 8
 		bodyData := data[index:(index + bodyLen)]
-		var value kv.Value
-		err = json.Unmarshal(bodyData, &value)
+		values, err := decodeRecord(bodyData)
 		if err != nil {
-			log.Println("Fail to umarshal entry data from buffer")
-			panic(err)
-		}
-		// 根据Value的类型, 插入到MemTable中完成还原
-		if value.Deleted == true {
-			memTable.Delete(value.Key)
-		} else {
-			memTable.Set(value.Key, value.Value)
+			return 0, 0, kv.CorruptError(path, "invalid entry at offset %d: %v", index, err)
 		}
+		// 交给调用方处理, 例如插入到MemTable中完成还原
+		fn(values)
 		// 遍历下一个entry
 		index = index + bodyLen
 	}
-	return &memTable
+	return size, size, nil
 }
 
 //
@@ -137,46 +259,261 @@ func (w *Wal) loadMemory() *bst.BSTree {
 //  @Description: 执行写入操作时需要同步执行的Write写日志
 //  @receiver w
 //  @param value
+//  @return error
 //
-func (w *Wal) Write(value kv.Value) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+func (w *Wal) Write(value kv.Value) error {
 	if value.Deleted {
 		log.Println("wal.log:	delete ", value.Key)
 	} else {
 		log.Println("wal.log:	set ", value.Key)
 	}
-	// 将value序列化为二进制数据
-	body, _ := json.Marshal(value)
-	header := len(body)
-	// 先写入value的长度作为header, 再写入数据作为body
-	err := binary.Write(w.f, binary.LittleEndian, int64(header))
-	err = binary.Write(w.f, binary.LittleEndian, body)
+	body, err := kv.Encode(value)
 	if err != nil {
-		log.Printf("Fail to Write value=%v to log", value)
-		panic(err)
+		return err
 	}
+	return w.writeRecord(body, value.Seq)
 }
 
 //
-// Reset
-//  @Description: 重置日志文件, 用来在memTable满了要落盘的时候, 重置wal
+// WriteBatch
+//  @Description: 将一批Value作为一条记录写入wal.log, 恢复时要么全部还原, 要么全部丢弃
 //  @receiver w
+//  @param values
+//  @return error
+//
+func (w *Wal) WriteBatch(values []kv.Value) error {
+	log.Println("wal.log:	batch of ", len(values))
+	// 依次写入数量和每个Value的长度, 数据
+	body := []byte{batchRecord}
+	buf := make([]byte, binary.MaxVarintLen64)
+	body = append(body, buf[:binary.PutUvarint(buf, uint64(len(values)))]...)
+	for _, value := range values {
+		data, err := kv.Encode(value)
+		if err != nil {
+			return err
+		}
+		body = append(body, buf[:binary.PutUvarint(buf, uint64(len(data)))]...)
+		body = append(body, data...)
+	}
+	return w.writeRecord(body, maxSeq(0, values))
+}
+
+//
+// decodeRecord
+//  @Description: 还原一条记录中的所有Value, 兼容旧版本的JSON格式
+//  @param body
+//  @return []kv.Value
+//  @return error
+//
+func decodeRecord(body []byte) ([]kv.Value, error) {
+	if len(body) > 0 && body[0] == '{' {
+		var rec jsonRecord
+		if err := json.Unmarshal(body, &rec); err != nil {
+			return nil, err
+		}
+		if rec.Batch != nil {
+			return rec.Batch, nil
+		}
+		return []kv.Value{rec.Value}, nil
+	}
+	if len(body) == 0 || body[0] != batchRecord {
+		value, err := kv.Decode(body)
+		if err != nil {
+			return nil, err
+		}
+		return []kv.Value{value}, nil
+	}
+	body = body[1:]
+	count, n := binary.Uvarint(body)
+	if n <= 0 {
+		return nil, errors.New("invalid batch size")
+	}
+	body = body[n:]
+	values := make([]kv.Value, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || size > uint64(len(body)-n) {
+			return nil, errors.New("invalid batch entry")
+		}
+		value, err := kv.Decode(body[n : n+int(size)])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		body = body[n+int(size):]
+	}
+	return values, nil
+}
+
 //
-func (w *Wal) Reset() {
+// maxSeq
+//  @Description: 返回last和values中最大的序列号
+//  @param last
+//  @param values
+//  @return uint64
+//
+func maxSeq(last uint64, values []kv.Value) uint64 {
+	for _, value := range values {
+		if value.Seq > last {
+			last = value.Seq
+		}
+	}
+	return last
+}
+
+func (w *Wal) writeRecord(body []byte, seq uint64) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	log.Println("Resetting the wal.log file")
-
-	_ = w.f.Close() // 关闭文件句柄
+	if w.f == nil {
+		return kv.ErrClosed
+	}
+	// 先写入记录的长度作为header, 再写入数据作为body, 一次Write写完避免只写了一半header
+	data := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint64(data, uint64(len(body)))
+	data = append(data, body...)
+	if _, err := w.f.Write(data); err != nil {
+		return kv.IOError("write file", w.path, err)
+	}
+	if seq > w.last {
+		w.last = seq
+	}
+	return nil
+}
 
-	w.f = nil
-	_ = os.Remove(w.path) //删除文件
+//
+// truncate
+//  @Description: 丢弃从offset开始写了一半的记录, 一般是写入过程中崩溃留下的; 调用方需要持有w.mu
+//  @receiver w
+//  @param offset
+//  @return error
+//
+func (w *Wal) truncate(offset int64) error {
+	log.Printf("Dropping the incomplete record at offset %d of %s\r\n", offset, w.path)
+	if err := w.f.Truncate(offset); err != nil {
+		return kv.IOError("truncate file", w.path, err)
+	}
+	return nil
+}
 
-	// 创建一个空的新文件
+//
+// Rotate
+//  @Description: 把当前的wal.log切换为一个旧文件, 之后的写入进入新的wal.log; wal.log为空时不切换.
+//  和内存表的切换一起进行, 切换出去的内存表中的写入都在旧文件中, 落盘之后用Retire删除
+//  @receiver w
+//  @return error
+//
+func (w *Wal) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return kv.ErrClosed
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return kv.IOError("stat file", w.path, err)
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	seg := segment{path: path.Join(w.dir, fmt.Sprintf(segmentFormat, w.next)), last: w.last, size: info.Size()}
+	log.Println("Rotating the wal.log file to ", seg.path)
+	if err = os.Rename(w.path, seg.path); err != nil {
+		return kv.IOError("rename file", w.path, err)
+	}
+	// 创建一个空的新文件, 失败时改回原来的名字, 继续写入旧的文件
 	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		panic(err)
+		_ = os.Rename(seg.path, w.path)
+		return kv.IOError("create file", w.path, err)
 	}
+	_ = w.f.Close()
 	w.f = f
+	w.segments = append(w.segments, seg)
+	w.next++
+	w.last = 0
+	return nil
+}
+
+//
+// Retire
+//  @Description: 从最旧的开始删除最大序列号不超过seq的旧文件, 遇到不能删除的就停止, 剩下的写入仍然是连续的
+//  @receiver w
+//  @param seq	不大于它的写入都已经落盘
+//  @return uint64	删除的最后一个文件中最大的序列号, 没有删除时为0
+//  @return error
+//
+func (w *Wal) Retire(seq uint64) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var base uint64
+	for len(w.segments) > 0 && w.segments[0].last <= seq {
+		seg := w.segments[0]
+		log.Println("Removing the wal segment ", seg.path)
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return base, kv.IOError("remove file", seg.path, err)
+		}
+		base = seg.last
+		w.segments = w.segments[1:]
+	}
+	return base, nil
+}
+
+//
+// Size
+//  @Description: 返回wal.log和切换出去的旧文件的总字节数
+//  @receiver w
+//  @return int64
+//
+func (w *Wal) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var size int64
+	for _, seg := range w.segments {
+		size += seg.size
+	}
+	if w.f != nil {
+		if info, err := w.f.Stat(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+//
+// Archived
+//  @Description: 返回切换出去的旧文件中最大的序列号, 没有旧文件时返回0
+//  @receiver w
+//  @return uint64
+//
+func (w *Wal) Archived() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.segments) == 0 {
+		return 0
+	}
+	return w.segments[len(w.segments)-1].last
+}
+
+//
+// Close
+//  @Description: 将wal.log刷到磁盘并关闭文件句柄
+//  @receiver w
+//  @return error
+//
+func (w *Wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	log.Println("Closing the wal.log file")
+	if err := w.f.Sync(); err != nil {
+		return kv.IOError("sync file", w.path, err)
+	}
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return kv.IOError("close file", w.path, err)
+	}
+	return nil
 }